@@ -2,4 +2,4 @@ module nawaphon
 
 go 1.24.6
 
-require github.com/anishathalye/porcupine v1.0.3 // indirect
+require github.com/anishathalye/porcupine v1.0.3
@@ -0,0 +1,152 @@
+package kv_server_with_stable_network
+
+import "strings"
+
+// A KVServer can check the requests of clerks against an ACL. A clerk
+// sends the Credential it was made with in every request, and the
+// server accepts a request only if the Secret matches the one the ACL
+// holds for the Principal, and some rule for the Principal grants the
+// permission the request needs for each of its keys: a rule covers the
+// keys that start with its Prefix, and the rules of a principal add
+// up. Keys that no rule covers, for any principal, stay open to every
+// clerk, including those with no credential, so that an ACL only
+// guards the prefixes it names. The server answers any other request
+// with ErrPermission.
+//
+// Scan leaves out the keys the clerk may not read, before it counts
+// them against its limit. ReadChanges, Dump, and Restore reach all
+// keys, so they need a rule with the empty prefix. The server checks a
+// request before performing it and then clears its credential, so
+// that secrets stay out of the Raft log; a Scan keeps the principal,
+// which scanL needs.
+//
+// The RPCs that servers send each other (see pb.go), and that the
+// shard controller sends the groups (see shard.go), install and hand
+// over keys without regard to the rules. With an ACL, a server takes
+// them only with the credential of the ACL's Server principal, which
+// the servers send with the secret the ACL holds for it, and which
+// the shard controller must be made with (see
+// MakeShardCtrlerWithCredential).
+
+type Perm int
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+
+	PermReadWrite = PermRead | PermWrite
+)
+
+type Credential struct {
+	Principal string
+	Secret    string
+}
+
+type ACLRule struct {
+	Prefix    string
+	Principal string
+	Perm      Perm
+}
+
+type ACL struct {
+	Secrets map[string]string // by principal
+	Rules   []ACLRule
+	Server  string // the principal of the servers themselves
+}
+
+// authentic reports whether cred names a principal of the ACL, with
+// its secret. The empty credential is that of an anonymous clerk.
+func (acl *ACL) authentic(cred Credential) bool {
+	if cred.Principal == "" {
+		return cred.Secret == ""
+	}
+	secret, ok := acl.Secrets[cred.Principal]
+	return ok && secret == cred.Secret
+}
+
+// allows reports whether cred may access key with perm. A nil ACL
+// allows everything.
+func (acl *ACL) allows(cred Credential, key string, perm Perm) bool {
+	if acl == nil {
+		return true
+	}
+	return acl.authentic(cred) && acl.grants(cred.Principal, key, perm)
+}
+
+// grants reports whether the rules let principal access key with perm,
+// for a principal whose secret was checked already. A nil ACL grants
+// everything.
+func (acl *ACL) grants(principal string, key string, perm Perm) bool {
+	if acl == nil {
+		return true
+	}
+	covered := false
+	granted := Perm(0)
+	for _, r := range acl.Rules {
+		if !strings.HasPrefix(key, r.Prefix) {
+			continue
+		}
+		covered = true
+		if r.Principal == principal && principal != "" {
+			granted |= r.Perm
+		}
+	}
+	return !covered || granted&perm == perm
+}
+
+// allowsAll reports whether cred may access every key with perm.
+func (acl *ACL) allowsAll(cred Credential, perm Perm) bool {
+	if acl == nil {
+		return true
+	}
+	if !acl.authentic(cred) || cred.Principal == "" {
+		return false
+	}
+	granted := Perm(0)
+	for _, r := range acl.Rules {
+		if r.Prefix == "" && r.Principal == cred.Principal {
+			granted |= r.Perm
+		}
+	}
+	return granted&perm == perm
+}
+
+// authorize checks that *cred may access keys with perm, and then
+// clears *cred.
+func (kv *KVServer) authorize(cred *Credential, perm Perm, keys ...string) bool {
+	defer func() { *cred = Credential{} }()
+	if kv.acl != nil && !kv.acl.authentic(*cred) {
+		return false
+	}
+	for _, k := range keys {
+		if !kv.acl.allows(*cred, k, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeAll is authorize for every key.
+func (kv *KVServer) authorizeAll(cred *Credential, perm Perm) bool {
+	defer func() { *cred = Credential{} }()
+	return kv.acl.allowsAll(*cred, perm)
+}
+
+// authorizeServer checks that *cred is that of the ACL's Server
+// principal, and then clears *cred. Without an ACL, any credential
+// will do.
+func (kv *KVServer) authorizeServer(cred *Credential) bool {
+	defer func() { *cred = Credential{} }()
+	if kv.acl == nil {
+		return true
+	}
+	return kv.acl.Server != "" && cred.Principal == kv.acl.Server && kv.acl.authentic(*cred)
+}
+
+// serverCred returns the credential this server sends to the others.
+func (kv *KVServer) serverCred() Credential {
+	if kv.acl == nil || kv.acl.Server == "" {
+		return Credential{}
+	}
+	return Credential{Principal: kv.acl.Server, Secret: kv.acl.Secrets[kv.acl.Server]}
+}
@@ -0,0 +1,349 @@
+package kv_server_with_stable_network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Admin is an RPC service that each KVServer registers next to itself,
+// for operators rather than clerks. Dump copies all keys with their
+// values and versions, a page at a time, from a snapshot that the
+// server takes when the dump starts, so the pages are consistent even
+// while clerks keep writing. Restore loads keys with their versions,
+// so that clerks' conditional Puts keep working on the restored keys;
+// it goes through the log and the backups like a MultiPut. See
+// Clerk.Dump and Clerk.Restore for the formats of a dump.
+
+// a dump that nobody reads for this long is dropped
+const DumpTimeout = time.Minute
+
+// the most keys in a page of a dump, or in a Restore
+const MaxDumpEntries = 256
+
+type DumpFormat int
+
+const (
+	DumpJSONLines DumpFormat = iota // one JSON DumpEntry per line
+	DumpLabgob                      // a labgob stream of DumpEntry
+)
+
+type Admin struct {
+	kv *KVServer
+
+	mu    sync.Mutex
+	dumps map[int64]*dump
+}
+
+type dump struct {
+	entries []DumpEntry // in key order
+	timer   *time.Timer // drops the dump once nobody reads it
+}
+
+func makeAdmin(kv *KVServer) *Admin {
+	return &Admin{kv: kv, dumps: make(map[int64]*dump)}
+}
+
+// Kill drops the dumps; the tester kills the KVServer itself.
+func (a *Admin) Kill() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, d := range a.dumps {
+		d.timer.Stop()
+		delete(a.dumps, id)
+	}
+}
+
+// Dump returns the page of dump args.Id that starts at args.Offset.
+// With args.Id 0, Dump takes a snapshot for a new dump and returns its
+// first page and Id. It returns ErrNoKey if the dump is gone, because
+// it timed out or this server took over from another.
+func (a *Admin) Dump(args *DumpArgs, reply *DumpReply) {
+	kv := a.kv
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.limiter.admit(args.ClientId) {
+		reply.Err = ErrBusy
+		return
+	}
+	defer kv.limiter.done()
+
+	if !kv.authorizeAll(&args.Cred, PermRead) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	id := args.Id
+	if id == 0 {
+		entries, err := a.snapshot()
+		if err != OK {
+			reply.Err = err
+			return
+		}
+		id = nrand()
+		a.mu.Lock()
+		a.dumps[id] = &dump{entries: entries, timer: time.AfterFunc(DumpTimeout, func() { a.drop(id) })}
+		a.mu.Unlock()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	d, ok := a.dumps[id]
+	if !ok || args.Offset > len(d.entries) {
+		reply.Err = ErrNoKey
+		return
+	}
+	d.timer.Reset(DumpTimeout)
+
+	end := min(args.Offset+MaxDumpEntries, len(d.entries))
+	reply.Id = id
+	reply.Entries = d.entries[args.Offset:end]
+	reply.Done = end == len(d.entries)
+	reply.Err = OK
+}
+
+func (a *Admin) drop(id int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.dumps, id)
+}
+
+// snapshot returns the keys this server serves, if it leads its group.
+// A Raft leader first puts a Get through the log, so that the
+// snapshot holds every request the group performed before the dump.
+func (a *Admin) snapshot() ([]DumpEntry, Err) {
+	kv := a.kv
+	if kv.raft != nil {
+		if _, ok := kv.submit(Op{Get: &GetArgs{}}); !ok {
+			return nil, ErrWrongLeader
+		}
+	} else {
+		if !kv.startOp() {
+			return nil, ErrWrongLeader
+		}
+		defer kv.endOp()
+	}
+
+	kv.mu.Lock()
+	ok := kv.primaryL()
+	engines := kv.snapshotL()
+	shards := slices.Clone(kv.shards)
+	kv.mu.Unlock()
+
+	if !ok || !kv.confirm() {
+		return nil, ErrWrongLeader
+	}
+	return dumpEntries(engines, shards), OK
+}
+
+// dumpEntries returns the keys of engines that haven't expired and that a
+// server with shards serves, in key order.
+func dumpEntries(engines []Engine, shards []ShardInfo) []DumpEntry {
+	now := time.Now()
+	entries := []DumpEntry{}
+	forEach(engines, func(key Key, value Value) {
+		if !value.expired(now) && owns(shards, string(key)) {
+			ns, k := splitKey(string(key))
+			entries = append(entries, DumpEntry{Namespace: ns, Key: k, Value: value.value, Version: value.version})
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return nsKey(entries[i].Namespace, entries[i].Key) < nsKey(entries[j].Namespace, entries[j].Key)
+	})
+	return entries
+}
+
+// Restore installs the keys in args.Entries with their versions. It
+// returns ErrVersion, and installs none of them, if any of the keys
+// exists, appears twice, or has version 0, and ErrNotEmpty if
+// args.Fresh is set and the server holds live keys in any namespace
+// of args.Entries. Like a Put, Restore is performed at most
+// once, however many times the RPC is resent.
+func (a *Admin) Restore(args *RestoreArgs, reply *RestoreReply) {
+	kv := a.kv
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.limiter.admit(args.ClientId) {
+		reply.Err = ErrBusy
+		return
+	}
+	defer kv.limiter.done()
+
+	for _, e := range args.Entries {
+		if !validKey(e.Namespace, e.Key) {
+			reply.Err = ErrBadKey
+			return
+		}
+	}
+	if !kv.authorizeAll(&args.Cred, PermWrite) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	res, ok := kv.perform(Op{Restore: args}, func(res *opResult) bool {
+		rec, ok := kv.restoreDump(args, &res.restore)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = RestoreReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.restore
+}
+
+func (kv *KVServer) restoreDump(args *RestoreArgs, reply *RestoreReply) (walRecord, bool) {
+	defer kv.maybeCompact()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.restoreOpL(args, reply)
+}
+
+// restoreOpL performs a Restore and returns the record to replicate,
+// unless the Restore is a duplicate. Caller must hold kv.mu.
+func (kv *KVServer) restoreOpL(args *RestoreArgs, reply *RestoreReply) (walRecord, bool) {
+	for _, e := range args.Entries {
+		if !kv.ownsL(nsKey(e.Namespace, e.Key)) {
+			reply.Err = ErrWrongGroup
+			return walRecord{}, false
+		}
+	}
+
+	if last, ok := kv.duplicateL(args.ClientId, args.Seq); ok {
+		if last != nil {
+			reply.Err = last.Err
+		}
+		return walRecord{}, false
+	}
+
+	keys := make([]string, len(args.Entries))
+	for i, e := range args.Entries {
+		keys[i] = nsKey(e.Namespace, e.Key)
+	}
+	kv.restoreEntriesL(args, reply)
+	kv.rememberL(args.ClientId, args.Seq, reply.Err, nil, keys...)
+
+	if reply.Err == OK {
+		evicted := kv.evictL(keys...)
+		return kv.persistL(args.ClientId, append(evicted, keys...)...), true
+	}
+	return kv.persistL(args.ClientId), true
+}
+
+func (kv *KVServer) restoreEntriesL(args *RestoreArgs, reply *RestoreReply) {
+	if args.Fresh && kv.holdsAnyL(args.Entries) {
+		reply.Err = ErrNotEmpty
+		return
+	}
+
+	var size int64
+	values := make(map[Key]string)
+	for _, e := range args.Entries {
+		key := Key(nsKey(e.Namespace, e.Key))
+		if _, found := kv.lookupL(key); found || e.Version == 0 {
+			reply.Err = ErrVersion
+			return
+		}
+		if _, twice := values[key]; twice {
+			reply.Err = ErrVersion
+			return
+		}
+		size += int64(len(key) + len(e.Value))
+		values[key] = e.Value
+	}
+	if kv.overQuotaL(values) {
+		reply.Err = ErrQuota
+		return
+	}
+	if kv.fullL(size, size) {
+		reply.Err = ErrFull
+		return
+	}
+
+	now := kv.nowL()
+	for _, e := range args.Entries {
+		key := Key(nsKey(e.Namespace, e.Key))
+		if _, found := kv.valueL(key); !found {
+			kv.index.insert(key)
+		}
+		kv.setValueL(key, Value{value: e.Value, version: e.Version, meta: KeyMeta{}.written(args.ClientId, now)})
+	}
+	kv.changed.Broadcast()
+
+	reply.Err = OK
+}
+
+// holdsAnyL reports whether this server serves a key that hasn't
+// expired in a namespace of entries. Caller must hold kv.mu.
+func (kv *KVServer) holdsAnyL(entries []DumpEntry) bool {
+	namespaces := make(map[string]bool)
+	for _, e := range entries {
+		namespaces[e.Namespace] = true
+	}
+	now := kv.nowL()
+	found := false
+	for i := range kv.stripes {
+		kv.stripes[i].engine.Iterate(func(key Key, value Value) bool {
+			ns, _ := splitKey(string(key))
+			found = namespaces[ns] && !value.expired(now) && kv.ownsL(string(key))
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func writeDump(w io.Writer, format DumpFormat, entries []DumpEntry) error {
+	var encode func(any) error
+	switch format {
+	case DumpJSONLines:
+		encode = json.NewEncoder(w).Encode
+	case DumpLabgob:
+		encode = NewEncoder(w).Encode
+	default:
+		return fmt.Errorf("unknown dump format %v", format)
+	}
+	for _, e := range entries {
+		if err := encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDump(r io.Reader, format DumpFormat) ([]DumpEntry, error) {
+	var decode func(any) error
+	switch format {
+	case DumpJSONLines:
+		decode = json.NewDecoder(r).Decode
+	case DumpLabgob:
+		decode = NewDecoder(r).Decode
+	default:
+		return nil, fmt.Errorf("unknown dump format %v", format)
+	}
+	entries := []DumpEntry{}
+	for {
+		e := DumpEntry{}
+		if err := decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
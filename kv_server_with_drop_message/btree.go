@@ -0,0 +1,299 @@
+package kv_server_with_stable_network
+
+import (
+	"slices"
+	"sort"
+)
+
+// btreeEngine is an ordered engine: a B-tree in which every node but
+// the root holds between BTreeDegree-1 and 2*BTreeDegree-1 keys, and
+// an inner node with n keys has n+1 children. Insertion splits full
+// nodes on the way down, and deletion tops up minimal nodes on the
+// way down, so neither ever has to walk back up.
+
+const BTreeDegree = 16
+
+const btreeMaxItems = 2*BTreeDegree - 1
+
+type btreeItem struct {
+	key   Key
+	value Value
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode // empty for a leaf
+}
+
+type btreeEngine struct {
+	root *btreeNode // nil if the tree is empty
+	n    int
+}
+
+func MakeBTreeEngine() Engine {
+	return &btreeEngine{}
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find returns the position of the first item >= key, and whether
+// that item is key.
+func (n *btreeNode) find(key Key) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+func (e *btreeEngine) Get(key Key) (Value, bool) {
+	for n := e.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if n.leaf() {
+			break
+		}
+		n = n.children[i]
+	}
+	return Value{}, false
+}
+
+func (e *btreeEngine) Put(key Key, value Value) {
+	item := btreeItem{key: key, value: value}
+	if e.root == nil {
+		e.root = &btreeNode{items: []btreeItem{item}}
+		e.n = 1
+		return
+	}
+	if len(e.root.items) == btreeMaxItems {
+		root := &btreeNode{children: []*btreeNode{e.root}}
+		root.split(0)
+		e.root = root
+	}
+	if e.root.insert(item) {
+		e.n += 1
+	}
+}
+
+// split splits the full child i of n in two around its middle item,
+// which moves up into n.
+func (n *btreeNode) split(i int) {
+	child := n.children[i]
+	mid := BTreeDegree - 1
+	item := child.items[mid]
+
+	right := &btreeNode{items: slices.Clone(child.items[mid+1:])}
+	if !child.leaf() {
+		right.children = slices.Clone(child.children[mid+1:])
+		child.children = child.children[:mid+1]
+	}
+	child.items = child.items[:mid]
+
+	n.items = slices.Insert(n.items, i, item)
+	n.children = slices.Insert(n.children, i+1, right)
+}
+
+// insert adds item to the subtree of n, which isn't full, or replaces
+// the item with the same key. It reports whether it added a key.
+func (n *btreeNode) insert(item btreeItem) bool {
+	i, found := n.find(item.key)
+	if found {
+		n.items[i] = item
+		return false
+	}
+	if n.leaf() {
+		n.items = slices.Insert(n.items, i, item)
+		return true
+	}
+	if len(n.children[i].items) == btreeMaxItems {
+		n.split(i)
+		switch {
+		case item.key == n.items[i].key:
+			n.items[i] = item
+			return false
+		case item.key > n.items[i].key:
+			i += 1
+		}
+	}
+	return n.children[i].insert(item)
+}
+
+func (e *btreeEngine) Delete(key Key) {
+	if e.root == nil {
+		return
+	}
+	if e.root.remove(key) {
+		e.n -= 1
+	}
+	if len(e.root.items) == 0 {
+		if e.root.leaf() {
+			e.root = nil
+		} else {
+			e.root = e.root.children[0]
+		}
+	}
+}
+
+// remove deletes key from the subtree of n, and reports whether it
+// was there. n must hold at least BTreeDegree items unless it is the
+// root.
+func (n *btreeNode) remove(key Key) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if found {
+			n.items = slices.Delete(n.items, i, i+1)
+		}
+		return found
+	}
+
+	if found {
+		switch {
+		case len(n.children[i].items) >= BTreeDegree:
+			// replace key with its predecessor
+			pred := n.children[i].max()
+			n.items[i] = pred
+			return n.children[i].remove(pred.key)
+		case len(n.children[i+1].items) >= BTreeDegree:
+			// replace key with its successor
+			succ := n.children[i+1].min()
+			n.items[i] = succ
+			return n.children[i+1].remove(succ.key)
+		default:
+			n.merge(i)
+			return n.children[i].remove(key)
+		}
+	}
+
+	if len(n.children[i].items) < BTreeDegree {
+		i = n.grow(i)
+	}
+	return n.children[i].remove(key)
+}
+
+// grow gives child i of n, which holds BTreeDegree-1 items, another
+// item, borrowed from a sibling or by merging with one. It returns the
+// position of the child afterwards.
+func (n *btreeNode) grow(i int) int {
+	child := n.children[i]
+	switch {
+	case i > 0 && len(n.children[i-1].items) >= BTreeDegree:
+		left := n.children[i-1]
+		last := len(left.items) - 1
+		child.items = slices.Insert(child.items, 0, n.items[i-1])
+		n.items[i-1] = left.items[last]
+		left.items = left.items[:last]
+		if !left.leaf() {
+			child.children = slices.Insert(child.children, 0, left.children[last+1])
+			left.children = left.children[:last+1]
+		}
+		return i
+	case i < len(n.children)-1 && len(n.children[i+1].items) >= BTreeDegree:
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = slices.Delete(right.items, 0, 1)
+		if !right.leaf() {
+			child.children = append(child.children, right.children[0])
+			right.children = slices.Delete(right.children, 0, 1)
+		}
+		return i
+	case i < len(n.children)-1:
+		n.merge(i)
+		return i
+	default:
+		n.merge(i - 1)
+		return i - 1
+	}
+}
+
+// merge joins child i of n, item i, and child i+1 into child i.
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.items = slices.Delete(n.items, i, i+1)
+	n.children = slices.Delete(n.children, i+1, i+2)
+}
+
+func (n *btreeNode) min() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (e *btreeEngine) Iterate(fn func(Key, Value) bool) {
+	if e.root != nil {
+		e.root.iterate(fn)
+	}
+}
+
+func (n *btreeNode) iterate(fn func(Key, Value) bool) bool {
+	for i, item := range n.items {
+		if !n.leaf() && !n.children[i].iterate(fn) {
+			return false
+		}
+		if !fn(item.key, item.value) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.children)-1].iterate(fn)
+	}
+	return true
+}
+
+func (e *btreeEngine) Ascend(start Key, fn func(Key, Value) bool) {
+	if e.root != nil {
+		e.root.ascend(start, fn)
+	}
+}
+
+func (n *btreeNode) ascend(start Key, fn func(Key, Value) bool) bool {
+	i, _ := n.find(start)
+	for ; i < len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(start, fn) {
+			return false
+		}
+		if !fn(n.items[i].key, n.items[i].value) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(start, fn)
+	}
+	return true
+}
+
+func (e *btreeEngine) Len() int {
+	return e.n
+}
+
+func (e *btreeEngine) Snapshot() Engine {
+	return &btreeEngine{root: e.root.clone(), n: e.n}
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	if n == nil {
+		return nil
+	}
+	c := &btreeNode{items: slices.Clone(n.items)}
+	if !n.leaf() {
+		c.children = make([]*btreeNode, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return c
+}
@@ -0,0 +1,191 @@
+package kv_server_with_stable_network
+
+import (
+	"sync"
+	"time"
+)
+
+// A KVServer numbers every change it makes to its keys, from 1 up, and
+// keeps at least the last ChangeLogSize changes in memory, so that
+// clerks can follow the changes with ReadChanges instead of polling
+// keys. A change is a key's value and version after a Put, a
+// MultiPut, or a shard install, or the key's removal by a Delete, the
+// reaper once the key expires (see ttl.go), an eviction (see
+// memory.go), or a shard delete.
+//
+// The server takes the changes from the records it logs (see
+// persist.go), in log order, so that replaying the log after a
+// restart, or on a backup, numbers them the same way, and it keeps
+// the changes in its snapshots. In a Raft group, every replica
+// numbers the changes alike as it applies the log. Each group of a
+// sharded deployment numbers its own changes.
+
+const ChangeLogSize = 1024
+
+// the most changes a ReadChanges returns, unless it asks for fewer
+const MaxReadChanges = 256
+
+type Change struct {
+	Seq     uint64
+	Key     string
+	Value   string
+	Version Tversion
+	Deleted bool
+}
+
+type changeLog struct {
+	mu      sync.Mutex
+	changes []Change // oldest first
+	seq     uint64   // of the last change
+}
+
+// add numbers the changes that rec describes and appends them.
+func (c *changeLog) add(rec walRecord) bool {
+	if len(rec.Values) == 0 && len(rec.Deleted) == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, pv := range rec.Values {
+		c.seq += 1
+		c.changes = append(c.changes, Change{Seq: c.seq, Key: pv.Key, Value: pv.Value, Version: pv.Version})
+	}
+	for _, k := range rec.Deleted {
+		c.seq += 1
+		c.changes = append(c.changes, Change{Seq: c.seq, Key: k, Deleted: true})
+	}
+	// trim in batches, so that each change is copied at most once
+	if len(c.changes) >= 2*ChangeLogSize {
+		c.changes = append([]Change(nil), c.changes[len(c.changes)-ChangeLogSize:]...)
+	}
+	return true
+}
+
+// read returns up to limit changes after seq after, and the number
+// of the last change. It returns ErrCompacted if the log no longer
+// holds the change after after, and no changes if it doesn't hold
+// change after yet, as on a new Raft leader that hasn't applied its
+// whole log.
+func (c *changeLog) read(after uint64, limit int) ([]Change, uint64, Err) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := c.seq + 1 - uint64(len(c.changes))
+	if after+1 < first {
+		return nil, c.seq, ErrCompacted
+	}
+	if after > c.seq {
+		return nil, c.seq, OK
+	}
+	changes := c.changes[after+1-first:]
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return append([]Change(nil), changes...), c.seq, OK
+}
+
+func (c *changeLog) reset(changes []Change, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changes = changes
+	c.seq = seq
+}
+
+func (c *changeLog) snapshot() ([]Change, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Change(nil), c.changes...), c.seq
+}
+
+// addChangesL adds the changes that rec describes to the change log.
+// Caller must hold kv.mu, or kv.mu shared and the stripes of the keys
+// of rec for writing, and, to keep the changes in log order, kv.walMu
+// if the server persists.
+func (kv *KVServer) addChangesL(rec walRecord) {
+	if kv.changes.add(rec) {
+		kv.changed.Broadcast()
+	}
+}
+
+// ReadChanges returns the changes of namespace args.Namespace after
+// args.After, up to args.Max of them, or MaxReadChanges if args.Max
+// is 0. If there are none, it waits up to args.Wait, but at most
+// MaxWatchTimeout, for one; a server that hasn't made change
+// args.After yet waits for it too. It returns ErrCompacted if the
+// server no longer keeps the change after args.After.
+func (kv *KVServer) ReadChanges(args *ReadChangesArgs, reply *ReadChangesReply) {
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.limiter.admit(args.ClientId) {
+		reply.Err = ErrBusy
+		return
+	}
+	defer kv.limiter.done()
+
+	if !validKey(args.Namespace, "") {
+		reply.Err = ErrBadKey
+		return
+	}
+	if !kv.authorizeAll(&args.Cred, PermRead) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	limit := args.Max
+	if limit <= 0 || limit > MaxReadChanges {
+		limit = MaxReadChanges
+	}
+	expired := false
+	timer := time.AfterFunc(min(args.Wait, MaxWatchTimeout), func() {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+
+		expired = true
+		kv.changed.Broadcast()
+	})
+	defer timer.Stop()
+
+	after := args.After
+	for {
+		if !kv.primaryL() || kv.killed() {
+			reply.Err = ErrWrongLeader
+			return
+		}
+		changes, last, err := kv.changes.read(after, limit)
+		mine := inNamespace(args.Namespace, changes)
+		if err != OK || len(mine) > 0 || (len(changes) == 0 && expired) {
+			reply.Changes = mine
+			reply.Last = last
+			reply.Err = err
+			return
+		}
+		if len(changes) > 0 {
+			// all of another namespace; read on, even if the wait
+			// is over, so that Last covers them
+			after = changes[len(changes)-1].Seq
+			continue
+		}
+		kv.changed.Wait()
+	}
+}
+
+// inNamespace returns the changes of namespace ns, with the keys as
+// the clerk sees them.
+func inNamespace(ns string, changes []Change) []Change {
+	mine := changes[:0]
+	for _, c := range changes {
+		if cns, key := splitKey(c.Key); cns == ns {
+			c.Key = key
+			mine = append(mine, c)
+		}
+	}
+	return mine
+}
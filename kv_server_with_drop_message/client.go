@@ -1,26 +1,192 @@
 package kv_server_with_stable_network
 
 import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"reflect"
+	"slices"
+	"sort"
 	"time"
 )
 
+// A Clerk numbers its modifying requests so that the server can
+// recognize resends; a Clerk must therefore not be used by several
+// threads at once.
 type Clerk struct {
-	clnt   *Clnt
-	server string
+	clnt    *Clnt
+	servers []string
+
+	// set for a sharded deployment, along with the latest
+	// configuration, or nil if the Clerk must fetch it
+	sck    *ShardCtrler
+	config *ShardConfig
+
+	// the server of each group that the Clerk believes is the leader
+	leaders map[Tgid]int
+
+	clientId int64
+	seq      uint64
+
+	// sent with every request; see acl.go
+	cred Credential
+
+	// the namespace of all keys of the Clerk; see namespace.go
+	namespace string
+
+	// the ErrBusy replies in a row; see limit.go
+	busy int
 }
 
-func MakeClerk(clnt *Clnt, server string) IKVClerk {
-	ck := &Clerk{clnt: clnt, server: server}
+// MakeClerk makes a Clerk for a single server, or for a replicated
+// group of servers, in which case the Clerk finds the leader by
+// trying them in turn.
+func MakeClerk(clnt *Clnt, servers ...string) IKVClerk {
+	ck := &Clerk{clnt: clnt, servers: servers, leaders: make(map[Tgid]int)}
 	// You may add code here.
+	ck.clientId = nrand()
+	return ck
+}
+
+// MakeClerkWithCredential is like MakeClerk, but the Clerk sends cred
+// with its requests, for servers that check an ACL (see acl.go).
+func MakeClerkWithCredential(clnt *Clnt, cred Credential, servers ...string) IKVClerk {
+	ck := MakeClerk(clnt, servers...).(*Clerk)
+	ck.cred = cred
+	return ck
+}
+
+// MakeClerkInNamespace is like MakeClerk, but all keys of the Clerk
+// are those of namespace (see namespace.go), which must not hold
+// "\x00".
+func MakeClerkInNamespace(clnt *Clnt, namespace string, servers ...string) IKVClerk {
+	if !validKey(namespace, "") {
+		log.Fatalf("MakeClerkInNamespace: namespace %q holds \\x00", namespace)
+	}
+	ck := MakeClerk(clnt, servers...).(*Clerk)
+	ck.namespace = namespace
+	return ck
+}
+
+// MakeShardClerk makes a Clerk for a sharded deployment, whose
+// configuration is kept by the controller's servers (see
+// shardctrler.go). The Clerk sends each request to the group that
+// owns the key.
+func MakeShardClerk(clnt *Clnt, ctrler ...string) IKVClerk {
+	ck := &Clerk{clnt: clnt, sck: MakeShardCtrler(clnt, ctrler...), leaders: make(map[Tgid]int)}
+	ck.clientId = nrand()
 	return ck
 }
 
+// a random, non-zero client id
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64() + 1
+}
+
+// route returns the group that serves key, and its servers.
+func (ck *Clerk) route(key string) (Tgid, []string) {
+	return ck.routeStored(nsKey(ck.namespace, key))
+}
+
+// routeStored is route for a key as the servers store it.
+func (ck *Clerk) routeStored(stored string) (Tgid, []string) {
+	if ck.sck == nil {
+		return GRP0, ck.servers
+	}
+	if ck.config == nil {
+		ck.config = ck.sck.Query()
+	}
+	gid := ck.config.Shards[Key2Shard(stored)]
+	return gid, ck.config.Groups[gid]
+}
+
+// groupServers returns the servers of group gid.
+func (ck *Clerk) groupServers(gid Tgid) []string {
+	if ck.sck == nil {
+		return ck.servers
+	}
+	if ck.config == nil {
+		ck.config = ck.sck.Query()
+	}
+	return ck.config.Groups[gid]
+}
+
+// groups returns the groups of a sharded deployment, in order, or
+// just GRP0.
+func (ck *Clerk) groups() []Tgid {
+	if ck.sck == nil {
+		return []Tgid{GRP0}
+	}
+	if ck.config == nil {
+		ck.config = ck.sck.Query()
+	}
+	gids := make([]Tgid, 0, len(ck.config.Groups))
+	for gid := range ck.config.Groups {
+		gids = append(gids, gid)
+	}
+	slices.Sort(gids)
+	return gids
+}
+
+// call sends one RPC to the group that serves key; see callGroup.
+func (ck *Clerk) call(key string, method string, args interface{}, reply interface{}, err *Err) bool {
+	gid, servers := ck.route(key)
+	return ck.callGroup(gid, servers, method, args, reply, err)
+}
+
+// callGroup sends one RPC to the server of group gid that the Clerk
+// believes is the leader. If the RPC is lost or the reply's *err says
+// the server isn't the leader, callGroup moves on to the next server
+// and returns false. If the group doesn't serve the key, a sharded
+// Clerk drops its configuration, so that the next call fetches a new
+// one. If the server is busy, callGroup backs off and sends the RPC
+// to it again.
+func (ck *Clerk) callGroup(gid Tgid, servers []string, method string, args interface{}, reply interface{}, err *Err) bool {
+	if len(servers) == 0 {
+		ck.config = nil
+		return false
+	}
+	leader := ck.leaders[gid] % len(servers)
+	ok := ck.clnt.Call(servers[leader], method, args, reply)
+	for ok && *err == ErrBusy {
+		backoff(ck.busy)
+		ck.busy += 1
+		zeroReply(reply)
+		ok = ck.clnt.Call(servers[leader], method, args, reply)
+	}
+	if ok {
+		ck.busy = 0
+	}
+	if ok && *err == ErrWrongGroup && ck.sck != nil {
+		ck.config = nil
+		return false
+	}
+	if ok && *err != ErrWrongLeader {
+		ck.leaders[gid] = leader
+		return true
+	}
+	ck.leaders[gid] = (leader + 1) % len(servers)
+	return false
+}
+
+// zeroReply makes *reply the zero value again, so that an RPC can be
+// resent into it: labgob decodes only into a zero reply, and a field
+// the new reply leaves out would otherwise keep its old value.
+func zeroReply(reply interface{}) {
+	v := reflect.ValueOf(reply).Elem()
+	v.Set(reflect.Zero(v.Type()))
+}
+
 // Get fetches the current value and version for a key.  It returns
 // ErrNoKey if the key does not exist. It keeps trying forever in the
 // face of all other errors.
 //
 // You can send an RPC with code like this:
-// ok := ck.clnt.Call(ck.server, "KVServer.Get", &args, &reply)
+// ok := ck.clnt.Call(server, "KVServer.Get", &args, &reply)
 //
 // The types of args and reply (including whether they are pointers)
 // must match the declared types of the RPC handler function's
@@ -28,13 +194,27 @@ func MakeClerk(clnt *Clnt, server string) IKVClerk {
 func (ck *Clerk) Get(key string) (string, Tversion, Err) {
 	// You will have to modify this function.
 
-	args := &GetArgs{Key: key}
-	reply := &GetReply{}
+	return ck.get(&GetArgs{Key: key})
+}
 
-	for {
-		ok := ck.clnt.Call(ck.server, "KVServer.Get", args, reply)
+// GetAt fetches key as it was at version, from the history the
+// servers keep (see history.go). It returns ErrCompacted if the
+// servers no longer keep that version, and ErrVersion if the key
+// hasn't reached it yet.
+func (ck *Clerk) GetAt(key string, version Tversion) (string, Tversion, Err) {
+	return ck.get(&GetArgs{Key: key, AtVersion: version})
+}
 
-		if ok {
+func (ck *Clerk) get(args *GetArgs) (string, Tversion, Err) {
+	args.Cred = ck.cred
+	args.Namespace = ck.namespace
+	args.ClientId = ck.clientId
+	key := args.Key
+	var reply *GetReply
+
+	for {
+		reply = &GetReply{}
+		if ck.call(key, "KVServer.Get", args, reply, &reply.Err) {
 			break
 		}
 
@@ -45,19 +225,230 @@ func (ck *Clerk) Get(key string) (string, Tversion, Err) {
 	return reply.Value, reply.Version, reply.Err
 }
 
+// GetMeta fetches the metadata and current version of key: when it
+// was created and last written, and by which clerk (see meta.go). It
+// returns ErrNoKey if the key does not exist.
+func (ck *Clerk) GetMeta(key string) (KeyMeta, Tversion, Err) {
+	args := &GetMetaArgs{Key: key, Cred: ck.cred, Namespace: ck.namespace, ClientId: ck.clientId}
+	var reply *GetMetaReply
+
+	for {
+		reply = &GetMetaReply{}
+		if ck.call(key, "KVServer.GetMeta", args, reply, &reply.Err) {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return reply.Meta, reply.Version, reply.Err
+}
+
+// Stats asks each server the Clerk knows of for its statistics (see
+// stats.go), with its hot most accessed keys, and returns the replies
+// by server. A server that doesn't answer is left out.
+func (ck *Clerk) Stats(hot int) map[string]StatsReply {
+	servers := ck.servers
+	if ck.sck != nil {
+		if ck.config == nil {
+			ck.config = ck.sck.Query()
+		}
+		servers = nil
+		for _, grp := range ck.config.Groups {
+			servers = append(servers, grp...)
+		}
+	}
+
+	stats := make(map[string]StatsReply)
+	for _, server := range servers {
+		args := StatsArgs{Hot: hot, Cred: ck.cred, Namespace: ck.namespace, ClientId: ck.clientId}
+		reply := StatsReply{}
+		ok := ck.clnt.Call(server, "KVServer.Stats", &args, &reply)
+		for busy := 0; ok && reply.Err == ErrBusy; busy++ {
+			backoff(busy)
+			reply = StatsReply{}
+			ok = ck.clnt.Call(server, "KVServer.Stats", &args, &reply)
+		}
+		if ok && reply.Err == OK {
+			stats[server] = reply
+		}
+	}
+	return stats
+}
+
+// A ChangeStream follows the changes a group of servers makes to its
+// keys (see changes.go), in order. It asks for the changes after the
+// last one it returned, so a request or reply the network drops, or a
+// change of leader, just makes it ask again.
+type ChangeStream struct {
+	ck      *Clerk
+	last    uint64
+	pending []Change
+}
+
+// Subscribe returns a stream of the changes after change number
+// after; 0 starts from the first change. The stream holds the changes
+// of the Clerk's namespace only, so their numbers may skip some that
+// other namespaces took. In a sharded deployment,
+// each group numbers its own changes, and the stream follows the
+// group that serves the empty key.
+func (ck *Clerk) Subscribe(after uint64) *ChangeStream {
+	return &ChangeStream{ck: ck, last: after}
+}
+
+// Last returns the number of the last change Next returned, from
+// which a new stream can resume.
+func (cs *ChangeStream) Last() uint64 {
+	return cs.last
+}
+
+// Next returns the next change, waiting up to timeout for the servers
+// to make one. It returns ErrNoKey if none came in time, and
+// ErrCompacted if the servers no longer keep the next change, in which
+// case the caller must catch up some other way, such as with Scan.
+func (cs *ChangeStream) Next(timeout time.Duration) (Change, Err) {
+	deadline := time.Now().Add(timeout)
+	for len(cs.pending) == 0 {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return Change{}, ErrNoKey
+		}
+		args := &ReadChangesArgs{After: cs.last, Wait: wait, Cred: cs.ck.cred, Namespace: cs.ck.namespace, ClientId: cs.ck.clientId}
+		reply := &ReadChangesReply{}
+		if !cs.ck.call("", "KVServer.ReadChanges", args, reply, &reply.Err) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if reply.Err != OK {
+			return Change{}, reply.Err
+		}
+		cs.pending = reply.Changes
+		if len(cs.pending) == 0 {
+			// the changes up to reply.Last are all of other
+			// namespaces
+			cs.last = max(cs.last, reply.Last)
+		}
+	}
+	c := cs.pending[0]
+	cs.pending = cs.pending[1:]
+	cs.last = c.Seq
+	return c, OK
+}
+
+// Dump writes all keys with their values and versions, as they were
+// when the dump started, to w in format (see admin.go). If the server
+// giving the dump fails over partway, Dump starts again. In a sharded
+// deployment, Dump reads each group in turn, so the dump of each group
+// is consistent, but not the dump as a whole, and the configuration
+// must not change meanwhile.
+func (ck *Clerk) Dump(w io.Writer, format DumpFormat) error {
+	var entries []DumpEntry
+	for _, gid := range ck.groups() {
+		group, err := ck.dumpGroup(gid)
+		if err != OK {
+			return fmt.Errorf("dump: %v", err)
+		}
+		entries = append(entries, group...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return nsKey(entries[i].Namespace, entries[i].Key) < nsKey(entries[j].Namespace, entries[j].Key)
+	})
+	return writeDump(w, format, entries)
+}
+
+func (ck *Clerk) dumpGroup(gid Tgid) ([]DumpEntry, Err) {
+	var entries []DumpEntry
+	args := &DumpArgs{Cred: ck.cred, ClientId: ck.clientId}
+	for {
+		reply := &DumpReply{}
+		if !ck.callGroup(gid, ck.groupServers(gid), "Admin.Dump", args, reply, &reply.Err) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if reply.Err == ErrNoKey {
+			// the dump is gone; start over
+			entries, args = nil, &DumpArgs{Cred: ck.cred, ClientId: ck.clientId}
+			continue
+		}
+		if reply.Err != OK {
+			return nil, reply.Err
+		}
+		entries = append(entries, reply.Entries...)
+		if reply.Done {
+			return entries, OK
+		}
+		args = &DumpArgs{Id: reply.Id, Offset: len(entries), Cred: ck.cred, ClientId: ck.clientId}
+	}
+}
+
+// Restore loads a dump in format from r into servers that hold no
+// keys, keeping the versions of the keys. If the servers hold keys in
+// the namespaces of the dump already, Restore returns an error holding
+// ErrNotEmpty, and if a
+// restore fails partway, such as with ErrFull, the keys restored so
+// far stay. In a sharded deployment, Restore sends each key to the
+// group that serves it, and each group that gets keys must hold none;
+// if the configuration changes meanwhile, Restore fails with
+// ErrWrongGroup.
+func (ck *Clerk) Restore(r io.Reader, format DumpFormat) error {
+	entries, err := readDump(r, format)
+	if err != nil {
+		return err
+	}
+	byGroup := make(map[Tgid][]DumpEntry)
+	for _, e := range entries {
+		gid, _ := ck.routeStored(nsKey(e.Namespace, e.Key))
+		byGroup[gid] = append(byGroup[gid], e)
+	}
+	for _, gid := range ck.groups() {
+		if group, ok := byGroup[gid]; ok {
+			if err := ck.restoreGroup(gid, group); err != OK {
+				return fmt.Errorf("restore: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ck *Clerk) restoreGroup(gid Tgid, entries []DumpEntry) Err {
+	for start := 0; start < len(entries); start += MaxDumpEntries {
+		ck.seq += 1
+		args := &RestoreArgs{
+			Entries:  entries[start:min(start+MaxDumpEntries, len(entries))],
+			Fresh:    start == 0,
+			Cred:     ck.cred,
+			ClientId: ck.clientId,
+			Seq:      ck.seq,
+		}
+		var reply *RestoreReply
+		for {
+			reply = &RestoreReply{}
+			if ck.callGroup(gid, ck.groupServers(gid), "Admin.Restore", args, reply, &reply.Err) {
+				break
+			}
+			if reply.Err == ErrWrongGroup {
+				return ErrWrongGroup
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if reply.Err != OK {
+			return reply.Err
+		}
+	}
+	return OK
+}
+
 // Put updates key with value only if the version in the
 // request matches the version of the key at the server.  If the
 // versions numbers don't match, the server should return
-// ErrVersion.  If Put receives an ErrVersion on its first RPC, Put
-// should return ErrVersion, since the Put was definitely not
-// performed at the server. If the server returns ErrVersion on a
-// resend RPC, then Put must return ErrMaybe to the application, since
-// its earlier RPC might have been processed by the server successfully
-// but the response was lost, and the Clerk doesn't know if
-// the Put was performed or not.
+// ErrVersion.  Put resends the request until it gets a reply; every
+// resend carries the same client id and sequence number, so the
+// server performs the Put at most once and answers resends with the
+// reply of the original request. Put therefore returns the true
+// outcome and never ErrMaybe.
 //
 // You can send an RPC with code like this:
-// ok := ck.clnt.Call(ck.server, "KVServer.Put", &args, &reply)
+// ok := ck.clnt.Call(server, "KVServer.Put", &args, &reply)
 //
 // The types of args and reply (including whether they are pointers)
 // must match the declared types of the RPC handler function's
@@ -65,26 +456,216 @@ func (ck *Clerk) Get(key string) (string, Tversion, Err) {
 func (ck *Clerk) Put(key, value string, version Tversion) Err {
 	// You will have to modify this function.
 
-	reply := &PutReply{}
-	arg := &PutArgs{Key: key, Value: value, Version: version}
+	return ck.put(&PutArgs{Key: key, Value: value, Version: version})
+}
+
+// PutTTL is like Put, but the key expires ttl after the Put succeeds
+// unless another Put updates it first. Once expired, the key behaves
+// as if it were deleted.
+func (ck *Clerk) PutTTL(key, value string, version Tversion, ttl time.Duration) Err {
+	return ck.put(&PutArgs{Key: key, Value: value, Version: version, TTL: ttl})
+}
+
+func (ck *Clerk) put(arg *PutArgs) Err {
+	var reply *PutReply
+
+	ck.seq += 1
+	arg.ClientId = ck.clientId
+	arg.Seq = ck.seq
+	arg.Cred = ck.cred
+	arg.Namespace = ck.namespace
+
+	for {
+		reply = &PutReply{}
+		if ck.call(arg.Key, "KVServer.Put", arg, reply, &reply.Err) {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return reply.Err
+}
+
+// Delete removes key only if the version in the request matches the
+// version of the key at the server. If the versions don't match, the
+// server returns ErrVersion, and if the key doesn't exist it returns
+// ErrNoKey. Like Put, Delete is performed at most once, however many
+// times the RPC is resent.
+func (ck *Clerk) Delete(key string, version Tversion) Err {
+	var reply *DeleteReply
+
+	ck.seq += 1
+	arg := &DeleteArgs{Key: key, Version: version, Cred: ck.cred, Namespace: ck.namespace, ClientId: ck.clientId, Seq: ck.seq}
+
+	for {
+		reply = &DeleteReply{}
+		if ck.call(key, "KVServer.Delete", arg, reply, &reply.Err) {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return reply.Err
+}
+
+// MultiPut performs all of ops atomically at the server, or none of
+// them. If the version of some op doesn't match, the server returns
+// ErrVersion along with the conflicting keys and their current
+// versions. Like Put, MultiPut is performed at most once, however
+// many times the RPC is resent. In a sharded deployment, all keys must
+// belong to the same group; otherwise MultiPut returns ErrWrongGroup.
+func (ck *Clerk) MultiPut(ops []PutOp) ([]Conflict, Err) {
+	var reply *MultiPutReply
 
-	hasFailed := false
+	ck.seq += 1
+	arg := &MultiPutArgs{Ops: ops, Cred: ck.cred, Namespace: ck.namespace, ClientId: ck.clientId, Seq: ck.seq}
 
+	key := ""
+	if len(ops) > 0 {
+		key = ops[0].Key
+	}
 	for {
-		ok := ck.clnt.Call(ck.server, "KVServer.Put", arg, reply)
+		gid, servers := ck.route(key)
+		for _, op := range ops {
+			if g, _ := ck.route(op.Key); g != gid {
+				return nil, ErrWrongGroup
+			}
+		}
 
-		if ok {
+		reply = &MultiPutReply{}
+		if ck.callGroup(gid, servers, "KVServer.MultiPut", arg, reply, &reply.Err) {
 			break
 		}
 
-		hasFailed = true
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	if hasFailed {
-		return ErrMaybe
-	} else {
-		return reply.Err
+	return reply.Conflicts, reply.Err
+}
+
+// Scan fetches up to limit keys in [start, end) with their values and
+// versions, in lexicographic order; an empty end means no upper
+// bound. Pass the returned token to the next Scan to fetch the next
+// page; the token is empty once the range is exhausted. Scan doesn't
+// modify the server, so it keeps trying forever like Get.
+func (ck *Clerk) Scan(start, end string, limit int, token string) ([]ScanEntry, string, Err) {
+	return ck.scan(&ScanArgs{Start: start, End: end, Limit: limit, Token: token})
+}
+
+// ScanPrefix is like Scan, but fetches the keys that start with prefix.
+func (ck *Clerk) ScanPrefix(prefix string, limit int, token string) ([]ScanEntry, string, Err) {
+	return ck.scan(&ScanArgs{Prefix: prefix, Limit: limit, Token: token})
+}
+
+func (ck *Clerk) scan(args *ScanArgs) ([]ScanEntry, string, Err) {
+	args.Cred = ck.cred
+	args.Namespace = ck.namespace
+	args.ClientId = ck.clientId
+	if ck.sck == nil {
+		reply := ck.scanGroup(GRP0, ck.servers, args)
+		return reply.Entries, reply.Token, reply.Err
+	}
+
+	// every group holds some of the keys in the range, so scan them
+	// all and merge
+	gids := ck.groups()
+	replies := make([]*ScanReply, len(gids))
+	for i, gid := range gids {
+		reply := ck.scanGroup(gid, ck.groupServers(gid), args)
+		for reply.Err == OK && reply.Token != "" && len(reply.Entries) == 0 {
+			// mergeScans would take the group to hold no more keys
+			next := *args
+			next.Token = reply.Token
+			reply = ck.scanGroup(gid, ck.groupServers(gid), &next)
+		}
+		if reply.Err != OK {
+			return nil, "", reply.Err
+		}
+		replies[i] = reply
+	}
+	entries, token := mergeScans(replies, args.Limit)
+	return entries, token, OK
+}
+
+func (ck *Clerk) scanGroup(gid Tgid, servers []string, args *ScanArgs) *ScanReply {
+	var reply *ScanReply
+
+	for {
+		reply = &ScanReply{}
+		if ck.callGroup(gid, servers, "KVServer.Scan", args, reply, &reply.Err) {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
 	}
 
+	return reply
+}
+
+// mergeScans merges the pages that several groups returned for the
+// same Scan into one page of at most limit entries. A group that
+// returned a token may hold more keys after its last one, so the
+// merged page stops there.
+func mergeScans(replies []*ScanReply, limit int) ([]ScanEntry, string) {
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	all := []ScanEntry{}
+	bound := ""
+	for _, reply := range replies {
+		all = append(all, reply.Entries...)
+		if reply.Token != "" && len(reply.Entries) > 0 {
+			last := reply.Entries[len(reply.Entries)-1].Key
+			if bound == "" || last < bound {
+				bound = last
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+
+	entries := []ScanEntry{}
+	for _, e := range all {
+		if (bound != "" && e.Key > bound) || len(entries) == limit {
+			return entries, entries[len(entries)-1].Key + "\x00"
+		}
+		entries = append(entries, e)
+	}
+	if bound != "" {
+		return entries, entries[len(entries)-1].Key + "\x00"
+	}
+	return entries, ""
+}
+
+// Watch waits until the version of key differs from version, which
+// includes key being created or deleted, and returns the new value
+// and version like Get. If nothing changes within timeout, Watch
+// returns the current value and version, so the caller can tell a
+// timeout apart by the unchanged version. Each Watch RPC blocks at
+// the server for at most the remaining time; if the RPC is lost, Watch
+// sends a new one for whatever time remains.
+func (ck *Clerk) Watch(key string, version Tversion, timeout time.Duration) (string, Tversion, Err) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		args := &WatchArgs{Key: key, Version: version, Timeout: time.Until(deadline), Cred: ck.cred, Namespace: ck.namespace, ClientId: ck.clientId}
+		reply := &GetReply{}
+
+		ok := ck.call(key, "KVServer.Watch", args, reply, &reply.Err)
+
+		if ok && (reply.Err == ErrPermission || reply.Version != version || !time.Now().Before(deadline)) {
+			return reply.Value, reply.Version, reply.Err
+		}
+
+		if !ok {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !time.Now().Before(deadline) {
+			// out of time, but the last RPC was lost; fetch the
+			// current value instead
+			return ck.Get(key)
+		}
+	}
 }
@@ -0,0 +1,93 @@
+package kv_server_with_stable_network
+
+import (
+	"slices"
+	"sort"
+)
+
+// A clerk sends one modifying request at a time, numbering them
+// 1, 2, 3, ... under its client id. The server remembers the reply to
+// the last request of each clerk, so that a resent request returns
+// the original reply instead of being performed again.
+//
+// A sharded server also remembers which shards the request touched,
+// so that a shard that moves takes along only the replies of the
+// clerks whose last request it could be asked to perform again; see
+// shard.go.
+type lastReply struct {
+	Seq       uint64
+	Err       Err
+	Conflicts []Conflict // only for MultiPut
+	Shards    []int      // in order; nil if the server wasn't sharded
+}
+
+// touches reports whether the request of last may have changed shard.
+func (last *lastReply) touches(shard int) bool {
+	if last.Shards == nil {
+		return true
+	}
+	_, found := slices.BinarySearch(last.Shards, shard)
+	return found
+}
+
+// duplicateL reports whether the request seq of clientId was
+// performed already, and if so returns its reply. The reply is nil for
+// requests older than the last one, since the clerk has stopped
+// waiting for them. Requests without a client id are never
+// duplicates. Caller must hold kv.mu, or kv.mu shared and the clerk's
+// stripe.
+func (kv *KVServer) duplicateL(clientId int64, seq uint64) (*lastReply, bool) {
+	if clientId == 0 {
+		return nil, false
+	}
+	last, ok := kv.clientL(clientId)
+	if !ok || seq > last.Seq {
+		return nil, false
+	}
+	if seq == last.Seq {
+		return last, true
+	}
+	return nil, true
+}
+
+// rememberL records the reply to request seq of clientId, which was
+// for keys. Caller must hold kv.mu, or kv.mu shared and the clerk's
+// stripe.
+func (kv *KVServer) rememberL(clientId int64, seq uint64, err Err, conflicts []Conflict, keys ...string) {
+	if clientId == 0 {
+		return
+	}
+	var shards []int
+	if kv.shards != nil {
+		shards = shardsOf(keys)
+	}
+	if last, ok := kv.clientL(clientId); ok {
+		last.Seq = seq
+		last.Err = err
+		last.Conflicts = conflicts
+		last.Shards = shards
+		return
+	}
+	kv.setClientL(clientId, &lastReply{Seq: seq, Err: err, Conflicts: conflicts, Shards: shards})
+}
+
+// shardsOf returns the shards of keys, in order, and not nil.
+func shardsOf(keys []string) []int {
+	shards := []int{}
+	for _, k := range keys {
+		shards = append(shards, Key2Shard(k))
+	}
+	sort.Ints(shards)
+	return slices.Compact(shards)
+}
+
+// mergeClientsL adds the clerks of another group, keeping the later
+// request of a clerk both groups know. Caller must hold kv.mu.
+func (kv *KVServer) mergeClientsL(clients map[int64]lastReply) {
+	for id, last := range clients {
+		if cur, ok := kv.clientL(id); !ok || last.Seq > cur.Seq {
+			last := last
+			kv.setClientL(id, &last)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package kv_server_with_stable_network
+
+import "maps"
+
+// An Engine stores keys with their values, versions, and expiry
+// times. A KVServer keeps one engine per stripe (see store.go) and
+// does the locking itself: reads (Get, Iterate, Len, Snapshot) may
+// run at the same time as each other, but not at the same time as
+// writes (Put, Delete). The server also checks versions and expiry
+// before it writes, so an engine just stores what it is given.
+type Engine interface {
+	// Get returns the value of key, expired or not.
+	Get(key Key) (Value, bool)
+
+	// Put makes value, with its version, the value of key.
+	Put(key Key, value Value)
+
+	// Delete removes key, if it exists.
+	Delete(key Key)
+
+	// Iterate calls fn for each key until fn returns false. An
+	// ordered engine goes in key order.
+	Iterate(fn func(Key, Value) bool)
+
+	// Len returns the number of keys.
+	Len() int
+
+	// Snapshot returns an engine with the same keys, which later
+	// writes to this engine don't affect. The server takes snapshots
+	// under kv.mu, and reads them for dumps and state transfers
+	// without it.
+	Snapshot() Engine
+}
+
+// An OrderedEngine keeps its keys in order, and can start an
+// iteration at any key.
+type OrderedEngine interface {
+	Engine
+
+	// Ascend is Iterate, but starts at the first key >= start.
+	Ascend(start Key, fn func(Key, Value) bool)
+}
+
+// An EngineMaker makes an empty engine for a KVServer.
+type EngineMaker func() Engine
+
+// mapEngine is the default engine: a Go map, which doesn't keep its
+// keys in order.
+type mapEngine struct {
+	data map[Key]Value
+}
+
+func MakeMapEngine() Engine {
+	return &mapEngine{data: make(map[Key]Value)}
+}
+
+func (e *mapEngine) Get(key Key) (Value, bool) {
+	value, found := e.data[key]
+	return value, found
+}
+
+func (e *mapEngine) Put(key Key, value Value) {
+	e.data[key] = value
+}
+
+func (e *mapEngine) Delete(key Key) {
+	delete(e.data, key)
+}
+
+func (e *mapEngine) Iterate(fn func(Key, Value) bool) {
+	for key, value := range e.data {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+func (e *mapEngine) Len() int {
+	return len(e.data)
+}
+
+func (e *mapEngine) Snapshot() Engine {
+	return &mapEngine{data: maps.Clone(e.data)}
+}
@@ -0,0 +1,209 @@
+package kv_server_with_stable_network
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A file-backed Persister keeps its raft state and snapshot in a
+// directory, so that they outlive the process:
+//
+//	raftstate-<n>  the raft state saved by the n'th write of it
+//	snapshot-<n>   the snapshot saved by the n'th write of it
+//	CURRENT        "<snapshot n> <raftstate n>", the files in use
+//
+// Save writes new files, fsyncs them, and then atomically renames a
+// new CURRENT into place, so a crash at any point leaves either the
+// old or the new state. Files not named by CURRENT are left-overs of
+// an interrupted Save and are removed on the next start. Since Save
+// usually changes only the raft state, it rewrites the snapshot only
+// when given a different snapshot than before.
+//
+// Append adds to the end of the current raft state file and fsyncs
+// it, without touching CURRENT. A crash during an Append may leave
+// part of the appended bytes behind, so a server that appends must
+// ignore a torn record at the end of its raft state.
+
+const currentFile = "CURRENT"
+
+type persisterFiles struct {
+	mu      sync.Mutex
+	dir     string
+	snapGen int
+	raftGen int
+	retired bool // superseded by a Copy; ignore Save
+}
+
+// MakeFilePersister returns a persister that stores its state in dir,
+// creating dir if needed, and starting with the state saved there.
+func MakeFilePersister(dir string) (*Persister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	pf := &persisterFiles{dir: dir}
+	ps := MakePersister()
+	ps.files = pf
+
+	b, err := os.ReadFile(filepath.Join(dir, currentFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if _, err := fmt.Sscanf(string(b), "%d %d", &pf.snapGen, &pf.raftGen); err != nil {
+			return nil, fmt.Errorf("corrupt %s: %v", currentFile, err)
+		}
+		if pf.snapGen > 0 {
+			if ps.snapshot, err = os.ReadFile(pf.path("snapshot", pf.snapGen)); err != nil {
+				return nil, err
+			}
+		}
+		if pf.raftGen > 0 {
+			if ps.raftstate, err = os.ReadFile(pf.path("raftstate", pf.raftGen)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pf.removeStale()
+	return ps, nil
+}
+
+func (pf *persisterFiles) path(kind string, gen int) string {
+	return filepath.Join(pf.dir, fmt.Sprintf("%s-%d", kind, gen))
+}
+
+// handOver retires pf and returns a persisterFiles for the same
+// directory that continues where pf left off.
+func (pf *persisterFiles) handOver() *persisterFiles {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.retired = true
+	return &persisterFiles{dir: pf.dir, snapGen: pf.snapGen, raftGen: pf.raftGen}
+}
+
+// retire makes pf ignore Save and Append from now on.
+func (pf *persisterFiles) retire() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.retired = true
+}
+
+// save writes raftstate, and snapshot if it changed, and then
+// switches CURRENT to them. An I/O error is fatal, since the caller
+// must not believe its state is durable when it isn't.
+func (pf *persisterFiles) save(raftstate []byte, snapshot []byte, newSnapshot bool) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if !pf.retired {
+		pf.saveL(raftstate, snapshot, newSnapshot)
+	}
+}
+
+func (pf *persisterFiles) saveL(raftstate []byte, snapshot []byte, newSnapshot bool) {
+	snapGen, raftGen := pf.snapGen, pf.raftGen+1
+	if newSnapshot || snapGen == 0 {
+		snapGen += 1
+		if err := writeFileSync(pf.path("snapshot", snapGen), snapshot); err != nil {
+			log.Fatalf("[Persister->save]: %v", err)
+		}
+	}
+	if err := writeFileSync(pf.path("raftstate", raftGen), raftstate); err != nil {
+		log.Fatalf("[Persister->save]: %v", err)
+	}
+
+	current := []byte(fmt.Sprintf("%d %d\n", snapGen, raftGen))
+	tmp := filepath.Join(pf.dir, currentFile+".tmp")
+	if err := writeFileSync(tmp, current); err != nil {
+		log.Fatalf("[Persister->save]: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(pf.dir, currentFile)); err != nil {
+		log.Fatalf("[Persister->save]: %v", err)
+	}
+	if err := syncDir(pf.dir); err != nil {
+		log.Fatalf("[Persister->save]: %v", err)
+	}
+
+	if snapGen != pf.snapGen && pf.snapGen > 0 {
+		os.Remove(pf.path("snapshot", pf.snapGen))
+	}
+	if pf.raftGen > 0 {
+		os.Remove(pf.path("raftstate", pf.raftGen))
+	}
+	pf.snapGen, pf.raftGen = snapGen, raftGen
+}
+
+// append adds data to the current raft state file. If there is none
+// yet, it saves data as the raft state, along with snapshot.
+func (pf *persisterFiles) append(data []byte, snapshot []byte) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.retired {
+		return
+	}
+	if pf.raftGen == 0 {
+		pf.saveL(data, snapshot, false)
+		return
+	}
+	f, err := os.OpenFile(pf.path("raftstate", pf.raftGen), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("[Persister->append]: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		log.Fatalf("[Persister->append]: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatalf("[Persister->append]: %v", err)
+	}
+}
+
+// removeStale removes the files that CURRENT doesn't name.
+func (pf *persisterFiles) removeStale() {
+	entries, err := os.ReadDir(pf.dir)
+	if err != nil {
+		return
+	}
+	keep := map[string]bool{
+		currentFile: true,
+		filepath.Base(pf.path("snapshot", pf.snapGen)):  true,
+		filepath.Base(pf.path("raftstate", pf.raftGen)): true,
+	}
+	for _, e := range entries {
+		name := e.Name()
+		stale := strings.HasPrefix(name, "snapshot-") || strings.HasPrefix(name, "raftstate-") ||
+			name == currentFile+".tmp"
+		if stale && !keep[name] {
+			os.Remove(filepath.Join(pf.dir, name))
+		}
+	}
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -154,6 +154,44 @@ func (sg *ServerGrp) connect(i int, to []int) {
 	}
 }
 
+// detach server i from the servers listed in from
+func (sg *ServerGrp) disconnect(i int, from []int) {
+	sg.mu.Lock()
+	sg.connected[i] = false
+	sg.mu.Unlock()
+
+	// outgoing socket files
+	sg.srvs[i].disconnect(from)
+
+	// incoming socket files
+	for j := 0; j < len(from); j++ {
+		s := sg.srvs[from[j]]
+		if i < len(s.endNames) {
+			sg.net.Enable(s.endNames[i], false)
+		}
+	}
+}
+
+func (sg *ServerGrp) DisconnectAll(i int) {
+	sg.disconnect(i, sg.all())
+}
+
+// Shutdown a server by isolating it, killing its services, and
+// saving a copy of its persisted state for the next StartServer(i).
+func (sg *ServerGrp) ShutdownServer(i int) {
+	sg.disconnect(i, sg.all())
+
+	// disable client connections to the server.
+	// it's important to do this before creating
+	// the new Persister in saved[i], to avoid
+	// the possibility of the server returning a
+	// positive reply to an Append but persisting
+	// the result in the superseded Persister.
+	sg.net.DeleteServer(ServerName(sg.gid, i))
+
+	sg.srvs[i].shutdownServer()
+}
+
 func (sg *ServerGrp) all() []int {
 	all := make([]int, len(sg.srvs))
 	for i, _ := range sg.srvs {
@@ -0,0 +1,166 @@
+package kv_server_with_stable_network
+
+import (
+	"sort"
+	"time"
+)
+
+// A KVServer can keep the past versions of each key, so that a Get
+// with AtVersion reads the key as it was. When a write replaces a
+// key, the replaced version goes into the key's history, stamped with
+// the time it was replaced, and a HistoryPolicy bounds the history by
+// count, by age, or both. A Get of a version that the policy has
+// dropped returns ErrCompacted. Deleting a key, or its expiring or
+// being evicted, drops its history too, since a key that is created
+// again starts over at version 1. The history is part of the
+// snapshot, and replaying the log rebuilds the rest of it.
+
+// Versions is the most past versions a key keeps, and Age how long a
+// past version stays after it is replaced; 0 means no bound. A server
+// with neither keeps no history.
+type HistoryPolicy struct {
+	Versions int
+	Age      time.Duration
+}
+
+func (p HistoryPolicy) enabled() bool {
+	return p.Versions > 0 || p.Age > 0
+}
+
+// prune drops the versions of past, oldest first, that p doesn't keep
+// at now.
+func (p HistoryPolicy) prune(past []pastValue, now time.Time) []pastValue {
+	drop := 0
+	if p.Versions > 0 && len(past) > p.Versions {
+		drop = len(past) - p.Versions
+	}
+	for p.Age > 0 && drop < len(past) && now.Sub(past[drop].replaced) > p.Age {
+		drop += 1
+	}
+	return past[drop:]
+}
+
+type pastValue struct {
+	value    string
+	version  Tversion
+	replaced time.Time
+}
+
+// A past version as it is persisted. Replaced is in Unix nanoseconds.
+type persistedPast struct {
+	Key      string
+	Value    string
+	Version  Tversion
+	Replaced int64
+}
+
+// recordPastL adds old, which a write to key replaces, to the history
+// of key. Caller must hold kv.mu, or kv.mu shared and the stripe of
+// key for writing.
+func (kv *KVServer) recordPastL(key Key, old Value) {
+	if !kv.historyPolicy.enabled() {
+		return
+	}
+	now := kv.nowL()
+	s := kv.stripeOf(key)
+	past := append(s.history[key], pastValue{value: old.value, version: old.version, replaced: now})
+	s.history[key] = kv.historyPolicy.prune(past, now)
+}
+
+// pastL returns version of key from its history, unless the policy
+// has dropped it. Caller must hold kv.mu, or kv.mu shared and the
+// stripe of key.
+func (kv *KVServer) pastL(key Key, version Tversion) (pastValue, bool) {
+	past := kv.historyPolicy.prune(kv.stripeOf(key).history[key], kv.nowL())
+	i := sort.Search(len(past), func(i int) bool {
+		return past[i].version >= version
+	})
+	if i < len(past) && past[i].version == version {
+		return past[i], true
+	}
+	return pastValue{}, false
+}
+
+// getPastL answers a Get of args.AtVersion of a key whose current
+// version is current. A version the key hasn't reached yet is
+// ErrVersion. Caller must hold kv.mu, or kv.mu shared and the stripe
+// of the key.
+func (kv *KVServer) getPastL(args *GetArgs, current Tversion, reply *GetReply) {
+	if args.AtVersion > current {
+		reply.Err = ErrVersion
+		return
+	}
+	past, ok := kv.pastL(Key(args.Key), args.AtVersion)
+	if !ok {
+		reply.Err = ErrCompacted
+		return
+	}
+	reply.Value = past.value
+	reply.Version = past.version
+	reply.Err = OK
+}
+
+// pruneHistoryL drops the past versions that have grown too old, for
+// the reaper. Caller must hold kv.mu.
+func (kv *KVServer) pruneHistoryL(now time.Time) {
+	if kv.historyPolicy.Age == 0 {
+		return
+	}
+	for i := range kv.stripes {
+		s := &kv.stripes[i]
+		for key, past := range s.history {
+			if past = kv.historyPolicy.prune(past, now); len(past) > 0 {
+				s.history[key] = past
+			} else {
+				delete(s.history, key)
+			}
+		}
+	}
+}
+
+// historyL returns the history of all keys, to persist. Caller must
+// hold kv.mu.
+func (kv *KVServer) historyL() []persistedPast {
+	return kv.historyWhereL(func(Key) bool { return true })
+}
+
+// historyWhereL returns the history of the keys for which keep
+// returns true. Caller must hold kv.mu.
+func (kv *KVServer) historyWhereL(keep func(Key) bool) []persistedPast {
+	var history []persistedPast
+	for i := range kv.stripes {
+		for key, past := range kv.stripes[i].history {
+			if !keep(key) {
+				continue
+			}
+			for _, p := range past {
+				history = append(history, persistedPast{
+					Key:      string(key),
+					Value:    p.value,
+					Version:  p.version,
+					Replaced: p.replaced.UnixNano(),
+				})
+			}
+		}
+	}
+	return history
+}
+
+// loadHistoryL replaces the history of the keys in history, which is
+// in the order historyL returns it. Caller must hold kv.mu.
+func (kv *KVServer) loadHistoryL(history []persistedPast) {
+	loaded := make(map[Key]bool)
+	for _, p := range history {
+		key := Key(p.Key)
+		s := kv.stripeOf(key)
+		if !loaded[key] {
+			loaded[key] = true
+			delete(s.history, key)
+		}
+		s.history[key] = append(s.history[key], pastValue{
+			value:    p.Value,
+			version:  p.Version,
+			replaced: time.Unix(0, p.Replaced),
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package kv_server_with_stable_network
+
+import (
+	"iter"
+	"sync"
+)
+
+// keyIndex keeps the keys of a KVServer in lexicographic order, in a
+// B-tree (see btree.go) whose values are unused, so that Scan can
+// walk a range of keys without sorting the whole map, and Put and
+// Delete update it in O(log n). mu guards insert and remove, which
+// Put and Delete call with kv.mu held only shared; the readers of
+// keys hold kv.mu exclusively.
+//
+// If the engines of the stripes keep their keys in order themselves,
+// as the B-tree and LSM engines do, the index keeps no keys, and
+// instead merges the engines' keys as Scan walks them, so that an LSM
+// engine's keys don't all have to fit in memory after all.
+type keyIndex struct {
+	mu      sync.Mutex
+	keys    btreeEngine
+	engines []OrderedEngine // nil unless every stripe's engine is ordered
+}
+
+// resetIndexL empties the index. Caller must hold kv.mu.
+func (kv *KVServer) resetIndexL() {
+	kv.index.keys = btreeEngine{}
+	kv.index.engines = nil
+	for i := range kv.stripes {
+		e, ok := kv.stripes[i].engine.(OrderedEngine)
+		if !ok {
+			kv.index.engines = nil
+			return
+		}
+		kv.index.engines = append(kv.index.engines, e)
+	}
+}
+
+func (ix *keyIndex) insert(key Key) {
+	if ix.engines != nil {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.keys.Put(key, Value{})
+}
+
+func (ix *keyIndex) remove(key Key) {
+	if ix.engines != nil {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.keys.Delete(key)
+}
+
+// ascendL calls fn for each key >= start, in order, with its value,
+// until fn returns false. fn must not read the engines itself: an LSM
+// engine holds its lock for the whole walk, and a flush waiting for
+// that lock would block a second read behind it. Caller must hold
+// kv.mu.
+func (kv *KVServer) ascendL(start Key, fn func(Key, Value) bool) {
+	ix := &kv.index
+	if ix.engines == nil {
+		ix.keys.Ascend(start, func(key Key, _ Value) bool {
+			value, _ := kv.valueL(key)
+			return fn(key, value)
+		})
+		return
+	}
+
+	// each key is in just one engine
+	type source struct {
+		next  func() (Key, Value, bool)
+		key   Key
+		value Value
+		ok    bool
+	}
+	srcs := make([]*source, len(ix.engines))
+	for i, e := range ix.engines {
+		next, stop := iter.Pull2(func(yield func(Key, Value) bool) {
+			e.Ascend(start, yield)
+		})
+		defer stop()
+		srcs[i] = &source{next: next}
+		srcs[i].key, srcs[i].value, srcs[i].ok = next()
+	}
+	for {
+		var first *source
+		for _, src := range srcs {
+			if src.ok && (first == nil || src.key < first.key) {
+				first = src
+			}
+		}
+		if first == nil || !fn(first.key, first.value) {
+			return
+		}
+		first.key, first.value, first.ok = first.next()
+	}
+}
+
+// prefixEnd returns the smallest key that is greater than every key
+// with the given prefix, or "" if there is no such key.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i] += 1
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -2,16 +2,18 @@ package kv_server_with_stable_network
 
 import (
 	"fmt"
+	"reflect"
 	"sort"
 
 	"github.com/anishathalye/porcupine"
 )
 
 type KvInput struct {
-	Op      uint8 // 0 => get, 1 => put
+	Op      uint8 // 0 => get, 1 => put, 2 => delete, 3 => multiput
 	Key     string
 	Value   string
 	Version uint64
+	Puts    []KvInput // the puts of a multiput
 }
 
 type KvOutput struct {
@@ -20,48 +22,109 @@ type KvOutput struct {
 	Err     string
 }
 
+// the keys an operation reads or writes
+func (inp KvInput) keys() []string {
+	if inp.Op == 3 && len(inp.Puts) > 0 {
+		keys := make([]string, 0, len(inp.Puts))
+		for _, p := range inp.Puts {
+			keys = append(keys, p.Key)
+		}
+		return keys
+	}
+	return []string{inp.Key}
+}
+
 var KvModel = porcupine.Model{
+	// Partition by key, except that keys touched by the same
+	// multiput end up in the same partition.
 	Partition: func(history []porcupine.Operation) [][]porcupine.Operation {
+		parent := make(map[string]string)
+		var find func(string) string
+		find = func(k string) string {
+			p, ok := parent[k]
+			if !ok || p == k {
+				parent[k] = k
+				return k
+			}
+			r := find(p)
+			parent[k] = r
+			return r
+		}
+		for _, v := range history {
+			keys := v.Input.(KvInput).keys()
+			for _, k := range keys[1:] {
+				parent[find(k)] = find(keys[0])
+			}
+		}
 		m := make(map[string][]porcupine.Operation)
 		for _, v := range history {
-			key := v.Input.(KvInput).Key
-			m[key] = append(m[key], v)
+			root := find(v.Input.(KvInput).keys()[0])
+			m[root] = append(m[root], v)
 		}
-		keys := make([]string, 0, len(m))
+		roots := make([]string, 0, len(m))
 		for k := range m {
-			keys = append(keys, k)
+			roots = append(roots, k)
 		}
-		sort.Strings(keys)
-		ret := make([][]porcupine.Operation, 0, len(keys))
-		for _, k := range keys {
+		sort.Strings(roots)
+		ret := make([][]porcupine.Operation, 0, len(roots))
+		for _, k := range roots {
 			ret = append(ret, m[k])
 		}
 		return ret
 	},
 	Init: func() interface{} {
-		// note: we are modeling a single key's value here;
-		// we're partitioning by key, so this is okay
-		return KvState{"", 0}
+		// note: we are modeling only the keys of one partition
+		// here; keys that don't exist are absent from the map
+		return KvStates{}
 	},
 	Step: func(state, input, output interface{}) (bool, interface{}) {
 		inp := input.(KvInput)
 		out := output.(KvOutput)
-		st := state.(KvState)
+		sts := state.(KvStates)
+		st := sts[inp.Key]
 		switch inp.Op {
 		case 0:
 			// get
-			return out.Value == st.Value, state
+			if st.Version == 0 {
+				return out.Err == "ErrNoKey", state
+			}
+			return out.Err == "OK" && out.Value == st.Value && out.Version == st.Version, state
 		case 1:
 			// put
 			if st.Version == inp.Version {
-				return out.Err == "OK" || out.Err == "ErrMaybe", KvState{inp.Value, st.Version + 1}
+				return out.Err == "OK" || out.Err == "ErrMaybe", sts.with(inp.Key, KvState{inp.Value, st.Version + 1})
+			} else if st.Version == 0 {
+				return out.Err == "ErrNoKey" || out.Err == "ErrMaybe", state
 			} else {
-				return out.Err == "ErrVersion" || out.Err == "ErrMaybe", st
+				return out.Err == "ErrVersion" || out.Err == "ErrMaybe", state
 			}
+		case 2:
+			// delete; a deleted key looks like one that was never created
+			if st.Version == 0 {
+				return out.Err == "ErrNoKey" || out.Err == "ErrMaybe", state
+			} else if st.Version == inp.Version {
+				return out.Err == "OK" || out.Err == "ErrMaybe", sts.with(inp.Key, KvState{"", 0})
+			} else {
+				return out.Err == "ErrVersion" || out.Err == "ErrMaybe", state
+			}
+		case 3:
+			// multiput; either all puts happen or none
+			nsts := sts
+			for _, p := range inp.Puts {
+				st := nsts[p.Key]
+				if st.Version != p.Version {
+					return out.Err == "ErrVersion" || out.Err == "ErrMaybe", state
+				}
+				nsts = nsts.with(p.Key, KvState{p.Value, st.Version + 1})
+			}
+			return out.Err == "OK" || out.Err == "ErrMaybe", nsts
 		default:
 			return false, "<invalid>"
 		}
 	},
+	Equal: func(state1, state2 interface{}) bool {
+		return reflect.DeepEqual(state1, state2)
+	},
 	DescribeOperation: func(input, output interface{}) string {
 		inp := input.(KvInput)
 		out := output.(KvOutput)
@@ -70,6 +133,17 @@ var KvModel = porcupine.Model{
 			return fmt.Sprintf("get('%s') -> ('%s', '%d', '%s')", inp.Key, out.Value, out.Version, out.Err)
 		case 1:
 			return fmt.Sprintf("put('%s', '%s', '%d') -> ('%s')", inp.Key, inp.Value, inp.Version, out.Err)
+		case 2:
+			return fmt.Sprintf("delete('%s', '%d') -> ('%s')", inp.Key, inp.Version, out.Err)
+		case 3:
+			puts := ""
+			for i, p := range inp.Puts {
+				if i > 0 {
+					puts += ", "
+				}
+				puts += fmt.Sprintf("('%s', '%s', '%d')", p.Key, p.Value, p.Version)
+			}
+			return fmt.Sprintf("multiput(%s) -> ('%s')", puts, out.Err)
 		default:
 			return "<invalid>"
 		}
@@ -80,3 +154,20 @@ type KvState struct {
 	Value   string
 	Version uint64
 }
+
+// The state of all keys in a partition. Steps must not modify a
+// KvStates, so with returns an updated copy.
+type KvStates map[string]KvState
+
+func (sts KvStates) with(key string, st KvState) KvStates {
+	nsts := make(KvStates, len(sts)+1)
+	for k, v := range sts {
+		nsts[k] = v
+	}
+	if st.Version == 0 {
+		delete(nsts, key)
+	} else {
+		nsts[key] = st
+	}
+	return nsts
+}
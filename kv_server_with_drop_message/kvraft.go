@@ -0,0 +1,197 @@
+package kv_server_with_stable_network
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+)
+
+// A KVServer in a Raft group is a replicated state machine: every
+// request, reads included, goes through the Raft log, and every
+// server performs the requests in log order. The server that took a
+// request waits until the request comes out of the log at the index
+// Raft promised, and replies with the result. If a different request
+// comes out at that index, or nothing does within CommitTimeout, the
+// server lost its leadership and the clerk must retry elsewhere.
+//
+// Raft keeps its state in the raftstate slot of the persister, and
+// the KVServer's snapshot goes in the snapshot slot through
+// Raft.Snapshot(), once the Raft state outgrows MaxRaftState.
+
+const MaxRaftState = 64 << 10
+
+// A request in the Raft log; exactly one of the args is set. Now is
+// the time, in Unix nanoseconds, at which the leader took the
+// request, and every server performs the request as of Now (see
+// nowL).
+type Op struct {
+	Id       int64
+	Get      *GetArgs
+	Put      *PutArgs
+	Delete   *DeleteArgs
+	MultiPut *MultiPutArgs
+	Scan     *ScanArgs
+	Now      int64
+
+	InstallShard *InstallShardArgs
+	FreezeShard  *FreezeShardArgs
+	DeleteShard  *DeleteShardArgs
+
+	Restore *RestoreArgs
+	Expire  *ExpireArgs
+}
+
+// The reply to an Op, set for the kind of the Op.
+type opResult struct {
+	id       int64
+	get      GetReply
+	put      PutReply
+	delete   DeleteReply
+	multiPut MultiPutReply
+	scan     ScanReply
+
+	installShard InstallShardReply
+	freezeShard  FreezeShardReply
+	deleteShard  DeleteShardReply
+
+	restore RestoreReply
+}
+
+type raftKV struct {
+	rf        *Raft
+	applyCh   chan ApplyMsg
+	persister *Persister
+
+	// protected by kv.mu
+	lastApplied int
+	now         time.Time // the Now of the Op being applied, if any
+	// the requests waiting to come out of the log, by index
+	waiting map[int]chan opResult
+}
+
+func init() {
+	Register(Op{})
+}
+
+func makeOpId() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+// submit puts op in the Raft log, and returns the result once op is
+// performed, or false if this server isn't the leader or lost its
+// leadership.
+func (kv *KVServer) submit(op Op) (opResult, bool) {
+	op.Id = makeOpId()
+	op.Now = time.Now().UnixNano()
+
+	kv.mu.Lock()
+	index, _, isLeader := kv.raft.rf.Start(op)
+	if !isLeader {
+		kv.mu.Unlock()
+		return opResult{}, false
+	}
+	ch := make(chan opResult, 1)
+	kv.raft.waiting[index] = ch
+	kv.mu.Unlock()
+
+	defer func() {
+		kv.mu.Lock()
+		if kv.raft.waiting[index] == ch {
+			delete(kv.raft.waiting, index)
+		}
+		kv.mu.Unlock()
+	}()
+
+	select {
+	case res := <-ch:
+		return res, res.id == op.Id
+	case <-time.After(CommitTimeout):
+		return opResult{}, false
+	case <-kv.stop:
+		return opResult{}, false
+	}
+}
+
+// applyOpL performs op. Caller must hold kv.mu.
+func (kv *KVServer) applyOpL(op Op) opResult {
+	res := opResult{id: op.Id}
+	kv.raft.now = time.Unix(0, op.Now)
+	defer func() { kv.raft.now = time.Time{} }()
+
+	switch {
+	case op.Get != nil:
+		kv.getL(op.Get, &res.get)
+	case op.Put != nil:
+		kv.putOpL(op.Put, &res.put)
+	case op.Delete != nil:
+		kv.deleteOpL(op.Delete, &res.delete)
+	case op.MultiPut != nil:
+		kv.multiPutOpL(op.MultiPut, &res.multiPut)
+	case op.Scan != nil:
+		kv.scanL(op.Scan, &res.scan)
+	case op.InstallShard != nil:
+		kv.installShardOpL(op.InstallShard, &res.installShard)
+	case op.FreezeShard != nil:
+		kv.freezeShardOpL(op.FreezeShard, &res.freezeShard)
+	case op.DeleteShard != nil:
+		kv.deleteShardOpL(op.DeleteShard, &res.deleteShard)
+	case op.Restore != nil:
+		kv.restoreOpL(op.Restore, &res.restore)
+	case op.Expire != nil:
+		kv.expireOpL(op.Expire)
+	}
+	return res
+}
+
+// applier performs the requests that come out of the Raft log, and
+// installs the snapshots Raft hands over, until Raft is killed.
+func (kv *KVServer) applier() {
+	for msg := range kv.raft.applyCh {
+		kv.mu.Lock()
+		if msg.SnapshotValid && msg.SnapshotIndex > kv.raft.lastApplied {
+			kv.loadStateL(msg.Snapshot)
+			kv.raft.lastApplied = msg.SnapshotIndex
+		} else if msg.CommandValid && msg.CommandIndex > kv.raft.lastApplied {
+			kv.raft.lastApplied = msg.CommandIndex
+			res := kv.applyOpL(msg.Command.(Op))
+			if ch, ok := kv.raft.waiting[msg.CommandIndex]; ok {
+				ch <- res
+				delete(kv.raft.waiting, msg.CommandIndex)
+			}
+			if kv.raft.persister.RaftStateSize() > MaxRaftState {
+				kv.raft.rf.Snapshot(msg.CommandIndex, kv.encodeStateL())
+			}
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// startRaft makes kv server me of a Raft group, restoring its state
+// from the snapshot in persister.
+func (kv *KVServer) startRaft(ends []*ClientEnd, me int, persister *Persister) *Raft {
+	kv.mu.Lock()
+	kv.raft = &raftKV{
+		applyCh:   make(chan ApplyMsg),
+		persister: persister,
+		waiting:   make(map[int]chan opResult),
+	}
+
+	// Raft replays its log onto the snapshot, so durable engines
+	// must start from the snapshot rather than from their files
+	if data := persister.ReadSnapshot(); len(data) > 0 {
+		kv.loadStateL(data)
+	} else {
+		kv.resetL()
+	}
+	kv.mu.Unlock()
+
+	rf := MakeRaft(ends, me, persister, kv.raft.applyCh, kv.spawn)
+	kv.mu.Lock()
+	kv.raft.rf = rf
+	kv.mu.Unlock()
+
+	kv.spawn(kv.applier)
+	return rf
+}
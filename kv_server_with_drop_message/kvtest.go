@@ -13,6 +13,12 @@ import (
 type IKVClerk interface {
 	Get(string) (string, Tversion, Err)
 	Put(string, string, Tversion) Err
+	PutTTL(string, string, Tversion, time.Duration) Err
+	Delete(string, Tversion) Err
+	MultiPut([]PutOp) ([]Conflict, Err)
+	Scan(string, string, int, string) ([]ScanEntry, string, Err)
+	ScanPrefix(string, int, string) ([]ScanEntry, string, Err)
+	Watch(string, Tversion, time.Duration) (string, Tversion, Err)
 }
 
 type IClerkMaker interface {
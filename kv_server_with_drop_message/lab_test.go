@@ -1,9 +1,19 @@
 package kv_server_with_stable_network
 
 import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/anishathalye/porcupine"
 )
 
 // Test Put with a single client and a reliable network
@@ -117,9 +127,9 @@ func TestMemPutManyClientsReliable(t *testing.T) {
 	}
 }
 
-// Test with one client and unreliable network. If Clerk.Put returns
-// ErrMaybe, the Put must have happened, since the test uses only one
-// client.
+// Test with one client and unreliable network. Resent Puts must not
+// be performed twice, so every Put must succeed with OK and bump the
+// version exactly once.
 func TestUnreliableNet(t *testing.T) {
 	const NTRY = 100
 
@@ -130,29 +140,3017 @@ func TestUnreliableNet(t *testing.T) {
 
 	ck := ts.MakeClerk()
 
-	retried := false
 	for try := 0; try < NTRY; try++ {
-		for i := 0; true; i++ {
-			if err := ts.PutJson(ck, "k", i, Tversion(try), 0); err != ErrMaybe {
-				if i > 0 && err != ErrVersion {
-					t.Fatalf("Put shouldn't have happen more than once %v", err)
-				}
-				break
-			}
-			// Try put again; it should fail with ErrVersion
-			retried = true
+		if err := ts.PutJson(ck, "k", try, Tversion(try), 0); err != OK {
+			t.Fatalf("Put err %v; expected OK", err)
 		}
 		v := 0
 		if ver := ts.GetJson(ck, "k", 0, &v); ver != Tversion(try+1) {
 			t.Fatalf("Wrong version %d expect %d", ver, try+1)
 		}
-		if v != 0 {
-			t.Fatalf("Wrong value %d expect %d", v, 0)
+		if v != try {
+			t.Fatalf("Wrong value %d expect %d", v, try)
 		}
 	}
-	if !retried {
-		t.Fatalf("Clerk.Put never returned ErrMaybe")
+	if ts.RpcTotal() <= 2*NTRY {
+		t.Fatalf("Clerk never resent an RPC")
 	}
 
 	ts.CheckPorcupine()
 }
+
+// Test Delete with a single client and a reliable network
+func TestReliableDelete(t *testing.T) {
+	const Val = "6.5840"
+
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and reliable Delete")
+
+	ck := ts.MakeClerk()
+	if err := ck.Delete("k", 0); err != ErrNoKey {
+		t.Fatalf("expected Delete to fail with ErrNoKey; got err=%v", err)
+	}
+
+	if err := ck.Put("k", Val, 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	if err := ck.Delete("k", 2); err != ErrVersion {
+		t.Fatalf("expected Delete to fail with ErrVersion; got err=%v", err)
+	}
+
+	if err := ck.Delete("k", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+
+	if _, _, err := ck.Get("k"); err != ErrNoKey {
+		t.Fatalf("expected Get to fail with ErrNoKey; got err=%v", err)
+	}
+
+	// a deleted key can be created again from version 0
+	if err := ck.Put("k", Val, 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if val, ver, err := ck.Get("k"); err != OK || val != Val || ver != 1 {
+		t.Fatalf("Get (%v, %v, %v); expected (%v, 1, OK)", val, ver, err, Val)
+	}
+}
+
+func TestPutDeleteConcurrentReliable(t *testing.T) {
+	runPutDeleteConcurrent(t, true)
+}
+
+// Resent Puts and Deletes must not be performed again after another
+// clerk re-created or deleted the key.
+func TestPutDeleteConcurrentUnreliable(t *testing.T) {
+	runPutDeleteConcurrent(t, false)
+}
+
+// Test that the model checks the Err and version of a Get, not just
+// its value
+func TestKvModelGet(t *testing.T) {
+	put := func(value string, version uint64, at int64) porcupine.Operation {
+		return porcupine.Operation{Input: KvInput{Op: 1, Key: "k", Value: value, Version: version},
+			Output: KvOutput{Err: "OK"}, Call: at, Return: at + 1}
+	}
+	del := porcupine.Operation{Input: KvInput{Op: 2, Key: "k", Version: 2}, Output: KvOutput{Err: "OK"}, Call: 4, Return: 5}
+	get := func(out KvOutput, at int64) porcupine.Operation {
+		return porcupine.Operation{Input: KvInput{Op: 0, Key: "k"}, Output: out, Call: at, Return: at + 1}
+	}
+
+	for _, c := range []struct {
+		history []porcupine.Operation
+		ok      bool
+	}{
+		{[]porcupine.Operation{put("x", 0, 0), put("y", 1, 2), get(KvOutput{Value: "y", Version: 2, Err: "OK"}, 4)}, true},
+		{[]porcupine.Operation{put("x", 0, 0), put("y", 1, 2), get(KvOutput{Value: "y", Version: 1, Err: "OK"}, 4)}, false},
+		{[]porcupine.Operation{put("x", 0, 0), put("y", 1, 2), del, get(KvOutput{Err: "ErrNoKey"}, 6)}, true},
+		{[]porcupine.Operation{put("x", 0, 0), put("y", 1, 2), del, get(KvOutput{Err: "OK"}, 6)}, false},
+	} {
+		if ok := porcupine.CheckOperations(KvModel, c.history); ok != c.ok {
+			t.Fatalf("CheckOperations %v for %v; expected %v", ok, c.history, c.ok)
+		}
+	}
+}
+
+// Many clients putting and deleting the same key.
+func runPutDeleteConcurrent(t *testing.T, reliable bool) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NCLNT         = 5
+		NSEC          = 1
+	)
+
+	ts := MakeTestKV(t, reliable)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: many clients racing to put and delete the same key")
+
+	ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		res := ClntRes{}
+		for {
+			select {
+			case <-done:
+				return res
+			default:
+				_, ver, err := Get(ts.Config, ck, "k", ts.oplog, me)
+				if err == ErrNoKey {
+					err = Put(ts.Config, ck, "k", strconv.Itoa(me), 0, ts.oplog, me)
+				} else if rand.Int()%2 == 0 {
+					err = Delete(ts.Config, ck, "k", ver, ts.oplog, me)
+				} else {
+					err = Put(ts.Config, ck, "k", strconv.Itoa(me), ver, ts.oplog, me)
+				}
+				if err == OK {
+					res.Nok += 1
+				} else if err == ErrMaybe {
+					res.Nmaybe += 1
+				}
+			}
+		}
+	})
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// Test MultiPut with a single client and a reliable network
+func TestReliableMultiPut(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and reliable MultiPut")
+
+	ck := ts.MakeClerk()
+	if _, err := ck.MultiPut([]PutOp{{"a", "1", 0}, {"b", "1", 0}}); err != OK {
+		t.Fatalf("MultiPut err %v", err)
+	}
+
+	// b is at version 1, and c doesn't exist, so nothing happens
+	conflicts, err := ck.MultiPut([]PutOp{{"a", "2", 1}, {"b", "2", 0}, {"c", "2", 1}})
+	if err != ErrVersion {
+		t.Fatalf("expected MultiPut to fail with ErrVersion; got err=%v", err)
+	}
+	expected := []Conflict{{"b", 1, ErrVersion}, {"c", 0, ErrNoKey}}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Fatalf("wrong conflicts %v; expected %v", conflicts, expected)
+	}
+	if val, ver, err := ck.Get("a"); err != OK || val != "1" || ver != 1 {
+		t.Fatalf("Get (%v, %v, %v); expected (1, 1, OK)", val, ver, err)
+	}
+
+	// a later op on the same key expects the version of the earlier one
+	if _, err := ck.MultiPut([]PutOp{{"a", "2", 1}, {"a", "3", 2}, {"b", "3", 1}}); err != OK {
+		t.Fatalf("MultiPut err %v", err)
+	}
+	if val, ver, err := ck.Get("a"); err != OK || val != "3" || ver != 3 {
+		t.Fatalf("Get (%v, %v, %v); expected (3, 3, OK)", val, ver, err)
+	}
+	if val, ver, err := ck.Get("b"); err != OK || val != "3" || ver != 2 {
+		t.Fatalf("Get (%v, %v, %v); expected (3, 2, OK)", val, ver, err)
+	}
+}
+
+// Many clients moving a value between two keys with MultiPut; the
+// keys must always be updated together.
+func TestMultiPutConcurrent(t *testing.T) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NCLNT         = 5
+		NSEC          = 1
+	)
+
+	ts := MakeTestKV(t, false)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: many clients racing to multiput two keys")
+
+	ck := ts.MakeClerk()
+	for _, k := range []string{"x", "y"} {
+		if err := Put(ts.Config, ck, k, "0", 0, ts.oplog, 0); err != OK && err != ErrMaybe {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+
+	ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		res := ClntRes{}
+		for {
+			select {
+			case <-done:
+				return res
+			default:
+				_, verx, _ := Get(ts.Config, ck, "x", ts.oplog, me)
+				_, very, _ := Get(ts.Config, ck, "y", ts.oplog, me)
+				v := strconv.Itoa(me)
+				_, err := MultiPut(ts.Config, ck, []PutOp{{"x", v, verx}, {"y", v, very}}, ts.oplog, me)
+				if err == OK {
+					res.Nok += 1
+				} else if err == ErrMaybe {
+					res.Nmaybe += 1
+				}
+			}
+		}
+	})
+
+	valx, verx, _ := ck.Get("x")
+	valy, very, _ := ck.Get("y")
+	if valx != valy || verx != very {
+		t.Fatalf("keys diverged: x=(%v, %v) y=(%v, %v)", valx, verx, valy, very)
+	}
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// Test Scan over ranges and prefixes with a reliable network
+func TestReliableScan(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and reliable Scan")
+
+	ck := ts.MakeClerk()
+	for _, k := range []string{"b/2", "a", "b/1", "c", "b/3", "b"} {
+		if err := ck.Put(k, "v"+k, 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if err := ck.Put("b/1", "vb/1", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.Delete("b/3", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+
+	entries, token, err := ck.Scan("", "", 0, "")
+	if err != OK || token != "" {
+		t.Fatalf("Scan err %v token %q", err, token)
+	}
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		if e.Value != "v"+e.Key {
+			t.Fatalf("wrong value %v for %v", e.Value, e.Key)
+		}
+	}
+	if expected := []string{"a", "b", "b/1", "b/2", "c"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Scan keys %v; expected %v", keys, expected)
+	}
+	if entries[2].Version != 2 {
+		t.Fatalf("wrong version %v for b/1", entries[2].Version)
+	}
+
+	if entries, _, _ := ck.Scan("b", "c", 0, ""); len(entries) != 3 {
+		t.Fatalf("Scan [b, c) returned %v", entries)
+	}
+
+	// page through the prefix one key at a time
+	keys = []string{}
+	token = ""
+	for {
+		entries, token, err = ck.ScanPrefix("b/", 1, token)
+		if err != OK || len(entries) > 1 {
+			t.Fatalf("ScanPrefix err %v entries %v", err, entries)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if token == "" {
+			break
+		}
+	}
+	if expected := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("ScanPrefix keys %v; expected %v", keys, expected)
+	}
+}
+
+// Test that paging through many keys over an unreliable network
+// returns every key exactly once.
+func TestScanUnreliable(t *testing.T) {
+	const (
+		NKEY  = 50
+		LIMIT = 7
+	)
+
+	ts := MakeTestKV(t, false)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and unreliable Scan")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(fmt.Sprintf("k%03d", i), strconv.Itoa(i), 0); err != OK && err != ErrMaybe {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+
+	n := 0
+	token := ""
+	for {
+		entries, next, err := ck.Scan("k", "", LIMIT, token)
+		if err != OK {
+			t.Fatalf("Scan err %v", err)
+		}
+		for _, e := range entries {
+			if e.Key != fmt.Sprintf("k%03d", n) || e.Value != strconv.Itoa(n) {
+				t.Fatalf("Scan entry %v; expected key %d", e, n)
+			}
+			n++
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if n != NKEY {
+		t.Fatalf("Scan returned %d keys; expected %d", n, NKEY)
+	}
+}
+
+// Test that Watch wakes up on Put and Delete, and times out otherwise
+func TestReliableWatch(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and reliable Watch")
+
+	ck := ts.MakeClerk()
+	writer := ts.MakeClerk()
+
+	start := time.Now()
+	if _, ver, err := ck.Watch("k", 0, 200*time.Millisecond); ver != 0 || err != ErrNoKey {
+		t.Fatalf("Watch (%v, %v); expected timeout with (0, ErrNoKey)", ver, err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("Watch returned after %v; expected to block", d)
+	}
+
+	// the writer's calls must not overlap, since a Clerk isn't safe
+	// for concurrent use
+	written := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		writer.Put("k", "x", 0)
+		close(written)
+	}()
+	if val, ver, err := ck.Watch("k", 0, 5*time.Second); val != "x" || ver != 1 || err != OK {
+		t.Fatalf("Watch (%v, %v, %v); expected (x, 1, OK)", val, ver, err)
+	}
+	<-written
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		writer.Delete("k", 1)
+	}()
+	if _, ver, err := ck.Watch("k", 1, 5*time.Second); ver != 0 || err != ErrNoKey {
+		t.Fatalf("Watch (%v, %v); expected (0, ErrNoKey)", ver, err)
+	}
+}
+
+// Test that a watcher sees every change of a key eventually over an
+// unreliable network
+func TestWatchUnreliable(t *testing.T) {
+	const NPUT = 20
+
+	ts := MakeTestKV(t, false)
+	defer ts.Cleanup()
+
+	ts.Begin("Watch with unreliable network")
+
+	writer := ts.MakeClerk()
+	go func() {
+		for i := 0; i < NPUT; i++ {
+			time.Sleep(20 * time.Millisecond)
+			writer.Put("k", strconv.Itoa(i), Tversion(i))
+		}
+	}()
+
+	ck := ts.MakeClerk()
+	ver := Tversion(0)
+	for ver < NPUT {
+		_, nver, err := ck.Watch("k", ver, 10*time.Second)
+		if nver == ver {
+			t.Fatalf("Watch timed out at version %v (err %v)", ver, err)
+		}
+		if nver < ver {
+			t.Fatalf("Watch went back from version %v to %v", ver, nver)
+		}
+		ver = nver
+	}
+}
+
+// Test that keys with a TTL expire, whether or not a client touches
+// them, and that a Put without TTL makes a key permanent again.
+func TestReliableTTL(t *testing.T) {
+	const TTL = 200 * time.Millisecond
+
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and reliable TTL")
+
+	ck := ts.MakeClerk()
+	if err := ck.PutTTL("k", "x", 0, TTL); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+	if err := ck.PutTTL("p", "x", 0, TTL); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+	if err := ck.Put("p", "y", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if val, ver, err := ck.Get("k"); err != OK || val != "x" || ver != 1 {
+		t.Fatalf("Get (%v, %v, %v); expected (x, 1, OK)", val, ver, err)
+	}
+
+	time.Sleep(2 * TTL)
+
+	if _, _, err := ck.Get("k"); err != ErrNoKey {
+		t.Fatalf("expected Get of expired key to fail with ErrNoKey; got err=%v", err)
+	}
+	if err := ck.Put("k", "y", 1); err != ErrNoKey {
+		t.Fatalf("expected Put of expired key to fail with ErrNoKey; got err=%v", err)
+	}
+	if val, ver, err := ck.Get("p"); err != OK || val != "y" || ver != 2 {
+		t.Fatalf("Get (%v, %v, %v); expected (y, 2, OK)", val, ver, err)
+	}
+
+	// an expired key can be created again
+	if err := ck.PutTTL("k", "z", 0, TTL); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+
+	// nobody touches k, so only the reaper can wake up the watcher
+	start := time.Now()
+	if _, ver, err := ck.Watch("k", 1, 10*TTL); ver != 0 || err != ErrNoKey {
+		t.Fatalf("Watch (%v, %v); expected (0, ErrNoKey)", ver, err)
+	}
+	if d := time.Since(start); d > 5*TTL {
+		t.Fatalf("key expired after %v; expected about %v", d, TTL)
+	}
+}
+
+// Test that keys and versions survive restarts of the server
+func TestRestartReliable(t *testing.T) {
+	const NPUT = 10
+
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("One client and restarts")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NPUT; i++ {
+		if err := ck.Put("k", strconv.Itoa(i), Tversion(i)); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+		if err := ck.PutTTL("ttl", "x", Tversion(i), time.Minute); err != OK {
+			t.Fatalf("PutTTL err %v", err)
+		}
+		ts.Restart()
+		if val, ver, err := ck.Get("k"); err != OK || val != strconv.Itoa(i) || ver != Tversion(i+1) {
+			t.Fatalf("Get after restart (%v, %v, %v); expected (%v, %v, OK)", val, ver, err, i, i+1)
+		}
+		if _, ver, err := ck.Get("ttl"); err != OK || ver != Tversion(i+1) {
+			t.Fatalf("Get after restart (%v, %v); expected (%v, OK)", ver, err, i+1)
+		}
+	}
+
+	if err := ck.Delete("ttl", NPUT); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	ts.Restart()
+	if _, _, err := ck.Get("ttl"); err != ErrNoKey {
+		t.Fatalf("expected Get of deleted key to fail with ErrNoKey; got err=%v", err)
+	}
+}
+
+func TestRestartPutConcurrentReliable(t *testing.T) {
+	runRestartPutConcurrent(t, true, StartKVServer)
+}
+
+func TestRestartPutConcurrentUnreliable(t *testing.T) {
+	runRestartPutConcurrent(t, false, StartKVServer)
+}
+
+// Same, with an LSM engine whose memtables are small enough that the
+// restarts often kill the server in the middle of a flush.
+func TestRestartPutConcurrentLSM(t *testing.T) {
+	runRestartPutConcurrent(t, true, StartKVServerLSM(t.TempDir(), 256))
+}
+
+// Same, with the server's state in files that each restart reads
+// back.
+func TestRestartPutConcurrentFile(t *testing.T) {
+	runRestartPutConcurrent(t, true, StartKVServerFile(t.TempDir()))
+}
+
+// Many clients putting to the same key while the server restarts
+// repeatedly. Since acknowledged Puts are persisted and resends are
+// recognized across restarts, the version at the server must match
+// the number of successful Puts exactly.
+func runRestartPutConcurrent(t *testing.T, reliable bool, mks FstartServer) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NCLNT         = 5
+		NSEC          = 2
+	)
+
+	ts := makeTestKV(t, 1, reliable, mks)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: many clients putting to the same key with restarts")
+
+	done := make(chan struct{})
+	restarted := make(chan struct{})
+	go func() {
+		defer close(restarted)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(300 * time.Millisecond):
+				ts.Restart()
+			}
+		}
+	}()
+
+	rs := ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		return ts.OneClientPut(me, ck, []string{"k"}, done)
+	})
+	close(done)
+	<-restarted
+
+	ck := ts.MakeClerk()
+	ts.CheckPutConcurrent(ck, "k", rs, &ClntRes{}, true)
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// Test that a file-backed persister reads back what it saved and
+// appended, even after a Save was interrupted, and stops writing once
+// copied.
+func TestFilePersister(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister err %v", err)
+	}
+	if ps.RaftStateSize() != 0 || len(ps.ReadSnapshot()) != 0 {
+		t.Fatalf("new persister isn't empty")
+	}
+	ps.Save([]byte("r1"), []byte("s1"))
+	ps.Save([]byte("r2"), []byte("s1"))
+
+	// left-overs of a Save that crashed before switching CURRENT
+	os.WriteFile(filepath.Join(dir, "raftstate-99"), []byte("junk"), 0644)
+	os.WriteFile(filepath.Join(dir, "CURRENT.tmp"), []byte("99 99\n"), 0644)
+
+	ps1, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister err %v", err)
+	}
+	if r, s := string(ps1.ReadRaftState()), string(ps1.ReadSnapshot()); r != "r2" || s != "s1" {
+		t.Fatalf("read (%q, %q); expected (r2, s1)", r, s)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("expected CURRENT, one raftstate and one snapshot; got %v", entries)
+	}
+
+	ps2 := ps1.Copy()
+	ps1.Save([]byte("old"), []byte("old"))
+	ps2.Save([]byte("r3"), []byte("s3"))
+	ps1.Save([]byte("old"), []byte("old"))
+	ps2.Append([]byte("+a"))
+	ps1.Append([]byte("+old"))
+	ps2.Append([]byte("+b"))
+
+	ps3, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister err %v", err)
+	}
+	if r, s := string(ps3.ReadRaftState()), string(ps3.ReadSnapshot()); r != "r3+a+b" || s != "s3" {
+		t.Fatalf("read (%q, %q); expected (r3+a+b, s3)", r, s)
+	}
+}
+
+// Test that a KVServer with a file-backed persister gets its keys
+// back after the process forgets it without a Kill, even if it was
+// in the middle of appending to its log.
+func TestFilePersisterKVServer(t *testing.T) {
+	const NPUT = 20
+
+	dir := t.TempDir()
+
+	ps, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister err %v", err)
+	}
+	kv0 := StartKVServer(nil, GRP0, 0, ps)[0].(*KVServer)
+	// Kill only stops background work; it doesn't save anything
+	defer kv0.Kill()
+	for i := 0; i < NPUT; i++ {
+		reply := PutReply{}
+		kv0.Put(&PutArgs{Key: "k", Value: strconv.Itoa(i), Version: Tversion(i), ClientId: 1, Seq: uint64(i + 1)}, &reply)
+		if reply.Err != OK {
+			t.Fatalf("Put err %v", reply.Err)
+		}
+	}
+
+	// what a crash during one more Append might leave behind
+	files, _ := filepath.Glob(filepath.Join(dir, "raftstate-*"))
+	if len(files) != 1 {
+		t.Fatalf("expected one raftstate; got %v", files)
+	}
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open %v", err)
+	}
+	f.Write([]byte{0x7f, 0x01})
+	f.Close()
+
+	ps, err = MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister err %v", err)
+	}
+	kv := StartKVServer(nil, GRP0, 0, ps)[0].(*KVServer)
+	defer kv.Kill()
+
+	get := GetReply{}
+	kv.Get(&GetArgs{Key: "k"}, &get)
+	if get.Err != OK || get.Value != strconv.Itoa(NPUT-1) || get.Version != NPUT {
+		t.Fatalf("Get (%v, %v, %v); expected (%v, %v, OK)", get.Value, get.Version, get.Err, NPUT-1, NPUT)
+	}
+
+	// the last Put is remembered, so a resend isn't performed again
+	reply := PutReply{}
+	kv.Put(&PutArgs{Key: "k", Value: "x", Version: NPUT - 1, ClientId: 1, Seq: NPUT}, &reply)
+	if reply.Err != OK {
+		t.Fatalf("resent Put err %v; expected OK", reply.Err)
+	}
+	kv.Get(&GetArgs{Key: "k"}, &get)
+	if get.Version != NPUT {
+		t.Fatalf("resent Put was performed again; version %v", get.Version)
+	}
+}
+
+// Test that a primary-backup group keeps serving, and keeps every
+// acknowledged write, when its primary crashes.
+func TestFailoverReliable(t *testing.T) {
+	const NSRV = 3
+
+	ts := MakeTestPBGroup(t, NSRV, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: primary crashes")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < 10; i++ {
+		if err := ck.Put("k"+strconv.Itoa(i), "v", 0); err != OK {
+			ts.Fatalf("Put err %v", err)
+		}
+	}
+
+	// server 0 is the primary of the first view
+	grp := ts.Group(GRP0)
+	grp.ShutdownServer(0)
+
+	for i := 0; i < 10; i++ {
+		if v, ver, err := ck.Get("k" + strconv.Itoa(i)); err != OK || v != "v" || ver != 1 {
+			ts.Fatalf("Get after failover %v %v %v", v, ver, err)
+		}
+	}
+	if err := ck.Put("k0", "w", 1); err != OK {
+		ts.Fatalf("Put after failover err %v", err)
+	}
+
+	grp.StartServer(0)
+	grp.ConnectOne(0)
+	grp.ShutdownServer(1)
+	grp.ShutdownServer(2)
+	grp.StartServer(1)
+	grp.ConnectOne(1)
+
+	if v, ver, err := ck.Get("k0"); err != OK || v != "w" || ver != 2 {
+		ts.Fatalf("Get after second failover %v %v %v", v, ver, err)
+	}
+}
+
+// Test many clients putting to the same key while servers of a
+// primary-backup group are partitioned away or crash, one at a time.
+func TestFailoverPartitionReliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestPBGroup, true, false)
+}
+
+func TestFailoverPartitionUnreliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestPBGroup, false, false)
+}
+
+func TestFailoverCrashReliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestPBGroup, true, true)
+}
+
+func TestFailoverCrashUnreliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestPBGroup, false, true)
+}
+
+func runFailoverPutConcurrent(t *testing.T, mk func(*testing.T, int, bool) *TestKV, reliable, crash bool) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NSRV          = 3
+		NCLNT         = 5
+		NSEC          = 5
+	)
+
+	ts := mk(t, NSRV, reliable)
+	defer ts.Cleanup()
+
+	ts.Begin(fmt.Sprintf("Test: many clients putting to the same key with failures (crash %v)", crash))
+
+	grp := ts.Group(GRP0)
+	done := make(chan struct{})
+	failed := make(chan struct{})
+	go func() {
+		defer close(failed)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+			i := rand.Intn(NSRV)
+			if crash {
+				grp.ShutdownServer(i)
+			} else {
+				grp.DisconnectAll(i)
+			}
+			time.Sleep(time.Second)
+			if crash {
+				grp.StartServer(i)
+			}
+			grp.ConnectOne(i)
+		}
+	}()
+
+	rs := ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		return ts.OneClientPut(me, ck, []string{"k"}, done)
+	})
+	close(done)
+	<-failed
+
+	ck := ts.MakeClerk()
+	ts.CheckPutConcurrent(ck, "k", rs, &ClntRes{}, true)
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// Test that a Raft group serves clerks through leader crashes, and
+// that a restarted group recovers from snapshots and its Raft log.
+func TestRaftReliable(t *testing.T) {
+	const (
+		NSRV = 3
+		NKEY = 100
+	)
+
+	ts := MakeTestKVGroup(t, NSRV, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: Raft group with leader crashes and restarts")
+
+	ck := ts.MakeClerk()
+	grp := ts.Group(GRP0)
+
+	// enough data that the servers snapshot
+	val := RandValue(MaxRaftState / NKEY)
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put("k"+strconv.Itoa(i), val, 0); err != OK {
+			ts.Fatalf("Put err %v", err)
+		}
+		if i%(NKEY/4) == 0 {
+			// crash whichever server is the leader
+			_, ver, _ := ck.Get("k0")
+			leader := ck.(*TestClerk).IKVClerk.(*Clerk).leaders[GRP0]
+			grp.ShutdownServer(leader)
+			if _, ver1, _ := ck.Get("k0"); ver1 != ver {
+				ts.Fatalf("version changed across failover %v %v", ver, ver1)
+			}
+			grp.StartServer(leader)
+			grp.ConnectOne(leader)
+		}
+	}
+
+	for i := 0; i < NSRV; i++ {
+		grp.ShutdownServer(i)
+	}
+	for i := 0; i < NSRV; i++ {
+		grp.StartServer(i)
+		grp.ConnectOne(i)
+	}
+
+	for i := 0; i < NKEY; i++ {
+		if v, ver, err := ck.Get("k" + strconv.Itoa(i)); err != OK || v != val || ver != 1 {
+			ts.Fatalf("Get after restart %v %v", ver, err)
+		}
+	}
+}
+
+// Test many clients putting to the same key while servers of a Raft
+// group are partitioned away or crash, one at a time.
+func TestRaftPartitionReliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestKVGroup, true, false)
+}
+
+func TestRaftPartitionUnreliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestKVGroup, false, false)
+}
+
+func TestRaftCrashReliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestKVGroup, true, true)
+}
+
+func TestRaftCrashUnreliable(t *testing.T) {
+	runFailoverPutConcurrent(t, MakeTestKVGroup, false, true)
+}
+
+// Test that a follower doesn't move its commit index back when an
+// AppendEntries with fewer entries than it has committed arrives, as
+// one the network delayed may
+func TestRaftCommitIndexMonotonic(t *testing.T) {
+	// no goroutines, so no elections or applying
+	rf := MakeRaft(make([]*ClientEnd, 3), 1, MakePersister(), make(chan ApplyMsg), func(func()) {})
+
+	entries := []LogEntry{{Term: 1, Command: 1}, {Term: 1, Command: 2}, {Term: 1, Command: 3}}
+	all := AppendEntriesArgs{Term: 1, LeaderId: 0, Entries: entries, LeaderCommit: 2}
+	fewer := AppendEntriesArgs{Term: 1, LeaderId: 0, Entries: entries[:1], LeaderCommit: 3}
+	for _, args := range []*AppendEntriesArgs{&all, &fewer} {
+		reply := AppendEntriesReply{}
+		rf.AppendEntries(args, &reply)
+		if !reply.Success {
+			t.Fatalf("AppendEntries %+v failed", args)
+		}
+	}
+	if rf.commitIndex != 2 {
+		t.Fatalf("commitIndex %v after an AppendEntries with fewer entries; expected 2", rf.commitIndex)
+	}
+}
+
+// Test that a Raft server performs each Op as of the time its leader
+// stamped on it, whatever its own clock says, so that the servers of
+// a group agree on which keys have expired and on their metadata
+func TestRaftApplyAsOfLeaderTime(t *testing.T) {
+	// no Raft, so the test applies the Ops itself
+	kv := MakeKVServer()
+	kv.raft = &raftKV{waiting: make(map[int]chan opResult)}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	then := time.Now().Add(-time.Hour)
+	put := kv.applyOpL(Op{Put: &PutArgs{Key: "k", Value: "x", TTL: time.Minute, ClientId: 1, Seq: 1}, Now: then.UnixNano()})
+	if put.put.Err != OK {
+		t.Fatalf("Put err %v", put.put.Err)
+	}
+	get := kv.applyOpL(Op{Get: &GetArgs{Key: "k", WithMeta: true}, Now: then.Add(time.Second).UnixNano()})
+	if get.get.Err != OK || get.get.Value != "x" || get.get.Meta.Created != then.UnixNano() {
+		t.Fatalf("Get (%v, %+v, %v) before the key expired; expected (x, created %v, OK)",
+			get.get.Value, get.get.Meta, get.get.Err, then.UnixNano())
+	}
+	get = kv.applyOpL(Op{Get: &GetArgs{Key: "k"}, Now: then.Add(2 * time.Minute).UnixNano()})
+	if get.get.Err != ErrNoKey {
+		t.Fatalf("Get err %v after the key expired; expected ErrNoKey", get.get.Err)
+	}
+}
+
+// Test that keys are spread over the groups of a sharded deployment,
+// that a group rejects the keys of other groups, and that Scan and
+// MultiPut work across groups.
+func TestShardReliable(t *testing.T) {
+	const (
+		NGRP = 3
+		NKEY = 100
+	)
+
+	ts := MakeTestShardKV(t, NGRP, 1, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: keys spread over groups")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(fmt.Sprintf("k%03d", i), strconv.Itoa(i), 0); err != OK {
+			ts.Fatalf("Put err %v", err)
+		}
+	}
+
+	cfg := ts.ctrler.Query()
+	gcks := make(map[Tgid]IKVClerk)
+	for gid := range cfg.Groups {
+		gcks[gid] = MakeClerk(ts.Config.MakeClient(), ServerName(gid, 0))
+	}
+	for i := 0; i < NKEY; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if v, _, err := ck.Get(key); err != OK || v != strconv.Itoa(i) {
+			ts.Fatalf("Get %v %v %v", key, v, err)
+		}
+		for gid, gck := range gcks {
+			_, _, err := gck.Get(key)
+			if gid == cfg.Shards[Key2Shard(key)] && err != OK {
+				ts.Fatalf("owner of %v err %v", key, err)
+			}
+			if gid != cfg.Shards[Key2Shard(key)] && err != ErrWrongGroup {
+				ts.Fatalf("group %v not owning %v err %v", gid, key, err)
+			}
+		}
+	}
+
+	keys := []string{}
+	token := ""
+	for {
+		entries, next, err := ck.Scan("", "", 7, token)
+		if err != OK {
+			ts.Fatalf("Scan err %v", err)
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if len(keys) != NKEY {
+		ts.Fatalf("Scan returned %d keys, want %d", len(keys), NKEY)
+	}
+	if _, _, err := ck.Scan(nsPrefix, "", 7, ""); err != ErrBadKey {
+		ts.Fatalf("Scan of stored keys err %v; expected ErrBadKey", err)
+	}
+	for i, k := range keys {
+		if k != fmt.Sprintf("k%03d", i) {
+			ts.Fatalf("Scan key %d is %v", i, k)
+		}
+	}
+
+	// two keys in the same shard, and one in a shard of another group
+	var same, other string
+	for i := 1; i < NKEY; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if same == "" && Key2Shard(key) == Key2Shard("k000") {
+			same = key
+		}
+		if other == "" && cfg.Shards[Key2Shard(key)] != cfg.Shards[Key2Shard("k000")] {
+			other = key
+		}
+	}
+	if _, err := ck.MultiPut([]PutOp{{Key: "k000", Value: "x", Version: 1}, {Key: same, Value: "x", Version: 1}}); err != OK {
+		ts.Fatalf("MultiPut within a group err %v", err)
+	}
+	if _, err := ck.MultiPut([]PutOp{{Key: "k000", Value: "y", Version: 2}, {Key: other, Value: "y", Version: 1}}); err != ErrWrongGroup {
+		ts.Fatalf("MultiPut across groups err %v", err)
+	}
+}
+
+// Test many clients putting to random keys of a sharded deployment.
+func TestShardConcurrentReliable(t *testing.T) {
+	runShardPutConcurrent(t, 1, true)
+}
+
+func TestShardConcurrentUnreliable(t *testing.T) {
+	runShardPutConcurrent(t, 1, false)
+}
+
+// Same, with each group a Raft group.
+func TestShardConcurrentRaft(t *testing.T) {
+	runShardPutConcurrent(t, 3, true)
+}
+
+func runShardPutConcurrent(t *testing.T, nsrv int, reliable bool) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NGRP          = 3
+		NCLNT         = 5
+		NSEC          = 3
+		NKEY          = 10
+	)
+
+	ts := MakeTestShardKV(t, NGRP, nsrv, reliable)
+	defer ts.Cleanup()
+
+	ts.Begin(fmt.Sprintf("Test: many clients putting to keys of %d groups", NGRP))
+
+	ka := make([]string, NKEY)
+	for i := range ka {
+		ka[i] = "k" + strconv.Itoa(i)
+	}
+	ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		return ts.OneClientPut(me, ck, ka, done)
+	})
+
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// Test that moving shards between groups keeps their keys, versions,
+// and clerks, and that the source group stops serving them.
+func TestShardMoveReliable(t *testing.T) {
+	const (
+		NGRP = 3
+		NKEY = 50
+	)
+
+	ts := MakeTestShardKV(t, NGRP, 1, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Test: move shards between groups")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		key := "k" + strconv.Itoa(i)
+		for v := Tversion(0); v < Tversion(i%3+1); v++ {
+			if err := ck.Put(key, strconv.Itoa(int(v)), v); err != OK {
+				ts.Fatalf("Put err %v", err)
+			}
+		}
+	}
+
+	// move every shard to group 1
+	next := ts.ctrler.Query()
+	for s := range next.Shards {
+		next.Shards[s] = 1
+	}
+	if err := ts.ctrler.ChangeConfigTo(next); err != OK {
+		ts.Fatalf("ChangeConfigTo err %v", err)
+	}
+	if cfg := ts.ctrler.Query(); cfg.Num != 2 || cfg.Shards != next.Shards {
+		ts.Fatalf("wrong config after move %v", cfg)
+	}
+
+	gck := MakeClerk(ts.Config.MakeClient(), ServerName(2, 0))
+	for i := 0; i < NKEY; i++ {
+		key := "k" + strconv.Itoa(i)
+		want := Tversion(i%3 + 1)
+		if v, ver, err := ck.Get(key); err != OK || ver != want || v != strconv.Itoa(int(want)-1) {
+			ts.Fatalf("Get %v after move %v %v %v", key, v, ver, err)
+		}
+		if _, _, err := gck.Get(key); err != ErrWrongGroup {
+			ts.Fatalf("old group still serves %v: %v", key, err)
+		}
+	}
+
+	// and spread them out again, with versions still going up
+	for s := range next.Shards {
+		next.Shards[s] = Tgid(s%NGRP + 1)
+	}
+	if err := ts.ctrler.ChangeConfigTo(next); err != OK {
+		ts.Fatalf("ChangeConfigTo err %v", err)
+	}
+	for i := 0; i < NKEY; i++ {
+		key := "k" + strconv.Itoa(i)
+		if err := ck.Put(key, "x", Tversion(i%3+1)); err != OK {
+			ts.Fatalf("Put %v after move err %v", key, err)
+		}
+	}
+}
+
+// Test that a moving shard takes along the past versions of its keys
+// and only the clerks whose last request touched it, and that the
+// controller won't assign a shard that holds keys to no group.
+func TestShardMoveHistoryAndClerks(t *testing.T) {
+	ts := makeTestShardKV(t, 2, 1, true, StartKVServerHistory(HistoryPolicy{Versions: 5}))
+	defer ts.Cleanup()
+
+	ts.Begin("Test: move a shard with history and clerks")
+
+	ck := ts.MakeClerk()
+	clerk := ck.(*TestClerk).IKVClerk.(*Clerk)
+	for ver := Tversion(0); ver < 3; ver++ {
+		if err := ck.Put("k", fmt.Sprintf("v%d", ver+1), ver); err != OK {
+			ts.Fatalf("Put err %v", err)
+		}
+	}
+	s := Key2Shard("k")
+	cur := ts.ctrler.Query()
+	from := cur.Shards[s]
+
+	// a clerk of the same group, whose last request was for another
+	// shard
+	ock := ts.MakeClerk()
+	for i := 0; ; i++ {
+		key := "o" + strconv.Itoa(i)
+		if Key2Shard(key) != s && cur.Shards[Key2Shard(key)] == from {
+			if err := ock.Put(key, "x", 0); err != OK {
+				ts.Fatalf("Put err %v", err)
+			}
+			break
+		}
+	}
+
+	if err := ts.ctrler.MoveShard(s, 0); err != ErrNotEmpty {
+		ts.Fatalf("MoveShard to gid 0 err %v; expected ErrNotEmpty", err)
+	}
+	if cfg := ts.ctrler.Query(); cfg.Num != cur.Num || cfg.Shards[s] != from {
+		ts.Fatalf("config changed to %v", cfg)
+	}
+	if val, _, err := ck.Get("k"); err != OK || val != "v3" {
+		ts.Fatalf("Get (%v, %v) after rejected move", val, err)
+	}
+
+	// freeze the shard the way the next move will, to see what moves
+	args := FreezeShardArgs{Shard: s, Num: cur.Num + 1}
+	reply := FreezeShardReply{}
+	if ok := ck.(*TestClerk).Clnt.Call(ServerName(from, 0), "KVServer.FreezeShard", &args, &reply); !ok || reply.Err != OK {
+		ts.Fatalf("FreezeShard ok %v err %v", ok, reply.Err)
+	}
+	if _, ok := reply.Clients[clerk.clientId]; !ok || len(reply.Clients) != 1 {
+		ts.Fatalf("FreezeShard clients %v; expected just %v", reply.Clients, clerk.clientId)
+	}
+	if len(reply.History) != 2 {
+		ts.Fatalf("FreezeShard history %v; expected 2 past versions", reply.History)
+	}
+
+	if err := ts.ctrler.MoveShard(s, 3-from); err != OK {
+		ts.Fatalf("MoveShard err %v", err)
+	}
+	for ver := Tversion(1); ver <= 3; ver++ {
+		if val, _, err := clerk.GetAt("k", ver); err != OK || val != fmt.Sprintf("v%d", ver) {
+			ts.Fatalf("GetAt %v (%v, %v) after move", ver, val, err)
+		}
+	}
+
+	if err := ck.Delete("k", 3); err != OK {
+		ts.Fatalf("Delete err %v", err)
+	}
+	if err := ts.ctrler.MoveShard(s, 0); err != OK {
+		ts.Fatalf("MoveShard of an empty shard to gid 0 err %v", err)
+	}
+	if cfg := ts.ctrler.Query(); cfg.Shards[s] != 0 {
+		ts.Fatalf("shard %v still assigned to %v", s, cfg.Shards[s])
+	}
+}
+
+// Test many clients putting to random keys while the controller keeps
+// moving shards between groups.
+func TestShardMoveConcurrentReliable(t *testing.T) {
+	runShardMoveConcurrent(t, 1, true)
+}
+
+func TestShardMoveConcurrentUnreliable(t *testing.T) {
+	runShardMoveConcurrent(t, 1, false)
+}
+
+// Same, with each group a Raft group.
+func TestShardMoveConcurrentRaft(t *testing.T) {
+	runShardMoveConcurrent(t, 3, true)
+}
+
+func runShardMoveConcurrent(t *testing.T, nsrv int, reliable bool) {
+	const (
+		PORCUPINETIME = 10 * time.Second
+		NGRP          = 3
+		NCLNT         = 5
+		NSEC          = 4
+		NKEY          = 10
+	)
+
+	ts := MakeTestShardKV(t, NGRP, nsrv, reliable)
+	defer ts.Cleanup()
+
+	ts.Begin(fmt.Sprintf("Test: many clients putting while shards move between %d groups", NGRP))
+
+	done := make(chan struct{})
+	moved := make(chan int)
+	go func() {
+		n := 0
+		defer func() { moved <- n }()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			shard := rand.Intn(NShards)
+			if err := ts.ctrler.MoveShard(shard, Tgid(rand.Intn(NGRP)+1)); err != OK {
+				ts.t.Errorf("MoveShard err %v", err)
+				return
+			}
+			n += 1
+		}
+	}()
+
+	ka := make([]string, NKEY)
+	for i := range ka {
+		ka[i] = "k" + strconv.Itoa(i)
+	}
+	ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		return ts.OneClientPut(me, ck, ka, done)
+	})
+	close(done)
+	if n := <-moved; n == 0 {
+		ts.Fatalf("no shards moved")
+	}
+
+	ts.CheckPorcupineT(PORCUPINETIME)
+}
+
+// The benchmarks call a KVServer's handlers directly, without the
+// network, to compare the striped store with a single lock for every
+// request, and with a memory limit, which also takes the single lock
+// (see store.go). Each goroutine is a clerk with its own keys, and
+// readPct percent of its requests are Gets of keys of any clerk.
+func benchmarkKV(b *testing.B, setup func(kv *KVServer), readPct int) {
+	const NKEY = 100
+
+	kv := MakeKVServer()
+	defer kv.Kill()
+	if setup != nil {
+		setup(kv)
+	}
+
+	for i := 0; i < NKEY; i++ {
+		kv.Put(&PutArgs{Key: "k" + strconv.Itoa(i), Value: "x"}, &PutReply{})
+	}
+
+	var nclnt atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := nclnt.Add(1)
+		prefix := "c" + strconv.FormatInt(id, 10) + "-"
+		versions := make([]Tversion, NKEY)
+		r := rand.New(rand.NewSource(id))
+		seq := uint64(0)
+		for pb.Next() {
+			i := r.Intn(NKEY)
+			if r.Intn(100) < readPct {
+				reply := GetReply{}
+				kv.Get(&GetArgs{Key: "k" + strconv.Itoa(i)}, &reply)
+				continue
+			}
+			seq += 1
+			args := PutArgs{Key: prefix + strconv.Itoa(i), Value: "x", Version: versions[i], ClientId: id, Seq: seq}
+			reply := PutReply{}
+			kv.Put(&args, &reply)
+			if reply.Err != OK {
+				b.Fatalf("Put err %v", reply.Err)
+			}
+			versions[i] += 1
+		}
+	})
+}
+
+func singleLock(kv *KVServer) { kv.singleLock = true }
+
+// a limit the benchmarks never reach
+func memLimit(kv *KVServer) {
+	kv.memLimit = 1 << 30
+	kv.memPolicy = EvictLRU
+	kv.lru = makeLRU()
+}
+
+func BenchmarkGetStriped(b *testing.B)      { benchmarkKV(b, nil, 100) }
+func BenchmarkGetSingleLock(b *testing.B)   { benchmarkKV(b, singleLock, 100) }
+func BenchmarkGetMemLimit(b *testing.B)     { benchmarkKV(b, memLimit, 100) }
+func BenchmarkPutStriped(b *testing.B)      { benchmarkKV(b, nil, 0) }
+func BenchmarkPutSingleLock(b *testing.B)   { benchmarkKV(b, singleLock, 0) }
+func BenchmarkPutMemLimit(b *testing.B)     { benchmarkKV(b, memLimit, 0) }
+func BenchmarkMixedStriped(b *testing.B)    { benchmarkKV(b, nil, 90) }
+func BenchmarkMixedSingleLock(b *testing.B) { benchmarkKV(b, singleLock, 90) }
+func BenchmarkMixedMemLimit(b *testing.B)   { benchmarkKV(b, memLimit, 90) }
+
+func TestEngineMap(t *testing.T) {
+	runEngineConformance(t, MakeMapEngine, false)
+}
+
+func TestEngineBTree(t *testing.T) {
+	runEngineConformance(t, MakeBTreeEngine, true)
+}
+
+func TestEngineLSM(t *testing.T) {
+	runEngineConformance(t, func() Engine {
+		e, err := MakeLSMEngine(t.TempDir(), 4096)
+		if err != nil {
+			t.Fatalf("MakeLSMEngine err %v", err)
+		}
+		t.Cleanup(e.(DurableEngine).Close)
+		return e
+	}, true)
+}
+
+// The conformance suite that every engine must pass: random puts and
+// deletes, checked against a map, and snapshots that later writes
+// don't change. An ordered engine must also iterate in key order,
+// and an OrderedEngine start anywhere. A durable engine commits every
+// write.
+func runEngineConformance(t *testing.T, mk EngineMaker, ordered bool) {
+	const (
+		NOP  = 20000
+		NKEY = 2000
+	)
+
+	e := mk()
+	if _, found := e.Get("k"); found || e.Len() != 0 {
+		t.Fatalf("new engine has keys")
+	}
+	e.Delete("k")
+
+	commit := func() {}
+	if d, ok := e.(DurableEngine); ok {
+		commit = d.Commit
+	}
+	check := func(e Engine, model map[Key]Value) {
+		checkEngine(t, e, model, ordered)
+	}
+
+	model := make(map[Key]Value)
+	r := rand.New(rand.NewSource(1))
+	var snap Engine
+	var snapModel map[Key]Value
+	for i := 0; i < NOP; i++ {
+		key := Key(fmt.Sprintf("k%05d", r.Intn(NKEY)))
+		if r.Intn(3) == 0 {
+			e.Delete(key)
+			delete(model, key)
+		} else {
+			value := Value{value: strconv.Itoa(i), version: model[key].version + 1}
+			if r.Intn(4) == 0 {
+				value.expires = time.Unix(0, int64(i))
+			}
+			e.Put(key, value)
+			model[key] = value
+		}
+		commit()
+		if i == NOP/2 {
+			check(e, model)
+			snap = e.Snapshot()
+			snapModel = make(map[Key]Value, len(model))
+			for key, value := range model {
+				snapModel[key] = value
+			}
+		}
+	}
+	check(e, model)
+	check(snap, snapModel)
+
+	n := 0
+	e.Iterate(func(Key, Value) bool {
+		n += 1
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Iterate went on after fn returned false")
+	}
+
+	for key := range model {
+		e.Delete(key)
+		commit()
+	}
+	check(e, map[Key]Value{})
+	check(snap, snapModel)
+}
+
+func checkEngine(t *testing.T, e Engine, model map[Key]Value, ordered bool) {
+	if e.Len() != len(model) {
+		t.Fatalf("Len %v; expected %v", e.Len(), len(model))
+	}
+	for key, value := range model {
+		if v, found := e.Get(key); !found || v != value {
+			t.Fatalf("Get %v = (%v, %v); expected %v", key, v, found, value)
+		}
+	}
+	n := 0
+	prev := Key("")
+	e.Iterate(func(key Key, value Value) bool {
+		if model[key] != value {
+			t.Fatalf("Iterate %v = %v; expected %v", key, value, model[key])
+		}
+		if ordered && n > 0 && key <= prev {
+			t.Fatalf("Iterate %v after %v", key, prev)
+		}
+		prev = key
+		n += 1
+		return true
+	})
+	if n != len(model) {
+		t.Fatalf("Iterate visited %v keys; expected %v", n, len(model))
+	}
+
+	o, ok := e.(OrderedEngine)
+	if !ok {
+		return
+	}
+	for _, start := range []Key{"", "k", "k01000", "k01000\x00", "l"} {
+		n, expected := 0, 0
+		for key := range model {
+			if key >= start {
+				expected += 1
+			}
+		}
+		o.Ascend(start, func(key Key, value Value) bool {
+			if key < start || model[key] != value {
+				t.Fatalf("Ascend from %q: %v = %v", start, key, value)
+			}
+			n += 1
+			return true
+		})
+		if n != expected {
+			t.Fatalf("Ascend from %q visited %v keys; expected %v", start, n, expected)
+		}
+	}
+}
+
+// Test that an LSM engine that dies in the middle of a flush comes
+// back with every committed key and none of the uncommitted ones, and
+// goes on flushing and compacting afterwards
+func TestLSMCrashMidFlush(t *testing.T) {
+	const NKEY = 500
+
+	dir := t.TempDir()
+	open := func() *lsmEngine {
+		e, err := MakeLSMEngine(dir, 4096)
+		if err != nil {
+			t.Fatalf("MakeLSMEngine err %v", err)
+		}
+		return e.(*lsmEngine)
+	}
+
+	e := open()
+	e.killFlushAt = 10
+	model := make(map[Key]Value)
+	for i := 0; i < NKEY; i++ {
+		key := Key(fmt.Sprintf("k%04d", i))
+		model[key] = Value{value: strconv.Itoa(i), version: 1}
+		e.Put(key, model[key])
+		e.Commit()
+	}
+	select {
+	case <-e.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush didn't die")
+	}
+	partial := filepath.Join(dir, "table-0")
+	if _, err := os.Stat(partial); err != nil {
+		t.Fatalf("no partial table: %v", err)
+	}
+	e.Put("uncommitted", Value{value: "x", version: 1})
+	e.Close()
+
+	e = open()
+	if _, err := os.Stat(partial); err == nil {
+		t.Fatalf("partial table survived")
+	}
+	checkEngine(t, e, model, true)
+
+	// enough writes for several flushes and a compaction
+	for round := 0; round < 4; round++ {
+		for i := 0; i < NKEY; i++ {
+			key := Key(fmt.Sprintf("k%04d", i))
+			if i%3 == round%3 {
+				e.Delete(key)
+				delete(model, key)
+			} else {
+				model[key] = Value{value: strconv.Itoa(round), version: model[key].version + 1}
+				e.Put(key, model[key])
+			}
+			e.Commit()
+		}
+	}
+	// the worker may not have run yet on a busy machine
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		e.mu.RLock()
+		flushed := len(e.tables) > 0 && e.imm == nil
+		e.mu.RUnlock()
+		if flushed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing was flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.Sync()
+	e.Close()
+
+	e = open()
+	defer e.Close()
+	checkEngine(t, e, model, true)
+}
+
+// Test that an LSM engine whose flushes fail tries again, and then
+// flushes as if nothing happened.
+func TestLSMFlushRetry(t *testing.T) {
+	const NKEY = 500
+
+	e0, err := MakeLSMEngine(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("MakeLSMEngine err %v", err)
+	}
+	e := e0.(*lsmEngine)
+	defer e.Close()
+	e.failFlushes = 3
+
+	model := make(map[Key]Value)
+	for i := 0; i < NKEY; i++ {
+		key := Key(fmt.Sprintf("k%04d", i))
+		model[key] = Value{value: strconv.Itoa(i), version: 1}
+		e.Put(key, model[key])
+		e.Commit()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		e.mu.RLock()
+		flushed := len(e.tables) > 0 && e.imm == nil
+		e.mu.RUnlock()
+		if flushed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing was flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkEngine(t, e, model, true)
+}
+
+// Test that a KVServer with LSM engines whose flushes die part way,
+// as if the server crashed, gets all its keys back when it restarts,
+// and scans them in order from the engines.
+func TestRestartLSMMidFlush(t *testing.T) {
+	const NKEY = 1000
+
+	dir := t.TempDir()
+	var engines []*lsmEngine // of the first start
+	mks := func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		mk := MakeLSMEngines(dir, 256)
+		first := engines == nil
+		kv := MakeKVServerEngine(func() Engine {
+			e := mk().(*lsmEngine)
+			if first {
+				e.killFlushAt = 2
+				engines = append(engines, e)
+			}
+			return e
+		})
+		return startKVServer(kv, ends, srv, persister)
+	}
+
+	ts := makeTestKV(t, 1, true, mks)
+	defer ts.Cleanup()
+
+	ts.Begin("Restart an LSM server in the middle of a flush")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(fmt.Sprintf("k%04d", i), strconv.Itoa(i), 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		died := false
+		for _, e := range engines {
+			select {
+			case <-e.done:
+				died = true
+			default:
+			}
+		}
+		if died {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no flush died")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.Restart()
+
+	for i := 0; i < NKEY; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		if val, ver, err := ck.Get(key); err != OK || val != strconv.Itoa(i) || ver != 1 {
+			t.Fatalf("Get %v (%v, %v, %v); expected (%v, 1, OK)", key, val, ver, err, i)
+		}
+	}
+	token := ""
+	for i := 0; i < NKEY; {
+		entries, next, err := ck.Scan("", "", 100, token)
+		if err != OK || len(entries) == 0 {
+			t.Fatalf("Scan err %v, %v entries, after %v keys", err, len(entries), i)
+		}
+		for _, e := range entries {
+			if expected := fmt.Sprintf("k%04d", i); e.Key != expected {
+				t.Fatalf("Scan entry %v; expected %v", e.Key, expected)
+			}
+			i += 1
+		}
+		token = next
+	}
+}
+
+// Test Scans of a KVServer with LSM engines while Puts keep the
+// engines flushing, since a Scan walks the engines under their locks
+func TestScanLSMFlushing(t *testing.T) {
+	const (
+		NCLNT = 4
+		NSEC  = 2
+	)
+
+	ts := makeTestKV(t, 1, true, StartKVServerEngine(MakeLSMEngines(t.TempDir(), 256)))
+	defer ts.Cleanup()
+
+	ts.Begin("Scan while LSM engines flush")
+
+	done := make(chan struct{})
+	stopped := make(chan bool)
+	for c := 0; c < NCLNT; c++ {
+		go func(c int) {
+			defer func() { stopped <- true }()
+			ck := ts.MakeClerk()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := ck.Put(fmt.Sprintf("k%d-%06d", c, i), strconv.Itoa(i), 0); err != OK {
+					t.Errorf("Put err %v", err)
+					return
+				}
+			}
+		}(c)
+	}
+
+	ck := ts.MakeClerk()
+	for start := time.Now(); time.Since(start) < NSEC*time.Second; {
+		scanned := make(chan Err)
+		go func() {
+			token := ""
+			for {
+				entries, next, err := ck.Scan("", "", MaxScanLimit, token)
+				if err != OK || next == "" || len(entries) == 0 {
+					scanned <- err
+					return
+				}
+				token = next
+			}
+		}()
+		select {
+		case err := <-scanned:
+			if err != OK {
+				t.Fatalf("Scan err %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Scan didn't return")
+		}
+	}
+	close(done)
+	for c := 0; c < NCLNT; c++ {
+		<-stopped
+	}
+}
+
+// Test a KVServer that keeps its keys in B-trees, across restarts
+func TestEngineBTreeKVServer(t *testing.T) {
+	const NKEY = 200
+
+	ts := makeTestKV(t, 1, true, StartKVServerEngine(MakeBTreeEngine))
+	defer ts.Cleanup()
+
+	ts.Begin("One client and a B-tree engine")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(fmt.Sprintf("k%03d", i), strconv.Itoa(i), 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for i := 0; i < NKEY; i += 2 {
+		if err := ck.Delete(fmt.Sprintf("k%03d", i), 1); err != OK {
+			t.Fatalf("Delete err %v", err)
+		}
+	}
+	ts.Restart()
+
+	entries, _, err := ck.Scan("", "", NKEY, "")
+	if err != OK || len(entries) != NKEY/2 {
+		t.Fatalf("Scan err %v, %v entries; expected %v", err, len(entries), NKEY/2)
+	}
+	for i, e := range entries {
+		if expected := fmt.Sprintf("k%03d", 2*i+1); e.Key != expected || e.Value != strconv.Itoa(2*i+1) || e.Version != 1 {
+			t.Fatalf("Scan entry %v; expected %v", e, expected)
+		}
+	}
+	if err := ck.Put("k001", "x", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if val, ver, err := ck.Get("k001"); err != OK || val != "x" || ver != 2 {
+		t.Fatalf("Get (%v, %v, %v); expected (x, 2, OK)", val, ver, err)
+	}
+}
+
+func stats(t *testing.T, ck IKVClerk) StatsReply {
+	args := StatsArgs{}
+	reply := StatsReply{}
+	if ok := ck.(*TestClerk).Clnt.Call(ServerName(GRP0, 0), "KVServer.Stats", &args, &reply); !ok || reply.Err != OK {
+		t.Fatalf("Stats ok %v err %v", ok, reply.Err)
+	}
+	return reply
+}
+
+func TestMemLimitEvictLRU(t *testing.T) {
+	const (
+		NKEY  = 20
+		LIMIT = 10 * 100
+	)
+
+	ts := makeTestKV(t, 1, true, StartKVServerMemLimit(LIMIT, EvictLRU))
+	defer ts.Cleanup()
+
+	ts.Begin("Evict the least recently used keys")
+
+	ck := ts.MakeClerk()
+	v := strings.Repeat("x", 100-3)
+	for i := 0; i < NKEY/2; i++ {
+		if err := ck.Put(fmt.Sprintf("k%02d", i), v, 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if s := stats(t, ck); s.Keys != NKEY/2 || s.Bytes != LIMIT || s.Evictions != 0 {
+		t.Fatalf("Stats %+v; expected %v keys, %v bytes", s, NKEY/2, LIMIT)
+	}
+
+	// use the odd keys, so that the even ones go first
+	for i := 1; i < NKEY/2; i += 2 {
+		if _, _, err := ck.Get(fmt.Sprintf("k%02d", i)); err != OK {
+			t.Fatalf("Get err %v", err)
+		}
+	}
+	for i := NKEY / 2; i < NKEY/2+NKEY/4; i++ {
+		if err := ck.Put(fmt.Sprintf("k%02d", i), v, 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for i := 0; i < NKEY/2+NKEY/4; i++ {
+		_, _, err := ck.Get(fmt.Sprintf("k%02d", i))
+		if evicted := i < NKEY/2 && i%2 == 0; evicted && err != ErrNoKey || !evicted && err != OK {
+			t.Fatalf("Get k%02d err %v; evicted %v", i, err, evicted)
+		}
+	}
+	s := stats(t, ck)
+	if s.Keys != NKEY/2 || s.Bytes != LIMIT || s.Limit != LIMIT || s.Evictions != NKEY/4 {
+		t.Fatalf("Stats %+v; expected %v keys, %v bytes, %v evictions", s, NKEY/2, LIMIT, NKEY/4)
+	}
+
+	if err := ck.Put("big", strings.Repeat("x", LIMIT), 0); err != ErrFull {
+		t.Fatalf("Put of a key over the limit err %v; expected ErrFull", err)
+	}
+	ts.Restart()
+	if s1 := stats(t, ck); s1.Keys != s.Keys || s1.Bytes != s.Bytes {
+		t.Fatalf("Stats after restart %+v; expected %+v", s1, s)
+	}
+}
+
+func TestMemLimitRejectWhenFull(t *testing.T) {
+	const LIMIT = 1000
+
+	ts := makeTestKV(t, 1, true, StartKVServerMemLimit(LIMIT, RejectWhenFull))
+	defer ts.Cleanup()
+
+	ts.Begin("Reject writes once full")
+
+	ck := ts.MakeClerk()
+	v := strings.Repeat("x", 100-1)
+	for i := 0; i < LIMIT/100; i++ {
+		if err := ck.Put(strconv.Itoa(i), v, 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if err := ck.Put("a", v, 0); err != ErrFull {
+		t.Fatalf("Put err %v; expected ErrFull", err)
+	}
+	// a smaller value frees space, but not enough
+	if err := ck.Put("0", "y", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.Put("a", v, 0); err != ErrFull {
+		t.Fatalf("Put err %v; expected ErrFull", err)
+	}
+	if err := ck.Delete("1", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	if err := ck.Put("a", v, 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	s := stats(t, ck)
+	if expected := int64(LIMIT - 100 + 2); s.Keys != LIMIT/100 || s.Bytes != expected || s.Evictions != 0 {
+		t.Fatalf("Stats %+v; expected %v keys, %v bytes", s, LIMIT/100, expected)
+	}
+}
+
+// serverGoroutines returns the stacks of the goroutines that run
+// KVServer, Raft, or LSM engine code.
+func serverGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var found []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "(*KVServer)") || strings.Contains(g, "(*Raft)") || strings.Contains(g, "(*lsmEngine)") {
+			found = append(found, g)
+		}
+	}
+	return found
+}
+
+func runKillLeaks(t *testing.T, nsrv int, mks FstartServer, part string) {
+	ts := makeTestKV(t, nsrv, true, mks)
+
+	ts.Begin(part)
+
+	ck := ts.MakeClerk()
+	if err := ck.Put("k", "0", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.PutTTL("ttl", "0", 0, time.Minute); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	// Watches that are still waiting when the servers are killed
+	done := make(chan bool)
+	for i := 0; i < nsrv; i++ {
+		go func() {
+			args := WatchArgs{Key: "k", Version: 1, Timeout: MaxWatchTimeout}
+			reply := GetReply{}
+			done <- ck.(*TestClerk).Clnt.Call(ServerName(GRP0, i), "KVServer.Watch", &args, &reply)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ts.Cleanup()
+	for i := 0; i < nsrv; i++ {
+		<-done
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		found := serverGoroutines()
+		if len(found) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines survived Cleanup:\n%v", len(found), found[0])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestKillLeaks(t *testing.T) {
+	runKillLeaks(t, 1, StartKVServerLSM(t.TempDir(), 256), "Kill a server with an LSM engine")
+	runKillLeaks(t, 3, StartPBKVServer, "Kill a primary-backup group")
+	runKillLeaks(t, 3, StartKVServer, "Kill a Raft group")
+}
+
+func TestKillRejects(t *testing.T) {
+	kv := MakeKVServer()
+	put := PutReply{}
+	kv.Put(&PutArgs{Key: "k", Value: "0", ClientId: 1, Seq: 1}, &put)
+	if put.Err != OK {
+		t.Fatalf("Put err %v", put.Err)
+	}
+	kv.Kill()
+	kv.Kill()
+
+	get := GetReply{}
+	kv.Get(&GetArgs{Key: "k"}, &get)
+	if get.Err != ErrWrongLeader {
+		t.Fatalf("Get after Kill err %v; expected ErrWrongLeader", get.Err)
+	}
+	put = PutReply{}
+	kv.Put(&PutArgs{Key: "k", Value: "1", Version: 1, ClientId: 1, Seq: 2}, &put)
+	if put.Err != ErrWrongLeader {
+		t.Fatalf("Put after Kill err %v; expected ErrWrongLeader", put.Err)
+	}
+}
+
+func TestHistoryVersions(t *testing.T) {
+	const NVERSION = 3
+
+	ts := makeTestKV(t, 1, true, StartKVServerHistory(HistoryPolicy{Versions: NVERSION}))
+	defer ts.Cleanup()
+
+	ts.Begin("Get past versions")
+
+	ck := ts.MakeClerk()
+	clerk := ck.(*TestClerk).IKVClerk.(*Clerk)
+	for ver := Tversion(0); ver < 6; ver++ {
+		if err := ck.Put("k", fmt.Sprintf("v%d", ver+1), ver); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	check := func() {
+		for ver := Tversion(1); ver <= 7; ver++ {
+			val, ver1, err := clerk.GetAt("k", ver)
+			switch {
+			case ver > 6:
+				if err != ErrVersion {
+					t.Fatalf("GetAt %v err %v; expected ErrVersion", ver, err)
+				}
+			case ver < 6-NVERSION:
+				if err != ErrCompacted {
+					t.Fatalf("GetAt %v err %v; expected ErrCompacted", ver, err)
+				}
+			default:
+				if err != OK || val != fmt.Sprintf("v%d", ver) || ver1 != ver {
+					t.Fatalf("GetAt %v (%v, %v, %v)", ver, val, ver1, err)
+				}
+			}
+		}
+	}
+	check()
+	ts.Restart()
+	check()
+
+	if err := ck.Delete("k", 6); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	if _, _, err := clerk.GetAt("k", 5); err != ErrNoKey {
+		t.Fatalf("GetAt of a deleted key err %v; expected ErrNoKey", err)
+	}
+	if err := ck.Put("k", "new", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.Put("k", "new2", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if val, _, err := clerk.GetAt("k", 1); err != OK || val != "new" {
+		t.Fatalf("GetAt 1 of a new key (%v, %v); expected new", val, err)
+	}
+}
+
+func TestHistoryAge(t *testing.T) {
+	const AGE = 500 * time.Millisecond
+
+	ts := makeTestKV(t, 1, true, StartKVServerHistory(HistoryPolicy{Age: AGE}))
+	defer ts.Cleanup()
+
+	ts.Begin("Past versions expire")
+
+	ck := ts.MakeClerk()
+	clerk := ck.(*TestClerk).IKVClerk.(*Clerk)
+	for ver := Tversion(0); ver < 3; ver++ {
+		if err := ck.Put("k", strconv.Itoa(int(ver)+1), ver); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for ver := Tversion(1); ver <= 3; ver++ {
+		if val, _, err := clerk.GetAt("k", ver); err != OK || val != strconv.Itoa(int(ver)) {
+			t.Fatalf("GetAt %v (%v, %v)", ver, val, err)
+		}
+	}
+	time.Sleep(AGE + ReapInterval)
+	for ver := Tversion(1); ver < 3; ver++ {
+		if _, _, err := clerk.GetAt("k", ver); err != ErrCompacted {
+			t.Fatalf("GetAt %v err %v; expected ErrCompacted", ver, err)
+		}
+	}
+	if val, _, err := clerk.GetAt("k", 3); err != OK || val != "3" {
+		t.Fatalf("GetAt of the current version (%v, %v)", val, err)
+	}
+}
+
+func runKeyMeta(t *testing.T, mks FstartServer, part string) {
+	ts := makeTestKV(t, 1, true, mks)
+	defer ts.Cleanup()
+
+	ts.Begin(part)
+
+	ck1 := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	ck2 := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+
+	start := time.Now()
+	if err := ck1.Put("lock", "held", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	meta1, ver, err := ck1.GetMeta("lock")
+	if err != OK || ver != 1 || meta1.Writer != ck1.clientId || meta1.Created != meta1.Modified ||
+		meta1.Created < start.UnixNano() || meta1.Created > time.Now().UnixNano() {
+		t.Fatalf("GetMeta (%+v, %v, %v) after the first Put", meta1, ver, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := ck2.Put("lock", "taken", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	meta2, ver, err := ck1.GetMeta("lock")
+	if err != OK || ver != 2 || meta2.Writer != ck2.clientId || meta2.Created != meta1.Created ||
+		meta2.Modified <= meta1.Modified {
+		t.Fatalf("GetMeta (%+v, %v, %v) after the second Put; first %+v", meta2, ver, err, meta1)
+	}
+
+	ts.Restart()
+	meta3, _, err := ck1.GetMeta("lock")
+	if err != OK || meta3 != meta2 {
+		t.Fatalf("GetMeta (%+v, %v) after restart; expected %+v", meta3, err, meta2)
+	}
+
+	if _, _, err := ck1.GetMeta("none"); err != ErrNoKey {
+		t.Fatalf("GetMeta of a missing key err %v; expected ErrNoKey", err)
+	}
+}
+
+func TestKeyMeta(t *testing.T) {
+	runKeyMeta(t, StartKVServer, "Key metadata")
+}
+
+func TestKeyMetaLSM(t *testing.T) {
+	runKeyMeta(t, StartKVServerLSM(t.TempDir(), 0), "Key metadata with an LSM engine")
+}
+
+func TestStats(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Server statistics")
+
+	ck := ts.MakeClerk()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := ck.Put(k, k+k, 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for k, n := range map[string]int{"a": 5, "b": 3, "c": 1} {
+		for i := 0; i < n; i++ {
+			if _, _, err := ck.Get(k); err != OK {
+				t.Fatalf("Get err %v", err)
+			}
+		}
+	}
+	if _, _, err := ck.Get("none"); err != ErrNoKey {
+		t.Fatalf("Get err %v", err)
+	}
+	if err := ck.Put("a", "x", 5); err != ErrVersion {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.Delete("c", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	if _, err := ck.(*TestClerk).IKVClerk.(*Clerk).MultiPut([]PutOp{{"b", "bb", 1}}); err != OK {
+		t.Fatalf("MultiPut err %v", err)
+	}
+	if _, _, err := ck.Watch("b", 0, time.Second); err != OK {
+		t.Fatalf("Watch err %v", err)
+	}
+
+	// neither another namespace's keys nor expired ones count
+	if err := ts.MakeClerkInNamespace("n").Put("d", "dddd", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.PutTTL("e", "ee", 0, time.Millisecond); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	stats := ck.(*TestClerk).IKVClerk.(*Clerk).Stats(2)
+	s, ok := stats[ServerName(GRP0, 0)]
+	if !ok || len(stats) != 1 {
+		t.Fatalf("Stats %v", stats)
+	}
+	if s.Keys != 2 || s.ValueBytes != 4 || s.Bytes != 6 {
+		t.Fatalf("Stats %+v; expected 2 keys with 4 value bytes", s)
+	}
+	if s.Gets[OK] != 9 || s.Gets[ErrNoKey] != 1 || s.Puts[OK] != 5 || s.Puts[ErrVersion] != 1 || s.Deletes[OK] != 1 ||
+		s.MultiPuts[OK] != 1 || s.Watches[OK] != 1 {
+		t.Fatalf("Stats gets %v puts %v deletes %v multiputs %v watches %v", s.Gets, s.Puts, s.Deletes, s.MultiPuts, s.Watches)
+	}
+	expected := []KeyCount{{"a", 7}, {"b", 6}}
+	if !reflect.DeepEqual(s.Hot, expected) {
+		t.Fatalf("Hot %v; expected %v", s.Hot, expected)
+	}
+}
+
+// Test that Stats reports the hot keys of the clerk's namespace that
+// it may read, counting the same key in two namespaces apart
+func TestStatsHotKeysVisible(t *testing.T) {
+	acl := ACL{
+		Secrets: map[string]string{"alice": "a"},
+		Rules:   []ACLRule{{Prefix: "team-a/", Principal: "alice", Perm: PermReadWrite}},
+	}
+	ts := makeTestKV(t, 1, true, StartKVServerACL(acl))
+	defer ts.Cleanup()
+
+	ts.Begin("Hot keys a clerk may see")
+
+	alice := ts.MakeClerkWithCredential(Credential{Principal: "alice", Secret: "a"})
+	anon := ts.MakeClerk()
+	n := ts.MakeClerkInNamespace("n")
+	for ck, key := range map[IKVClerk]string{alice: "team-a/x", anon: "open", n: "open"} {
+		if err := ck.Put(key, "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		alice.Get("team-a/x")
+		n.Get("open")
+	}
+	anon.Get("open")
+
+	for _, c := range []struct {
+		ck       IKVClerk
+		expected []KeyCount
+	}{
+		{anon, []KeyCount{{"open", 2}}},
+		{alice, []KeyCount{{"team-a/x", 4}, {"open", 2}}},
+		{n, []KeyCount{{"open", 4}}},
+	} {
+		stats := c.ck.(*TestClerk).IKVClerk.(*Clerk).Stats(10)
+		if s := stats[ServerName(GRP0, 0)]; !reflect.DeepEqual(s.Hot, c.expected) {
+			t.Fatalf("Hot %v; expected %v", s.Hot, c.expected)
+		}
+	}
+}
+
+// Test that a hot key stays among the hot keys when many more keys
+// than the server tracks come along
+func TestStatsHotKeysBounded(t *testing.T) {
+	st := makeServerStats()
+	ok := Err(OK)
+	for i := 0; i < 10; i++ {
+		st.count(opGet, &ok, "hot")
+	}
+	for i := 0; i < 3*HotKeysTracked; i++ {
+		st.count(opGet, &ok, strconv.Itoa(i))
+	}
+	if n := st.tracked(); n > HotKeysTracked {
+		t.Fatalf("tracking %v keys; at most %v", n, HotKeysTracked)
+	}
+	all := func(key Key) (string, bool) { return string(key), true }
+	if hot := st.hot(1, all); len(hot) != 1 || hot[0].Key != "hot" {
+		t.Fatalf("hot %v; expected hot", hot)
+	}
+}
+
+func checkChange(t *testing.T, cs *ChangeStream, expected Change) {
+	c, err := cs.Next(5 * time.Second)
+	if err != OK || c != expected {
+		t.Fatalf("Next (%+v, %v); expected %+v", c, err, expected)
+	}
+}
+
+func TestChangesReliable(t *testing.T) {
+	const NKEY = 10
+
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Follow changes")
+
+	ck := ts.MakeClerk()
+	cs := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).Subscribe(0)
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(strconv.Itoa(i), "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if err := ck.Put("0", "y", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ck.Delete("1", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	if err := ck.Put("0", "z", 1); err != ErrVersion {
+		t.Fatalf("Put err %v", err)
+	}
+	for i := 0; i < NKEY; i++ {
+		checkChange(t, cs, Change{Seq: uint64(i + 1), Key: strconv.Itoa(i), Value: "x", Version: 1})
+	}
+	checkChange(t, cs, Change{Seq: NKEY + 1, Key: "0", Value: "y", Version: 2})
+	checkChange(t, cs, Change{Seq: NKEY + 2, Key: "1", Deleted: true})
+	if c, err := cs.Next(100 * time.Millisecond); err != ErrNoKey {
+		t.Fatalf("Next (%+v, %v) with no change; expected ErrNoKey", c, err)
+	}
+
+	// the changes and their numbers survive a restart
+	ts.Restart()
+	if err := ck.Put("a", "x", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	checkChange(t, cs, Change{Seq: NKEY + 3, Key: "a", Value: "x", Version: 1})
+	cs = ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).Subscribe(NKEY)
+	checkChange(t, cs, Change{Seq: NKEY + 1, Key: "0", Value: "y", Version: 2})
+}
+
+func TestChangesCompacted(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Changes no longer kept")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < 2*ChangeLogSize; i++ {
+		if err := ck.Put(strconv.Itoa(i), "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	clerk := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	if _, err := clerk.Subscribe(0).Next(time.Second); err != ErrCompacted {
+		t.Fatalf("Next err %v; expected ErrCompacted", err)
+	}
+	cs := clerk.Subscribe(ChangeLogSize)
+	checkChange(t, cs, Change{Seq: ChangeLogSize + 1, Key: strconv.Itoa(ChangeLogSize), Value: "x", Version: 1})
+
+	// a stream ahead of the log waits for the log to catch up
+	cs = clerk.Subscribe(2*ChangeLogSize + 1)
+	if c, err := cs.Next(100 * time.Millisecond); err != ErrNoKey {
+		t.Fatalf("Next (%+v, %v) ahead of the log; expected ErrNoKey", c, err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := ck.Put(k, "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	checkChange(t, cs, Change{Seq: 2*ChangeLogSize + 2, Key: "b", Value: "x", Version: 1})
+}
+
+// Follow the changes of a Raft group over an unreliable network, while
+// a clerk writes
+func TestChangesUnreliable(t *testing.T) {
+	const (
+		NKEY = 5
+		NPUT = 50
+	)
+
+	ts := makeTestKV(t, 3, false, StartKVServer)
+	defer ts.Cleanup()
+
+	ts.Begin("Follow changes while the network drops messages")
+
+	done := make(chan []Change)
+	go func() {
+		cs := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).Subscribe(0)
+		changes := []Change{}
+		for len(changes) < NPUT {
+			c, err := cs.Next(30 * time.Second)
+			if err != OK {
+				break
+			}
+			changes = append(changes, c)
+		}
+		done <- changes
+	}()
+
+	ck := ts.MakeClerk()
+	versions := make([]Tversion, NKEY)
+	for i := 0; i < NPUT; i++ {
+		k := i % NKEY
+		if err := ck.Put(strconv.Itoa(k), strconv.Itoa(i), versions[k]); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+		versions[k] += 1
+	}
+
+	changes := <-done
+	if len(changes) != NPUT {
+		t.Fatalf("%v changes; expected %v", len(changes), NPUT)
+	}
+	for i, c := range changes {
+		expected := Change{Seq: uint64(i + 1), Key: strconv.Itoa(i % NKEY), Value: strconv.Itoa(i), Version: Tversion(i/NKEY + 1)}
+		if c != expected {
+			t.Fatalf("change %+v; expected %+v", c, expected)
+		}
+	}
+}
+
+// A key that expires is removed through the log or the backups, so
+// every server of the group sees the removal as a change
+func TestChangesExpire(t *testing.T) {
+	runChangesExpire(t, StartKVServer, "Expire a key in a Raft group")
+	runChangesExpire(t, StartPBKVServer, "Expire a key in a primary-backup group")
+}
+
+func runChangesExpire(t *testing.T, mks FstartServer, part string) {
+	const (
+		NSRV = 3
+		TTL  = 200 * time.Millisecond
+	)
+
+	ts := makeTestKV(t, NSRV, true, mks)
+	defer ts.Cleanup()
+
+	ts.Begin(part)
+
+	ck := ts.MakeClerk()
+	if err := ck.PutTTL("k", "x", 0, TTL); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+	cs := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).Subscribe(0)
+	checkChange(t, cs, Change{Seq: 1, Key: "k", Value: "x", Version: 1})
+	checkChange(t, cs, Change{Seq: 2, Key: "k", Deleted: true})
+
+	// whichever server serves next has removed k too
+	grp := ts.Group(GRP0)
+	for i := 0; i < NSRV; i++ {
+		grp.ShutdownServer(i)
+		// a new Raft leader may not have applied the Expire yet,
+		// and waits for it
+		cs := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).Subscribe(1)
+		checkChange(t, cs, Change{Seq: 2, Key: "k", Deleted: true})
+		if _, _, err := ck.Get("k"); err != ErrNoKey {
+			t.Fatalf("Get err %v; expected ErrNoKey", err)
+		}
+		grp.StartServer(i)
+		grp.ConnectOne(i)
+	}
+	if err := ck.Put("k", "y", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if val, ver, err := ck.Get("k"); err != OK || val != "y" || ver != 1 {
+		t.Fatalf("Get (%v, %v, %v); expected (y, 1, OK)", val, ver, err)
+	}
+}
+
+func runDumpRestore(t *testing.T, nsrv int, format DumpFormat, part string) {
+	const NKEY = MaxDumpEntries + 10
+
+	ts := makeTestKV(t, nsrv, true, StartKVServer)
+	defer ts.Cleanup()
+
+	ts.Begin(part)
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(strconv.Itoa(i), "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if err := ck.Put("0", "y", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	// a writer puts a and then b, so a consistent dump has a's version
+	// equal to b's or one ahead
+	done := make(chan struct{})
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ck := ts.MakeClerk()
+		for i := Tversion(0); ; i++ {
+			ck.Put("a", strconv.Itoa(int(i)), i)
+			ck.Put("b", strconv.Itoa(int(i)), i)
+			if i == 0 {
+				close(started)
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	time.Sleep(100 * time.Millisecond)
+
+	var buf strings.Builder
+	clerk := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	if err := clerk.Dump(&buf, format); err != nil {
+		t.Fatalf("Dump err %v", err)
+	}
+	close(done)
+	<-stopped
+
+	entries, err := readDump(strings.NewReader(buf.String()), format)
+	if err != nil {
+		t.Fatalf("readDump err %v", err)
+	}
+	versions := make(map[string]Tversion)
+	for _, e := range entries {
+		versions[e.Key] = e.Version
+	}
+	if len(versions) != NKEY+2 {
+		t.Fatalf("dump has %v keys; expected %v", len(versions), NKEY+2)
+	}
+	if versions["a"] != versions["b"] && versions["a"] != versions["b"]+1 {
+		t.Fatalf("dump has a at version %v and b at %v", versions["a"], versions["b"])
+	}
+
+	// restore into a fresh deployment
+	ts1 := makeTestKV(t, nsrv, true, StartKVServer)
+	defer ts1.Cleanup()
+
+	ts1.Begin("Restore into a fresh deployment")
+
+	// keys of other namespaces, and keys that have expired, don't
+	// keep a restore out
+	if err := ts1.MakeClerkInNamespace("n").Put("0", "x", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := ts1.MakeClerk().PutTTL("expired", "x", 0, time.Millisecond); err != OK {
+		t.Fatalf("PutTTL err %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	clerk1 := ts1.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	if err := clerk1.Restore(strings.NewReader(buf.String()), format); err != nil {
+		t.Fatalf("Restore err %v", err)
+	}
+	ck1 := ts1.MakeClerk()
+	for _, e := range entries {
+		if v, ver, err := ck1.Get(e.Key); err != OK || v != e.Value || ver != e.Version {
+			t.Fatalf("Get(%v) = (%v, %v, %v); expected (%v, %v, OK)", e.Key, v, ver, err, e.Value, e.Version)
+		}
+	}
+	if err := ck1.Put("0", "z", 2); err != OK {
+		t.Fatalf("Put at restored version err %v", err)
+	}
+	if err := ck1.Put("1", "z", 0); err != ErrVersion {
+		t.Fatalf("Put at version 0 of restored key err %v; expected ErrVersion", err)
+	}
+
+	// the servers hold keys now
+	if err := clerk1.Restore(strings.NewReader(buf.String()), format); err == nil || !strings.Contains(err.Error(), ErrNotEmpty) {
+		t.Fatalf("Restore into a server with keys err %v; expected %v", err, ErrNotEmpty)
+	}
+}
+
+func TestDumpRestoreJSON(t *testing.T) {
+	runDumpRestore(t, 1, DumpJSONLines, "Dump and restore as JSON lines")
+}
+
+func TestDumpRestoreLabgob(t *testing.T) {
+	runDumpRestore(t, 1, DumpLabgob, "Dump and restore as labgob")
+}
+
+func TestDumpRestoreRaft(t *testing.T) {
+	runDumpRestore(t, 3, DumpJSONLines, "Dump and restore a Raft group")
+}
+
+// Test that a dump of a sharded deployment holds the keys of every
+// group, and that Restore sends each key to the group that serves it
+func TestDumpRestoreSharded(t *testing.T) {
+	const (
+		NGRP = 3
+		NKEY = MaxDumpEntries + 10
+	)
+
+	ts := MakeTestShardKV(t, NGRP, 1, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Dump and restore a sharded deployment")
+
+	ck := ts.MakeClerk()
+	for i := 0; i < NKEY; i++ {
+		if err := ck.Put(strconv.Itoa(i), "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	var buf strings.Builder
+	if err := ck.(*TestClerk).IKVClerk.(*Clerk).Dump(&buf, DumpJSONLines); err != nil {
+		t.Fatalf("Dump err %v", err)
+	}
+	entries, err := readDump(strings.NewReader(buf.String()), DumpJSONLines)
+	if err != nil || len(entries) != NKEY {
+		t.Fatalf("readDump = (%v entries, %v); expected %v entries", len(entries), err, NKEY)
+	}
+
+	ts1 := MakeTestShardKV(t, NGRP, 1, true)
+	defer ts1.Cleanup()
+
+	ts1.Begin("Restore into a fresh sharded deployment")
+
+	ck1 := ts1.MakeClerk()
+	if err := ck1.(*TestClerk).IKVClerk.(*Clerk).Restore(strings.NewReader(buf.String()), DumpJSONLines); err != nil {
+		t.Fatalf("Restore err %v", err)
+	}
+	for i := 0; i < NKEY; i++ {
+		if v, ver, err := ck1.Get(strconv.Itoa(i)); err != OK || v != "x" || ver != 1 {
+			t.Fatalf("Get(%v) = (%v, %v, %v); expected (x, 1, OK)", i, v, ver, err)
+		}
+	}
+}
+
+// Test that Restore rejects a dump that holds a key twice
+func TestRestoreDuplicateKey(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Restore a key twice")
+
+	dump := `{"key":"k","value":"x","version":1}
+{"key":"k","value":"y","version":2}
+`
+	ck := ts.MakeClerk()
+	err := ck.(*TestClerk).IKVClerk.(*Clerk).Restore(strings.NewReader(dump), DumpJSONLines)
+	if err == nil || !strings.Contains(err.Error(), ErrVersion) {
+		t.Fatalf("Restore err %v; expected %v", err, ErrVersion)
+	}
+	if _, _, err := ck.Get("k"); err != ErrNoKey {
+		t.Fatalf("Get err %v; expected ErrNoKey", err)
+	}
+}
+
+func runACL(t *testing.T, nsrv int, part string) {
+	acl := ACL{
+		Secrets: map[string]string{"alice": "a", "bob": "b"},
+		Rules: []ACLRule{
+			{Prefix: "team-a/", Principal: "alice", Perm: PermReadWrite},
+			{Prefix: "team-b/", Principal: "bob", Perm: PermReadWrite},
+			{Prefix: "team-b/", Principal: "alice", Perm: PermRead},
+		},
+	}
+	ts := makeTestKV(t, nsrv, true, StartKVServerACL(acl))
+	defer ts.Cleanup()
+
+	ts.Begin(part)
+
+	alice := ts.MakeClerkWithCredential(Credential{Principal: "alice", Secret: "a"})
+	bob := ts.MakeClerkWithCredential(Credential{Principal: "bob", Secret: "b"})
+	anon := ts.MakeClerk()
+
+	if err := alice.Put("team-a/lock", "alice", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := bob.Put("team-b/x", "bob", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	// bob may neither write nor read team a's keys
+	if err := bob.Put("team-a/lock", "bob", 1); err != ErrPermission {
+		t.Fatalf("Put under another team's prefix err %v; expected ErrPermission", err)
+	}
+	if err := bob.Delete("team-a/lock", 1); err != ErrPermission {
+		t.Fatalf("Delete under another team's prefix err %v; expected ErrPermission", err)
+	}
+	if _, err := bob.(*TestClerk).IKVClerk.(*Clerk).MultiPut([]PutOp{{Key: "team-b/y", Value: "bob"}, {Key: "team-a/y", Value: "bob"}}); err != ErrPermission {
+		t.Fatalf("MultiPut under another team's prefix err %v; expected ErrPermission", err)
+	}
+	if _, _, err := bob.Get("team-a/lock"); err != ErrPermission {
+		t.Fatalf("Get under another team's prefix err %v; expected ErrPermission", err)
+	}
+	if v, ver, err := alice.Get("team-a/lock"); err != OK || v != "alice" || ver != 1 {
+		t.Fatalf("Get = (%v, %v, %v); expected (alice, 1, OK)", v, ver, err)
+	}
+	if _, _, err := alice.Get("team-b/y"); err != ErrNoKey {
+		t.Fatalf("Get of a key of a rejected MultiPut err %v; expected ErrNoKey", err)
+	}
+
+	// alice may read team b's keys, but not write them
+	if v, _, err := alice.Get("team-b/x"); err != OK || v != "bob" {
+		t.Fatalf("Get = (%v, %v); expected (bob, OK)", v, err)
+	}
+	if err := alice.Put("team-b/x", "alice", 1); err != ErrPermission {
+		t.Fatalf("Put with read permission err %v; expected ErrPermission", err)
+	}
+
+	// a wrong secret, or no credential, gets nothing under a prefix
+	mallory := ts.MakeClerkWithCredential(Credential{Principal: "alice", Secret: "b"})
+	if err := mallory.Put("team-a/lock", "mallory", 1); err != ErrPermission {
+		t.Fatalf("Put with a wrong secret err %v; expected ErrPermission", err)
+	}
+	if err := mallory.Put("open", "mallory", 0); err != ErrPermission {
+		t.Fatalf("Put with a wrong secret err %v; expected ErrPermission", err)
+	}
+	if err := anon.Put("team-a/lock", "anon", 1); err != ErrPermission {
+		t.Fatalf("Put without a credential err %v; expected ErrPermission", err)
+	}
+
+	// keys that no rule covers are open to all
+	if err := anon.Put("open", "anon", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if err := bob.Put("open", "bob", 1); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	// Scan leaves out what the clerk may not read
+	entries, _, err := bob.(*TestClerk).IKVClerk.(*Clerk).Scan("", "", 0, "")
+	if err != OK {
+		t.Fatalf("Scan err %v", err)
+	}
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"open", "team-b/x"}) {
+		t.Fatalf("Scan returned %v; expected [open team-b/x]", keys)
+	}
+	// and fills its page with the keys the clerk may read
+	entries, _, err = bob.(*TestClerk).IKVClerk.(*Clerk).Scan("team-", "", 1, "")
+	if err != OK || len(entries) != 1 || entries[0].Key != "team-b/x" {
+		t.Fatalf("Scan = (%v, %v); expected team-b/x", entries, err)
+	}
+
+	// Watch checks the credential like Get
+	if _, _, err := bob.(*TestClerk).IKVClerk.(*Clerk).Watch("team-a/lock", 1, 10*time.Millisecond); err != ErrPermission {
+		t.Fatalf("Watch under another team's prefix err %v; expected ErrPermission", err)
+	}
+	if _, _, err := mallory.(*TestClerk).IKVClerk.(*Clerk).Watch("open", 2, 10*time.Millisecond); err != ErrPermission {
+		t.Fatalf("Watch with a wrong secret err %v; expected ErrPermission", err)
+	}
+
+	// following all changes needs the empty prefix
+	if _, err := alice.(*TestClerk).IKVClerk.(*Clerk).Subscribe(0).Next(time.Second); err != ErrPermission {
+		t.Fatalf("Next err %v; expected ErrPermission", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	runACL(t, 1, "Prefix access control")
+}
+
+func TestACLRaft(t *testing.T) {
+	runACL(t, 3, "Prefix access control in a Raft group")
+}
+
+// Many clerks, each putting as fast as it can, get about the same
+// share, and no more than the rate limit allows
+// Test that the servers of a primary-backup group with an ACL
+// replicate with the ACL's Server credential, and that a clerk can't
+// use the RPCs between servers, or those of the shard controller, to
+// get around the ACL
+func TestACLServerRPCs(t *testing.T) {
+	acl := ACL{
+		Secrets: map[string]string{"alice": "a", "srv": "s"},
+		Rules:   []ACLRule{{Prefix: "team-a/", Principal: "alice", Perm: PermReadWrite}},
+		Server:  "srv",
+	}
+	mks := func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.acl = &acl
+		return startPBKVServer(kv, ends, srv, persister)
+	}
+	ts := makeTestKV(t, 3, true, mks)
+	defer ts.Cleanup()
+
+	ts.Begin("Servers with an ACL call each other with its Server credential")
+
+	alice := ts.MakeClerkWithCredential(Credential{Principal: "alice", Secret: "a"})
+	if err := alice.Put("team-a/x", "alice", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	clnt := alice.(*TestClerk).Clnt
+	value := makePersistedValue("team-a/x", Value{value: "mallory", version: 9})
+	for _, cred := range []Credential{{}, {Principal: "alice", Secret: "a"}, {Principal: "srv", Secret: "x"}} {
+		for i := 0; i < 3; i++ {
+			install := InstallShardReply{}
+			args := InstallShardArgs{Shard: Key2Shard("team-a/x"), Num: 1, Values: []persistedValue{value}, Cred: cred}
+			if ok := clnt.Call(ServerName(GRP0, i), "KVServer.InstallShard", &args, &install); ok && install.Err != ErrPermission {
+				t.Fatalf("InstallShard with %+v err %v; expected ErrPermission", cred, install.Err)
+			}
+			state := GetStateReply{}
+			if ok := clnt.Call(ServerName(GRP0, i), "KVServer.GetState", &GetStateArgs{View: 1 << 20, Cred: cred}, &state); ok && state.OK {
+				t.Fatalf("GetState with %+v returned the state", cred)
+			}
+		}
+	}
+
+	// the backups got alice's Put, and nothing else
+	ts.Group(GRP0).ShutdownServer(0)
+	if val, ver, err := alice.Get("team-a/x"); err != OK || val != "alice" || ver != 1 {
+		t.Fatalf("Get after failover (%v, %v, %v); expected (alice, 1, OK)", val, ver, err)
+	}
+}
+
+func TestRateLimitFair(t *testing.T) {
+	const (
+		NCLNT = 10
+		NSEC  = 2
+		RATE  = 20
+		BURST = 5
+	)
+
+	ts := makeTestKV(t, 1, true, StartKVServerRateLimit(RateLimit{Rate: RATE, Burst: BURST}))
+	defer ts.Cleanup()
+
+	ts.Begin("Rate limits share the server fairly among clerks")
+
+	rs := ts.SpawnClientsAndWait(NCLNT, NSEC*time.Second, func(me int, ck IKVClerk, done chan struct{}) ClntRes {
+		res := ClntRes{}
+		key := strconv.Itoa(me)
+		for ver := Tversion(0); ; ver++ {
+			select {
+			case <-done:
+				return res
+			default:
+			}
+			if err := ck.Put(key, "x", ver); err != OK {
+				res.Nmaybe += 1
+				return res
+			}
+			res.Nok += 1
+		}
+	})
+
+	// the last Put may finish after done, after a backoff
+	most := RATE*(NSEC+MaxBusyBackoff.Seconds()) + BURST
+	for me, r := range rs {
+		if r.Nmaybe > 0 {
+			t.Fatalf("clerk %v got an error from Put", me)
+		}
+		if float64(r.Nok) > most {
+			t.Fatalf("clerk %v did %v Puts; expected at most %v", me, r.Nok, most)
+		}
+		if r.Nok < RATE*NSEC/2 {
+			t.Fatalf("clerk %v did %v Puts; expected at least %v", me, r.Nok, RATE*NSEC/2)
+		}
+	}
+}
+
+// A client that floods the server without backing off gets no more
+// than its rate, and a well-behaved clerk still gets its own
+func TestRateLimitRunaway(t *testing.T) {
+	const (
+		NTHREAD = 8
+		NSEC    = 2
+		RATE    = 20
+		BURST   = 5
+	)
+
+	ts := makeTestKV(t, 1, true, StartKVServerRateLimit(RateLimit{Rate: RATE, Burst: BURST}))
+	defer ts.Cleanup()
+
+	ts.Begin("Rate limits hold back a runaway client")
+
+	ck := ts.MakeClerk()
+	if err := ck.Put("k", "x", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	var nok, nbusy atomic.Int64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	clnt := ts.Config.MakeClient()
+	clientId := nrand()
+	for i := 0; i < NTHREAD; i++ {
+		go func() {
+			defer func() { stopped <- struct{}{} }()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				args := GetArgs{Key: "k", ClientId: clientId}
+				reply := GetReply{}
+				if !clnt.Call(ServerName(GRP0, 0), "KVServer.Get", &args, &reply) {
+					continue
+				}
+				switch reply.Err {
+				case OK:
+					nok.Add(1)
+				case ErrBusy:
+					nbusy.Add(1)
+				}
+			}
+		}()
+	}
+
+	n := 0
+	start := time.Now()
+	for time.Since(start) < NSEC*time.Second {
+		if _, _, err := ck.Get("k"); err != OK {
+			t.Fatalf("Get err %v", err)
+		}
+		n += 1
+	}
+	close(done)
+	for i := 0; i < NTHREAD; i++ {
+		<-stopped
+	}
+
+	if nok.Load() > RATE*NSEC+BURST+RATE {
+		t.Fatalf("runaway client did %v Gets; expected at most %v", nok.Load(), RATE*NSEC+BURST+RATE)
+	}
+	if nbusy.Load() == 0 {
+		t.Fatalf("runaway client never got ErrBusy")
+	}
+	if n < RATE*NSEC/2 {
+		t.Fatalf("clerk did %v Gets beside a runaway client; expected at least %v", n, RATE*NSEC/2)
+	}
+}
+
+// Test that the requests beside the clerk's reads and writes count
+// against the rate limit too
+func TestRateLimitAllRequests(t *testing.T) {
+	ts := makeTestKV(t, 1, true, StartKVServerRateLimit(RateLimit{Rate: 0.01, Burst: 1}))
+	defer ts.Cleanup()
+
+	ts.Begin("Rate limits cover every request")
+
+	clnt := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk).clnt
+	server := ServerName(GRP0, 0)
+	calls := []struct {
+		method string
+		args   func(clientId int64) any
+		err    func(reply any) Err
+		reply  func() any
+	}{
+		{"KVServer.ReadChanges", func(id int64) any { return &ReadChangesArgs{ClientId: id} },
+			func(r any) Err { return r.(*ReadChangesReply).Err }, func() any { return &ReadChangesReply{} }},
+		{"KVServer.Stats", func(id int64) any { return &StatsArgs{ClientId: id} },
+			func(r any) Err { return r.(*StatsReply).Err }, func() any { return &StatsReply{} }},
+		{"Admin.Dump", func(id int64) any { return &DumpArgs{ClientId: id} },
+			func(r any) Err { return r.(*DumpReply).Err }, func() any { return &DumpReply{} }},
+		{"Admin.Restore", func(id int64) any { return &RestoreArgs{ClientId: id, Seq: 1} },
+			func(r any) Err { return r.(*RestoreReply).Err }, func() any { return &RestoreReply{} }},
+	}
+	for i, c := range calls {
+		id := int64(i + 1)
+		reply := c.reply()
+		if !clnt.Call(server, c.method, c.args(id), reply) || c.err(reply) == ErrBusy {
+			t.Fatalf("%v within the burst err %v", c.method, c.err(reply))
+		}
+		reply = c.reply()
+		if !clnt.Call(server, c.method, c.args(id), reply) || c.err(reply) != ErrBusy {
+			t.Fatalf("%v over the rate err %v; expected ErrBusy", c.method, c.err(reply))
+		}
+	}
+}
+
+func TestRateLimitInFlight(t *testing.T) {
+	l := makeRateLimiter(RateLimit{MaxInFlight: 2})
+	if !l.admit(1) || !l.admit(2) {
+		t.Fatalf("requests under the cap turned away")
+	}
+	if l.admit(3) {
+		t.Fatalf("request over the cap admitted")
+	}
+	l.done()
+	if !l.admit(3) {
+		t.Fatalf("request under the cap turned away")
+	}
+}
+
+func runNamespaces(t *testing.T, nsrv int, part string) {
+	quotas := map[string]Quota{
+		"a": {Keys: 3},
+		"b": {Bytes: 20},
+	}
+	ts := makeTestKV(t, nsrv, true, StartKVServerQuotas(quotas))
+	defer ts.Cleanup()
+
+	ts.Begin(part)
+
+	cks := map[string]IKVClerk{
+		"":  ts.MakeClerk(),
+		"a": ts.MakeClerkInNamespace("a"),
+		"b": ts.MakeClerkInNamespace("b"),
+	}
+	cs := cks["a"].(*TestClerk).IKVClerk.(*Clerk).Subscribe(0)
+
+	// the same key in each namespace is a key of its own
+	for ns, ck := range cks {
+		if err := ck.Put("k", "v"+ns, 0); err != OK {
+			t.Fatalf("Put in %q err %v", ns, err)
+		}
+	}
+	for ns, ck := range cks {
+		if v, ver, err := ck.Get("k"); err != OK || v != "v"+ns || ver != 1 {
+			t.Fatalf("Get in %q = (%v, %v, %v); expected (%v, 1, OK)", ns, v, ver, err, "v"+ns)
+		}
+		entries, _, err := ck.(*TestClerk).IKVClerk.(*Clerk).Scan("", "", 0, "")
+		if err != OK || len(entries) != 1 || entries[0] != (ScanEntry{Key: "k", Value: "v" + ns, Version: 1}) {
+			t.Fatalf("Scan in %q = (%v, %v); expected only k", ns, entries, err)
+		}
+	}
+	// a's stream sees only a's change, with a's key
+	if c, err := cs.Next(time.Second); err != OK || c.Key != "k" || c.Value != "va" {
+		t.Fatalf("Next = (%+v, %v); expected the change of k in a", c, err)
+	}
+	if c, err := cs.Next(100 * time.Millisecond); err != ErrNoKey {
+		t.Fatalf("Next = (%+v, %v) with no change in a; expected ErrNoKey", c, err)
+	}
+
+	// a holds at most 3 keys
+	a := cks["a"]
+	for _, k := range []string{"k1", "k2"} {
+		if err := a.Put(k, "x", 0); err != OK {
+			t.Fatalf("Put err %v", err)
+		}
+	}
+	if err := a.Put("k3", "x", 0); err != ErrQuota {
+		t.Fatalf("Put over the key quota err %v; expected ErrQuota", err)
+	}
+	if _, err := a.(*TestClerk).IKVClerk.(*Clerk).MultiPut([]PutOp{{Key: "k1", Value: "y", Version: 1}, {Key: "k3", Value: "y"}}); err != ErrQuota {
+		t.Fatalf("MultiPut over the key quota err %v; expected ErrQuota", err)
+	}
+	if err := a.Put("k1", "y", 1); err != OK {
+		t.Fatalf("Put of an existing key at the key quota err %v", err)
+	}
+	if err := cks[""].Put("k3", "x", 0); err != OK {
+		t.Fatalf("Put in another namespace err %v", err)
+	}
+
+	// b holds at most 20 bytes; it has 3, for k and vb
+	b := cks["b"]
+	if err := b.Put("big", strings.Repeat("x", 15), 0); err != ErrQuota {
+		t.Fatalf("Put over the byte quota err %v; expected ErrQuota", err)
+	}
+	if err := b.Put("big", strings.Repeat("x", 14), 0); err != OK {
+		t.Fatalf("Put up to the byte quota err %v", err)
+	}
+	if err := b.Put("k", "vbb", 1); err != ErrQuota {
+		t.Fatalf("Put that grows a key over the byte quota err %v; expected ErrQuota", err)
+	}
+	if err := b.Put("k", "", 1); err != OK {
+		t.Fatalf("Put that shrinks a key err %v", err)
+	}
+
+	// deleting a key frees its share, and a restart keeps the usage
+	if err := a.Delete("k2", 1); err != OK {
+		t.Fatalf("Delete err %v", err)
+	}
+	ts.Restart()
+	if err := a.Put("k3", "x", 0); err != OK {
+		t.Fatalf("Put after a Delete err %v", err)
+	}
+	if err := a.Put("k4", "x", 0); err != ErrQuota {
+		t.Fatalf("Put over the key quota after a restart err %v; expected ErrQuota", err)
+	}
+	if err := b.Put("big", strings.Repeat("x", 17), 1); err != ErrQuota {
+		t.Fatalf("Put over the byte quota after a restart err %v; expected ErrQuota", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	runNamespaces(t, 1, "Namespaces with quotas")
+}
+
+func TestNamespacesRaft(t *testing.T) {
+	runNamespaces(t, 3, "Namespaces with quotas in a Raft group")
+}
+
+// Test that a clerk of the default namespace can't reach the keys of
+// another namespace through the stored keys, and that a namespace
+// can't hold "\x00"
+func TestNamespaceIsolation(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Namespaces stay apart")
+
+	a := ts.MakeClerkInNamespace("a")
+	if err := a.Put("secret", "x", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+
+	ck := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	stored := nsKey("a", "secret")
+	if _, _, err := ck.Get(stored); err != ErrBadKey {
+		t.Fatalf("Get of a stored key err %v; expected ErrBadKey", err)
+	}
+	if err := ck.Put(stored, "y", 1); err != ErrBadKey {
+		t.Fatalf("Put of a stored key err %v; expected ErrBadKey", err)
+	}
+	if err := ck.Delete(stored, 1); err != ErrBadKey {
+		t.Fatalf("Delete of a stored key err %v; expected ErrBadKey", err)
+	}
+	if _, err := ck.MultiPut([]PutOp{{Key: "k", Value: "y"}, {Key: stored, Value: "y", Version: 1}}); err != ErrBadKey {
+		t.Fatalf("MultiPut of a stored key err %v; expected ErrBadKey", err)
+	}
+	if _, _, err := ck.ScanPrefix(nsPrefix, 0, ""); err != ErrBadKey {
+		t.Fatalf("Scan of the stored prefix err %v; expected ErrBadKey", err)
+	}
+	if _, _, err := ck.Scan(nsPrefix, "", 0, ""); err != ErrBadKey {
+		t.Fatalf("Scan from the stored prefix err %v; expected ErrBadKey", err)
+	}
+	if _, _, err := ck.Scan("", stored+"\x00", 0, ""); err != ErrBadKey {
+		t.Fatalf("Scan up to a stored key err %v; expected ErrBadKey", err)
+	}
+	if _, _, err := ck.Scan("", "", 0, stored); err != ErrBadKey {
+		t.Fatalf("Scan from a stored token err %v; expected ErrBadKey", err)
+	}
+	if entries, _, err := ck.Scan("", "", 0, ""); err != OK || len(entries) != 0 {
+		t.Fatalf("Scan = (%v, %v); expected no keys", entries, err)
+	}
+
+	// "a\x00secret" in namespace "" of a would be stored as a's key
+	bad := ts.MakeClerk().(*TestClerk).IKVClerk.(*Clerk)
+	bad.namespace = "a\x00"
+	if _, _, err := bad.Get("secret"); err != ErrBadKey {
+		t.Fatalf("Get in a namespace with \\x00 err %v; expected ErrBadKey", err)
+	}
+	if v, ver, err := a.Get("secret"); err != OK || v != "x" || ver != 1 {
+		t.Fatalf("Get = (%v, %v, %v); expected (x, 1, OK)", v, ver, err)
+	}
+}
+
+// Test that a stream of a quiet namespace keeps up with the change log
+// while another namespace makes more changes than the log keeps
+func TestChangesOtherNamespaceOutrunsLog(t *testing.T) {
+	ts := MakeTestKV(t, true)
+	defer ts.Cleanup()
+
+	ts.Begin("Follow a quiet namespace")
+
+	a := ts.MakeClerkInNamespace("a")
+	b := ts.MakeClerkInNamespace("b").(*TestClerk).IKVClerk.(*Clerk)
+	cs := a.(*TestClerk).IKVClerk.(*Clerk).Subscribe(0)
+	for i := 0; i < 3*ChangeLogSize; i += MaxReadChanges {
+		ops := make([]PutOp, MaxReadChanges)
+		for j := range ops {
+			ops[j] = PutOp{Key: strconv.Itoa(i + j), Value: "x"}
+		}
+		if _, err := b.MultiPut(ops); err != OK {
+			t.Fatalf("MultiPut err %v", err)
+		}
+		if c, err := cs.Next(50 * time.Millisecond); err != ErrNoKey {
+			t.Fatalf("Next = (%+v, %v) with no change in a; expected ErrNoKey", c, err)
+		}
+	}
+	if err := a.Put("k", "v", 0); err != OK {
+		t.Fatalf("Put err %v", err)
+	}
+	if c, err := cs.Next(time.Second); err != OK || c.Key != "k" || c.Value != "v" {
+		t.Fatalf("Next = (%+v, %v); expected the change of k in a", c, err)
+	}
+}
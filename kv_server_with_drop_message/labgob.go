@@ -45,6 +45,13 @@ func (dec *LabDecoder) Decode(e interface{}) error {
 	return dec.gob.Decode(e)
 }
 
+// Register records a type that is sent inside an interface{}, like a
+// Raft log entry's command.
+func Register(value interface{}) {
+	checkValue(value)
+	gob.Register(value)
+}
+
 func checkValue(value interface{}) {
 	checkType(reflect.TypeOf(value))
 }
@@ -0,0 +1,120 @@
+package kv_server_with_stable_network
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A KVServer can limit the rate of requests of each clerk, by client
+// id, with a token bucket: a clerk may send Burst requests at once,
+// and then Rate requests a second. It can also cap the requests it
+// performs at once, over all clerks. The server answers a request
+// over either limit with ErrBusy, without performing it, and the Clerk
+// backs off and resends the request to the same server, since a busy
+// server is alive, unlike one that drops messages.
+//
+// Every request of a clerk counts against the limits: Get, Put,
+// Delete, MultiPut, Scan, Watch, ReadChanges, Stats, and the Admin's
+// Dump and Restore; a Watch or ReadChanges counts against the cap for
+// as long as it waits. Requests without a client id
+// share no bucket, so only the cap limits them.
+
+type RateLimit struct {
+	Rate        float64 // per second and clerk; 0 means no limit
+	Burst       int
+	MaxInFlight int // 0 means no cap
+}
+
+// the first and the longest backoff of a Clerk after ErrBusy
+const (
+	BusyBackoff    = 10 * time.Millisecond
+	MaxBusyBackoff = time.Second
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	limit    RateLimit
+	inFlight atomic.Int64
+
+	mu      sync.Mutex
+	buckets map[int64]*bucket
+	pruned  int // len(buckets) after the last prune
+}
+
+func makeRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[int64]*bucket)}
+}
+
+// admit reports whether the server may perform a request of clientId
+// now. If it may, the caller must call done once the request is over.
+// A nil rateLimiter admits everything.
+func (l *rateLimiter) admit(clientId int64) bool {
+	if l == nil {
+		return true
+	}
+	if n := l.inFlight.Add(1); l.limit.MaxInFlight > 0 && n > int64(l.limit.MaxInFlight) {
+		l.inFlight.Add(-1)
+		return false
+	}
+	if clientId != 0 && l.limit.Rate > 0 && !l.take(clientId) {
+		l.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *rateLimiter) done() {
+	if l != nil {
+		l.inFlight.Add(-1)
+	}
+}
+
+// take takes a token from the bucket of clientId, if it has one.
+func (l *rateLimiter) take(clientId int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[clientId]
+	if !ok {
+		l.pruneL(now)
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[clientId] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate, float64(l.limit.Burst))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// pruneL drops the buckets that have filled up again, since a new
+// bucket starts full, once the buckets have doubled since the last
+// prune. Caller must hold l.mu.
+func (l *rateLimiter) pruneL(now time.Time) {
+	if len(l.buckets) < max(2*l.pruned, 64) {
+		return
+	}
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, id)
+		}
+	}
+	l.pruned = len(l.buckets)
+}
+
+// backoff sleeps after the busy'th ErrBusy in a row, for twice as
+// long each time up to MaxBusyBackoff, with jitter so that clerks
+// turned away together don't come back together.
+func backoff(busy int) {
+	d := min(BusyBackoff<<min(busy, 16), MaxBusyBackoff)
+	time.Sleep(d/2 + time.Duration(rand.Int63n(int64(d/2)+1)))
+}
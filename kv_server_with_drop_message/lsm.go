@@ -0,0 +1,999 @@
+package kv_server_with_stable_network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An lsmEngine is a log-structured merge tree that keeps its keys in a
+// directory, so that a KVServer can hold more keys than fit in memory:
+//
+//	wal-<n>    write-ahead log of keys in the memtables
+//	table-<n>  sorted string table (SSTable) of keys flushed from a
+//	           memtable or merged by compaction
+//	MANIFEST   "<n>" and then the tables in use, newest first; the
+//	           tables hold the keys of wal-<n> and all older logs
+//
+// A write goes to an in-memory B-tree, the memtable, and, once the
+// KVServer commits it, to the current log. When the memtable outgrows
+// its limit, it becomes immutable, a new memtable and log take over,
+// and a background worker writes the old memtable to a new table and
+// switches MANIFEST to it. Once there are LSMCompactTables tables, the
+// worker merges them all into one, dropping deleted keys. A read looks
+// in the memtables and then in the tables from newest to oldest, and a
+// table's bloom filter lets the read skip most tables without a disk
+// read. A deleted key is kept as a tombstone, a Value with version 0,
+// which no existing key has.
+//
+// Like the file-backed Persister, the engine writes a table before it
+// renames a new MANIFEST into place, so a crash at any point, even in
+// the middle of a flush, leaves either the old or the new tables.
+// Files that MANIFEST doesn't name are left-overs of an interrupted
+// flush or compaction, and are removed on the next start, which then
+// replays the logs that aren't in the tables yet.
+//
+// If a flush or compaction fails, say because the disk is full, the
+// worker logs the error and tries again, waiting longer each time up
+// to LSMRetryMaxDelay. Until a flush succeeds, the immutable memtable
+// stays in memory and the memtable grows past its limit, but reads and
+// writes go on.
+
+// the default size of a memtable, in bytes of keys and values
+const LSMMemtableBytes = 1 << 20
+
+// merge the tables once there are this many
+const LSMCompactTables = 4
+
+// the worker waits this long after a failed flush or compaction, and
+// twice as long after each further failure, up to LSMRetryMaxDelay
+const (
+	LSMRetryDelay    = 10 * time.Millisecond
+	LSMRetryMaxDelay = time.Second
+)
+
+const (
+	manifestFile     = "MANIFEST"
+	lsmIndexInterval = 16 // keep every 16th key of a table in memory
+	bloomBitsPerKey  = 10
+	bloomHashes      = 7
+	tableMagic       = 0x6c736d7461626c65 // "lsmtable"
+	tableFooterBytes = 32
+)
+
+// a flush or compaction stopped because the engine was closed or, in
+// a test, killed
+var errStopped = errors.New("lsm: stopped")
+
+// a flush failed in a test
+var errFailed = errors.New("lsm: failed")
+
+// A DurableEngine keeps its keys on disk by itself, so a KVServer
+// leaves them out of its snapshots (see persist.go). The engine must
+// not make a write durable before the server commits it, since the
+// server may be shut down before it has logged the write.
+type DurableEngine interface {
+	Engine
+
+	// Commit writes the writes since the last Commit to the log.
+	Commit()
+
+	// Sync commits, and waits until the log is on disk.
+	Sync()
+
+	// Close stops the background worker and closes the files,
+	// dropping writes that weren't committed, as a crash would.
+	Close()
+}
+
+type lsmEngine struct {
+	dir       string
+	memLimit  int
+	compactAt int
+
+	mu         sync.RWMutex
+	mem        *btreeEngine
+	memBytes   int
+	pending    []byte // log records of the writes since Commit
+	wal        *os.File
+	walW       *bufio.Writer
+	walN       int
+	imm        *btreeEngine // the memtable being flushed, or nil
+	immWal     int          // the newest log that imm holds
+	flushedWal int          // the tables hold this log and older ones
+	tables     []*sstable   // newest first
+	nextTable  int
+	n          int // number of keys
+	closed     bool
+
+	closing atomic.Bool
+	stop    chan struct{} // closed when the engine is closing
+	work    chan struct{} // wakes up the worker
+	done    chan struct{} // closed when the worker exits
+
+	// for tests: the worker dies after writing this many keys of a
+	// flush, as if the server crashed
+	killFlushAt int
+	// for tests: this many flushes fail, as if the disk were full
+	failFlushes int
+}
+
+type sstable struct {
+	n       int
+	f       *os.File
+	nkeys   int
+	dataEnd int64
+	index   []tableIndexEntry // every lsmIndexInterval'th key
+	bloom   bloomFilter
+}
+
+type tableIndexEntry struct {
+	key Key
+	off int64
+}
+
+// MakeLSMEngine returns an engine that keeps its keys in dir, creating
+// dir if needed, and starting with the keys saved there. memtable is
+// the size at which the engine flushes a memtable, or 0 for
+// LSMMemtableBytes.
+func MakeLSMEngine(dir string, memtable int) (Engine, error) {
+	if memtable <= 0 {
+		memtable = LSMMemtableBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &lsmEngine{
+		dir:       dir,
+		memLimit:  memtable,
+		compactAt: LSMCompactTables,
+		mem:       &btreeEngine{},
+		stop:      make(chan struct{}),
+		work:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("corrupt %s", manifestFile)
+		}
+		nums := make([]int, len(fields))
+		for i, f := range fields {
+			if nums[i], err = strconv.Atoi(f); err != nil {
+				return nil, fmt.Errorf("corrupt %s: %v", manifestFile, err)
+			}
+		}
+		e.flushedWal = nums[0]
+		for _, n := range nums[1:] {
+			t, err := openTable(e.path("table", n), n)
+			if err != nil {
+				return nil, err
+			}
+			e.tables = append(e.tables, t)
+			e.nextTable = max(e.nextTable, n+1)
+		}
+	}
+
+	wals, err := e.removeStale()
+	if err != nil {
+		return nil, err
+	}
+	e.walN = e.flushedWal
+	for _, n := range wals {
+		replayWAL(e.path("wal", n), func(key Key, value Value) {
+			e.mem.Put(key, value)
+			e.memBytes += entryBytes(key, value)
+		})
+		e.walN = max(e.walN, n)
+	}
+	if err := e.openWALL(e.walN + 1); err != nil {
+		return nil, err
+	}
+
+	e.iterateL(func(Key, Value) bool {
+		e.n += 1
+		return true
+	})
+
+	go e.worker()
+	return e, nil
+}
+
+// MakeLSMEngines returns an EngineMaker whose i'th engine lives in
+// dir/stripe-<i>, for a KVServer, which makes one engine per stripe
+// in order.
+func MakeLSMEngines(dir string, memtable int) EngineMaker {
+	i := 0
+	return func() Engine {
+		e, err := MakeLSMEngine(filepath.Join(dir, fmt.Sprintf("stripe-%d", i)), memtable)
+		if err != nil {
+			log.Fatalf("[LSM->MakeLSMEngines]: %v", err)
+		}
+		i += 1
+		return e
+	}
+}
+
+func (e *lsmEngine) path(kind string, n int) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%s-%d", kind, n))
+}
+
+// removeStale removes the files that MANIFEST doesn't need, and
+// returns the logs to replay, oldest first.
+func (e *lsmEngine) removeStale() ([]int, error) {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[int]bool)
+	for _, t := range e.tables {
+		inUse[t.n] = true
+	}
+	wals := []int{}
+	for _, de := range entries {
+		name := de.Name()
+		kind, num, _ := strings.Cut(name, "-")
+		n, err := strconv.Atoi(num)
+		switch {
+		case name == manifestFile:
+		case err == nil && kind == "wal" && n > e.flushedWal:
+			wals = append(wals, n)
+		case err == nil && kind == "table" && inUse[n]:
+		default:
+			os.Remove(filepath.Join(e.dir, name))
+		}
+	}
+	sort.Ints(wals)
+	return wals, nil
+}
+
+func (e *lsmEngine) openWALL(n int) error {
+	f, err := os.OpenFile(e.path("wal", n), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	e.wal = f
+	e.walW = bufio.NewWriter(f)
+	e.walN = n
+	return nil
+}
+
+func tombstone(value Value) bool {
+	return value.version == 0
+}
+
+// the memory a key takes in a memtable, roughly
+func entryBytes(key Key, value Value) int {
+	return len(key) + len(value.value) + 32
+}
+
+func (e *lsmEngine) Get(key Key) (Value, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.getL(key)
+}
+
+func (e *lsmEngine) getL(key Key) (Value, bool) {
+	if e.closed {
+		return Value{}, false
+	}
+	for _, m := range []*btreeEngine{e.mem, e.imm} {
+		if m == nil {
+			continue
+		}
+		if value, found := m.Get(key); found {
+			return value, !tombstone(value)
+		}
+	}
+	for _, t := range e.tables {
+		if value, found := t.get(key); found {
+			return value, !tombstone(value)
+		}
+	}
+	return Value{}, false
+}
+
+func (e *lsmEngine) Put(key Key, value Value) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, found := e.getL(key); !found {
+		e.n += 1
+	}
+	e.writeL(key, value)
+}
+
+func (e *lsmEngine) Delete(key Key) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, found := e.getL(key); !found {
+		return
+	}
+	e.n -= 1
+	e.writeL(key, Value{})
+}
+
+func (e *lsmEngine) writeL(key Key, value Value) {
+	e.mem.Put(key, value)
+	e.memBytes += entryBytes(key, value)
+	e.pending = appendWALRecord(e.pending, key, value)
+}
+
+func (e *lsmEngine) Iterate(fn func(Key, Value) bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	e.iterateL(fn)
+}
+
+func (e *lsmEngine) iterateL(fn func(Key, Value) bool) {
+	e.ascendL("", fn)
+}
+
+func (e *lsmEngine) Ascend(start Key, fn func(Key, Value) bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	e.ascendL(start, fn)
+}
+
+func (e *lsmEngine) ascendL(start Key, fn func(Key, Value) bool) {
+	if e.closed {
+		return
+	}
+	srcs := []*lsmIter{memIter(e.mem, start)}
+	if e.imm != nil {
+		srcs = append(srcs, memIter(e.imm, start))
+	}
+	for _, t := range e.tables {
+		srcs = append(srcs, t.iter(start))
+	}
+	mergeSources(srcs, func(key Key, value Value) bool {
+		return tombstone(value) || fn(key, value)
+	})
+}
+
+func (e *lsmEngine) Len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.n
+}
+
+// Snapshot copies the keys into memory, since the tables don't stay
+// around once compaction has merged them.
+func (e *lsmEngine) Snapshot() Engine {
+	snap := &btreeEngine{}
+	e.Iterate(func(key Key, value Value) bool {
+		snap.Put(key, value)
+		return true
+	})
+	return snap
+}
+
+func (e *lsmEngine) Commit() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commitL()
+}
+
+func (e *lsmEngine) commitL() {
+	if e.closed {
+		return
+	}
+	if len(e.pending) > 0 {
+		if _, err := e.walW.Write(e.pending); err != nil {
+			log.Fatalf("[LSM->Commit]: %v", err)
+		}
+		if err := e.walW.Flush(); err != nil {
+			log.Fatalf("[LSM->Commit]: %v", err)
+		}
+		e.pending = e.pending[:0]
+	}
+
+	// everything in the memtable is committed now, so it may go
+	// to a table
+	if e.memBytes >= e.memLimit && e.imm == nil {
+		e.wal.Close()
+		e.imm, e.immWal = e.mem, e.walN
+		e.mem, e.memBytes = &btreeEngine{}, 0
+		if err := e.openWALL(e.walN + 1); err != nil {
+			log.Fatalf("[LSM->Commit]: %v", err)
+		}
+		select {
+		case e.work <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *lsmEngine) Sync() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commitL()
+	if e.closed {
+		return
+	}
+	if err := e.wal.Sync(); err != nil {
+		log.Fatalf("[LSM->Sync]: %v", err)
+	}
+}
+
+func (e *lsmEngine) Close() {
+	if !e.closing.Swap(true) {
+		close(e.stop)
+	}
+	select {
+	case e.work <- struct{}{}:
+	default:
+	}
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.wal.Close()
+	for _, t := range e.tables {
+		t.f.Close()
+	}
+	e.pending = nil
+}
+
+// worker flushes the immutable memtable and compacts the tables,
+// until the engine is closed.
+func (e *lsmEngine) worker() {
+	defer close(e.done)
+
+	for range e.work {
+		if e.closing.Load() {
+			return
+		}
+		e.mu.RLock()
+		imm, ntables := e.imm, len(e.tables)
+		e.mu.RUnlock()
+
+		if imm != nil {
+			if e.retry(func() error { return e.flush(imm) }) != nil {
+				return
+			}
+			ntables += 1
+		}
+		if ntables >= e.compactAt {
+			if e.retry(e.compact) != nil {
+				return
+			}
+		}
+	}
+}
+
+// retry runs op until it succeeds, and returns errStopped if op, or
+// the wait before the next try, stopped because the engine is closing
+// or, in a test, was killed.
+func (e *lsmEngine) retry(op func() error) error {
+	delay := LSMRetryDelay
+	for {
+		err := op()
+		if err == nil || err == errStopped {
+			return err
+		}
+		log.Printf("[LSM->worker]: %v; retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-e.stop:
+			return errStopped
+		}
+		delay = min(2*delay, LSMRetryMaxDelay)
+	}
+}
+
+func (e *lsmEngine) flush(imm *btreeEngine) error {
+	e.mu.Lock()
+	n := e.nextTable
+	e.nextTable += 1
+	immWal := e.immWal
+	e.mu.Unlock()
+
+	if e.failFlushes > 0 {
+		e.failFlushes -= 1
+		return fmt.Errorf("flush to table-%d: %w", n, errFailed)
+	}
+	t, err := e.writeTable(n, imm.Len(), imm.Iterate, e.killFlushAt)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.tables = append([]*sstable{t}, e.tables...)
+	e.imm = nil
+	e.flushedWal = immWal
+	e.writeManifestL()
+	e.mu.Unlock()
+
+	entries, _ := os.ReadDir(e.dir)
+	for _, de := range entries {
+		kind, num, _ := strings.Cut(de.Name(), "-")
+		if n, err := strconv.Atoi(num); err == nil && kind == "wal" && n <= immWal {
+			os.Remove(filepath.Join(e.dir, de.Name()))
+		}
+	}
+	return nil
+}
+
+// compact merges all tables into one. Since the new table is the
+// oldest, it can leave out deleted keys.
+func (e *lsmEngine) compact() error {
+	e.mu.Lock()
+	inputs := slices.Clone(e.tables)
+	n := e.nextTable
+	e.nextTable += 1
+	e.mu.Unlock()
+
+	nkeys := 0
+	srcs := make([]*lsmIter, len(inputs))
+	for i, t := range inputs {
+		nkeys += t.nkeys
+		srcs[i] = t.iter("")
+	}
+	merged := func(fn func(Key, Value) bool) {
+		mergeSources(srcs, func(key Key, value Value) bool {
+			return tombstone(value) || fn(key, value)
+		})
+	}
+	t, err := e.writeTable(n, nkeys, merged, 0)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	// only the worker changes the tables, so they are still inputs
+	e.tables = []*sstable{t}
+	e.writeManifestL()
+	e.mu.Unlock()
+
+	for _, t := range inputs {
+		t.f.Close()
+		os.Remove(e.path("table", t.n))
+	}
+	return nil
+}
+
+func (e *lsmEngine) writeManifestL() {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", e.flushedWal)
+	for _, t := range e.tables {
+		fmt.Fprintf(&b, "%d\n", t.n)
+	}
+	tmp := filepath.Join(e.dir, manifestFile+".tmp")
+	if err := writeFileSync(tmp, []byte(b.String())); err != nil {
+		log.Fatalf("[LSM->writeManifest]: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(e.dir, manifestFile)); err != nil {
+		log.Fatalf("[LSM->writeManifest]: %v", err)
+	}
+	if err := syncDir(e.dir); err != nil {
+		log.Fatalf("[LSM->writeManifest]: %v", err)
+	}
+}
+
+// A table holds the entries of its keys in order, an index of every
+// lsmIndexInterval'th key, a bloom filter of all keys, and a footer
+// with the offsets of the index and the filter:
+//
+//	entries | index | bloom filter | dataEnd indexEnd nkeys magic
+//
+// An entry is the key and value, each preceded by its length, the
+// version, the expiry time in Unix nanoseconds, or 0, and the key's
+// metadata (see meta.go): the creation and modification times and the
+// writer. An index entry is a key and the offset of
+// its entry.
+
+// writeTable writes the keys that each yields, in order, to
+// table-<n>. It returns errStopped, leaving a partial file as a crash
+// would, if the engine is closing, or after kill keys if kill > 0. It
+// removes the file if writing it fails.
+func (e *lsmEngine) writeTable(n int, nkeys int, each func(func(Key, Value) bool), kill int) (*sstable, error) {
+	f, err := os.OpenFile(e.path("table", n), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	t := &sstable{n: n, f: f, bloom: makeBloom(nkeys)}
+
+	var buf []byte
+	stopped := false
+	each(func(key Key, value Value) bool {
+		if e.closing.Load() || (kill > 0 && t.nkeys == kill) {
+			stopped = true
+			return false
+		}
+		if t.nkeys%lsmIndexInterval == 0 {
+			t.index = append(t.index, tableIndexEntry{key: key, off: t.dataEnd})
+		}
+		buf = appendEntry(buf[:0], key, value)
+		w.Write(buf)
+		t.dataEnd += int64(len(buf))
+		t.bloom.add(key)
+		t.nkeys += 1
+		return true
+	})
+	if stopped {
+		w.Flush()
+		f.Close()
+		return nil, errStopped
+	}
+
+	buf = buf[:0]
+	for _, ie := range t.index {
+		buf = binary.AppendUvarint(buf, uint64(len(ie.key)))
+		buf = append(buf, ie.key...)
+		buf = binary.AppendUvarint(buf, uint64(ie.off))
+	}
+	indexEnd := t.dataEnd + int64(len(buf))
+	buf = append(buf, t.bloom...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(t.dataEnd))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(indexEnd))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(t.nkeys))
+	buf = binary.LittleEndian.AppendUint64(buf, tableMagic)
+	w.Write(buf)
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return t, nil
+}
+
+func openTable(name string, n int) (*sstable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(f, n)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return t, nil
+}
+
+func readTable(f *os.File, n int) (*sstable, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < tableFooterBytes {
+		return nil, errors.New("short table")
+	}
+	footer := make([]byte, tableFooterBytes)
+	if _, err := f.ReadAt(footer, size-tableFooterBytes); err != nil {
+		return nil, err
+	}
+	dataEnd := int64(binary.LittleEndian.Uint64(footer[0:]))
+	indexEnd := int64(binary.LittleEndian.Uint64(footer[8:]))
+	nkeys := int(binary.LittleEndian.Uint64(footer[16:]))
+	if binary.LittleEndian.Uint64(footer[24:]) != tableMagic || dataEnd > indexEnd || indexEnd > size-tableFooterBytes {
+		return nil, errors.New("corrupt table footer")
+	}
+
+	meta := make([]byte, size-tableFooterBytes-dataEnd)
+	if _, err := f.ReadAt(meta, dataEnd); err != nil {
+		return nil, err
+	}
+	t := &sstable{n: n, f: f, nkeys: nkeys, dataEnd: dataEnd}
+	r := bytes.NewReader(meta[:indexEnd-dataEnd])
+	for r.Len() > 0 {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, tableIndexEntry{key: Key(key), off: int64(off)})
+	}
+	t.bloom = bloomFilter(meta[indexEnd-dataEnd:])
+	return t, nil
+}
+
+// get reads the stretch of entries between two index entries that
+// could hold key.
+func (t *sstable) get(key Key) (Value, bool) {
+	if !t.bloom.mayContain(key) {
+		return Value{}, false
+	}
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if i < 0 {
+		return Value{}, false
+	}
+	end := t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].off
+	}
+	buf := make([]byte, end-t.index[i].off)
+	if _, err := t.f.ReadAt(buf, t.index[i].off); err != nil {
+		log.Fatalf("[LSM->get]: table-%d: %v", t.n, err)
+	}
+	r := bytes.NewReader(buf)
+	for r.Len() > 0 {
+		k, value, err := readEntry(r)
+		if err != nil {
+			log.Fatalf("[LSM->get]: table-%d: %v", t.n, err)
+		}
+		if k == key {
+			return value, true
+		}
+		if k > key {
+			break
+		}
+	}
+	return Value{}, false
+}
+
+// An lsmIter walks the keys of a memtable or table in order, from
+// the first key >= the start it was made with.
+type lsmIter struct {
+	key   Key
+	value Value
+	ok    bool
+	next  func() (Key, Value, bool)
+}
+
+func (it *lsmIter) advance() {
+	it.key, it.value, it.ok = it.next()
+}
+
+func memIter(m *btreeEngine, start Key) *lsmIter {
+	type kv struct {
+		key   Key
+		value Value
+	}
+	items := []kv{}
+	m.Ascend(start, func(key Key, value Value) bool {
+		items = append(items, kv{key, value})
+		return true
+	})
+	it := &lsmIter{next: func() (Key, Value, bool) {
+		if len(items) == 0 {
+			return "", Value{}, false
+		}
+		item := items[0]
+		items = items[1:]
+		return item.key, item.value, true
+	}}
+	it.advance()
+	return it
+}
+
+// iter starts reading at the last index entry <= start, and skips
+// the entries before start.
+func (t *sstable) iter(start Key) *lsmIter {
+	off := int64(0)
+	if i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > start
+	}) - 1; i >= 0 {
+		off = t.index[i].off
+	}
+	r := bufio.NewReader(io.NewSectionReader(t.f, off, t.dataEnd-off))
+	it := &lsmIter{next: func() (Key, Value, bool) {
+		for {
+			key, value, err := readEntry(r)
+			if err == io.EOF {
+				return "", Value{}, false
+			}
+			if err != nil {
+				log.Fatalf("[LSM->iter]: table-%d: %v", t.n, err)
+			}
+			if key >= start {
+				return key, value, true
+			}
+		}
+	}}
+	it.advance()
+	return it
+}
+
+// mergeSources calls fn in key order for the keys of srcs, which are
+// newest first, with the value of each key in the newest source that
+// has it, until fn returns false.
+func mergeSources(srcs []*lsmIter, fn func(Key, Value) bool) {
+	for {
+		var first *lsmIter
+		for _, it := range srcs {
+			if it.ok && (first == nil || it.key < first.key) {
+				first = it
+			}
+		}
+		if first == nil {
+			return
+		}
+		key, value := first.key, first.value
+		for _, it := range srcs {
+			if it.ok && it.key == key {
+				it.advance()
+			}
+		}
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+type entryReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func appendEntry(b []byte, key Key, value Value) []byte {
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = binary.AppendUvarint(b, uint64(len(value.value)))
+	b = append(b, value.value...)
+	b = binary.AppendUvarint(b, uint64(value.version))
+	b = binary.AppendVarint(b, unixNano(value.expires))
+	b = binary.AppendVarint(b, value.meta.Created)
+	b = binary.AppendVarint(b, value.meta.Modified)
+	return binary.AppendVarint(b, value.meta.Writer)
+}
+
+// readEntry returns io.EOF only if r ends before the entry starts.
+func readEntry(r entryReader) (Key, Value, error) {
+	key, err := readBytes(r)
+	if err != nil {
+		return "", Value{}, err
+	}
+	val, err := readBytes(r)
+	if err == nil {
+		var version uint64
+		if version, err = binary.ReadUvarint(r); err == nil {
+			var fields [4]int64 // expires, created, modified, writer
+			for i := 0; i < len(fields) && err == nil; i++ {
+				fields[i], err = binary.ReadVarint(r)
+			}
+			if err == nil {
+				value := Value{
+					value:   string(val),
+					version: Tversion(version),
+					expires: fromUnixNano(fields[0]),
+					meta: KeyMeta{
+						Created:  fields[1],
+						Modified: fields[2],
+						Writer:   fields[3],
+					},
+				}
+				return Key(key), value, nil
+			}
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return "", Value{}, err
+}
+
+func readBytes(r entryReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, errors.New("corrupt length")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// A log record is the length of an entry, its CRC-32, and the entry.
+func appendWALRecord(b []byte, key Key, value Value) []byte {
+	entry := appendEntry(nil, key, value)
+	b = binary.AppendUvarint(b, uint64(len(entry)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(entry))
+	return append(b, entry...)
+}
+
+// replayWAL calls fn for each record of the log in name, up to the
+// first one that is torn or corrupt.
+func replayWAL(name string, fn func(Key, Value)) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > 1<<30 {
+			return
+		}
+		var sum [4]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return
+		}
+		entry := make([]byte, n)
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return
+		}
+		if crc32.ChecksumIEEE(entry) != binary.LittleEndian.Uint32(sum[:]) {
+			return
+		}
+		key, value, err := readEntry(bytes.NewReader(entry))
+		if err != nil {
+			return
+		}
+		fn(key, value)
+	}
+}
+
+type bloomFilter []byte
+
+func makeBloom(nkeys int) bloomFilter {
+	bits := max(64, nkeys*bloomBitsPerKey)
+	return make(bloomFilter, (bits+7)/8)
+}
+
+func bloomHash(key Key) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	return uint32(x), uint32(x>>32) | 1
+}
+
+func (bf bloomFilter) add(key Key) {
+	h1, h2 := bloomHash(key)
+	m := uint32(len(bf) * 8)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		bf[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (bf bloomFilter) mayContain(key Key) bool {
+	if len(bf) == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	m := uint32(len(bf) * 8)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if bf[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
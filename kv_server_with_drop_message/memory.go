@@ -0,0 +1,112 @@
+package kv_server_with_stable_network
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A KVServer can limit the memory its keys take, counted as the bytes
+// of the keys and their values. When a write would take the server
+// over its limit, the server either rejects the write with ErrFull, or
+// evicts the least recently used keys until the keys fit again; a Get
+// or a write of a key counts as a use. A key that is bigger than the
+// limit by itself is always rejected. An eviction is a delete like any
+// other, logged and replicated along with the write that caused it,
+// and a server with a limit takes kv.mu exclusively for every request
+// so that it can evict keys of any stripe.
+
+type MemoryPolicy int
+
+const (
+	RejectWhenFull MemoryPolicy = iota
+	EvictLRU
+)
+
+type lruList struct {
+	mu    sync.Mutex
+	order *list.List // of Key, the most recently used first
+	elems map[Key]*list.Element
+}
+
+func makeLRU() *lruList {
+	return &lruList{order: list.New(), elems: make(map[Key]*list.Element)}
+}
+
+func (l *lruList) touch(key Key) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+	} else {
+		l.elems[key] = l.order.PushFront(key)
+	}
+}
+
+func (l *lruList) remove(key Key) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+// oldest returns the least recently used key that isn't in keep.
+func (l *lruList) oldest(keep map[Key]bool) (Key, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		if key := e.Value.(Key); !keep[key] {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func keyBytes(key Key, value Value) int64 {
+	return int64(len(key) + len(value.value))
+}
+
+// touch notes a use of key, for eviction.
+func (kv *KVServer) touch(key Key) {
+	if kv.lru != nil {
+		kv.lru.touch(key)
+	}
+}
+
+// fullL reports whether the server must reject a write that changes
+// the bytes of its keys by delta, and whose own keys take size bytes,
+// which eviction can't free. Caller must hold kv.mu.
+func (kv *KVServer) fullL(delta, size int64) bool {
+	if kv.memLimit == 0 {
+		return false
+	}
+	if size > kv.memLimit {
+		return true
+	}
+	return kv.memPolicy == RejectWhenFull && delta > 0 && kv.bytes.Load()+delta > kv.memLimit
+}
+
+// evictL removes the least recently used keys, but none of keep,
+// until the keys fit in the limit, and returns the keys it removed.
+// Caller must hold kv.mu.
+func (kv *KVServer) evictL(keep ...string) []string {
+	if kv.lru == nil || kv.bytes.Load() <= kv.memLimit {
+		return nil
+	}
+	kept := make(map[Key]bool, len(keep))
+	for _, k := range keep {
+		kept[Key(k)] = true
+	}
+	evicted := []string{}
+	for kv.bytes.Load() > kv.memLimit {
+		key, ok := kv.lru.oldest(kept)
+		if !ok {
+			break
+		}
+		kv.removeL(key)
+		kv.evictions.Add(1)
+		evicted = append(evicted, string(key))
+	}
+	return evicted
+}
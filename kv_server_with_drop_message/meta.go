@@ -0,0 +1,37 @@
+package kv_server_with_stable_network
+
+import "time"
+
+// KeyMeta says when a key was created and last written, in Unix
+// nanoseconds, and which clerk wrote it last, by client id; Writer is
+// 0 if the write came with no client id. A key that is deleted and
+// then created again starts over with a new Created. Replicas stamp
+// the times by their own clocks, so they may differ slightly between
+// replicas.
+type KeyMeta struct {
+	Created  int64
+	Modified int64
+	Writer   int64
+}
+
+// written returns the metadata of a key with metadata m once clientId
+// writes it at now. m is the zero KeyMeta for a new key.
+func (m KeyMeta) written(clientId int64, now time.Time) KeyMeta {
+	if m.Created == 0 {
+		m.Created = now.UnixNano()
+	}
+	m.Modified = now.UnixNano()
+	m.Writer = clientId
+	return m
+}
+
+// GetMeta returns the metadata and version of args.Key, if args.Key
+// exists. Otherwise, GetMeta returns ErrNoKey. It is a Get that
+// leaves out the value, so it goes wherever a Get would.
+func (kv *KVServer) GetMeta(args *GetMetaArgs, reply *GetMetaReply) {
+	get := GetReply{}
+	kv.Get(&GetArgs{Key: args.Key, WithMeta: true, Cred: args.Cred, Namespace: args.Namespace, ClientId: args.ClientId}, &get)
+	reply.Meta = get.Meta
+	reply.Version = get.Version
+	reply.Err = get.Err
+}
@@ -0,0 +1,176 @@
+package kv_server_with_stable_network
+
+import "strings"
+
+// Requests name a namespace, and each namespace is a key space of its
+// own: the same key in two namespaces is two keys, and Scan and
+// ReadChanges see only the keys of the clerk's namespace. The empty
+// namespace is the default, whose keys are stored as they are. The
+// server stores key of namespace ns as nsPrefix + ns + "\x00" + key,
+// so that all layers below the handlers, from the engines to Raft and
+// the backups, see ordinary keys. So that no clerk can reach the keys
+// of another namespace, a namespace must not hold "\x00", and the
+// server rejects with ErrBadKey a key of the default namespace, or a
+// bound of a Scan of it, that sorts at or above nsPrefix; nsPrefix is
+// not valid UTF-8, so it begins no key a clerk would use. ACL rules (see acl.go) match keys
+// as the clerk sees them, in every namespace.
+//
+// A server can limit the keys of a namespace and the bytes they take,
+// counted as the bytes of the keys as the clerk sees them and of their
+// values. It rejects a write that would take a namespace over its
+// quota with ErrQuota. Like a server with a memory limit (see
+// memory.go), a server with quotas takes kv.mu exclusively for every
+// request. In a sharded deployment, each group enforces the quotas on
+// the keys it serves.
+
+const nsPrefix = "\xff"
+
+// Quota limits a namespace; 0 means no limit.
+type Quota struct {
+	Keys  int
+	Bytes int64
+}
+
+type nsUsage struct {
+	keys  int
+	bytes int64
+}
+
+// the quotas of the namespaces that have them, and the usage of every
+// namespace
+type quotaTable struct {
+	quotas map[string]Quota
+	usage  map[string]*nsUsage
+}
+
+func makeQuotaTable(quotas map[string]Quota) *quotaTable {
+	return &quotaTable{quotas: quotas, usage: make(map[string]*nsUsage)}
+}
+
+// nsKey returns the key the server stores for key of namespace ns.
+func nsKey(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return nsPrefix + ns + "\x00" + key
+}
+
+// validKey reports whether a clerk of namespace ns may use key, as a
+// key or as a bound of a Scan.
+func validKey(ns, key string) bool {
+	return !strings.Contains(ns, "\x00") && (ns != "" || key < nsPrefix)
+}
+
+// splitKey returns the namespace and the key of a stored key.
+func splitKey(stored string) (string, string) {
+	if !strings.HasPrefix(stored, nsPrefix) {
+		return "", stored
+	}
+	ns, key, _ := strings.Cut(stored[len(nsPrefix):], "\x00")
+	return ns, key
+}
+
+// add counts value of stored key n times, -1 to uncount it.
+func (t *quotaTable) add(stored Key, value Value, n int) {
+	if t == nil {
+		return
+	}
+	ns, key := splitKey(string(stored))
+	u, ok := t.usage[ns]
+	if !ok {
+		u = &nsUsage{}
+		t.usage[ns] = u
+	}
+	u.keys += n
+	u.bytes += int64(n * (len(key) + len(value.value)))
+	if u.keys == 0 {
+		delete(t.usage, ns)
+	}
+}
+
+func (t *quotaTable) reset() {
+	if t != nil {
+		t.usage = make(map[string]*nsUsage)
+	}
+}
+
+// overQuotaL reports whether setting the stored keys of writes to
+// their new values would take a namespace over its quota. A write
+// that doesn't add keys or bytes is never over. Caller must hold
+// kv.mu.
+func (kv *KVServer) overQuotaL(writes map[Key]string) bool {
+	if kv.quota == nil {
+		return false
+	}
+	added := make(map[string]*nsUsage)
+	for stored, v := range writes {
+		ns, key := splitKey(string(stored))
+		a, ok := added[ns]
+		if !ok {
+			a = &nsUsage{}
+			added[ns] = a
+		}
+		a.bytes += int64(len(key) + len(v))
+		if value, found := kv.valueL(stored); found {
+			a.bytes -= int64(len(key) + len(value.value))
+		} else {
+			a.keys += 1
+		}
+	}
+	for ns, a := range added {
+		q, ok := kv.quota.quotas[ns]
+		if !ok {
+			continue
+		}
+		u := kv.quota.usage[ns]
+		if u == nil {
+			u = &nsUsage{}
+		}
+		if q.Keys > 0 && a.keys > 0 && u.keys+a.keys > q.Keys {
+			return true
+		}
+		if q.Bytes > 0 && a.bytes > 0 && u.bytes+a.bytes > q.Bytes {
+			return true
+		}
+	}
+	return false
+}
+
+// nsScan turns args, a Scan of namespace ns, into a Scan of the
+// stored keys, and returns the prefix to strip from the keys and the
+// token of its reply.
+func nsScan(ns string, args *ScanArgs) string {
+	if ns == "" {
+		// leave out the keys of the other namespaces
+		if args.Prefix == "" && args.End == "" {
+			args.End = nsPrefix
+		}
+		return ""
+	}
+	p := nsKey(ns, "")
+	if args.Prefix != "" {
+		args.Prefix = p + args.Prefix
+	} else {
+		if args.End == "" {
+			args.End = prefixEnd(p)
+		} else {
+			args.End = p + args.End
+		}
+		args.Start = p + args.Start
+	}
+	if args.Token != "" {
+		args.Token = p + args.Token
+	}
+	return p
+}
+
+// stripScan strips prefix p from the keys and token of reply.
+func stripScan(p string, reply *ScanReply) {
+	if p == "" {
+		return
+	}
+	for i := range reply.Entries {
+		reply.Entries[i].Key = strings.TrimPrefix(reply.Entries[i].Key, p)
+	}
+	reply.Token = strings.TrimPrefix(reply.Token, p)
+}
@@ -0,0 +1,542 @@
+package kv_server_with_stable_network
+
+import (
+	"sync"
+	"time"
+)
+
+// Primary-backup replication for a group of KVServers.
+//
+// Servers move through numbered views; the primary of view v is
+// server v % n, and only the primary serves clerks. The primary gives
+// each modifying request the next index, performs it, and forwards
+// the walRecord describing its effect to the backups. It replies to
+// the clerk only once a majority of the group, counting itself, holds
+// the record, so a reply survives the loss of any minority of
+// servers. Reads also wait until a majority confirms the view, so a
+// deposed primary can't return stale values.
+//
+// A backup that doesn't hear from the primary for PrimaryTimeout, and
+// a primary that can't reach a majority, move to the next view. The
+// primary of a new view takes over by collecting the state of a
+// majority, adopting the most recent one (by the view it was synced
+// in, then by index), and installing it on a majority before serving.
+// Since every committed request is held by a majority, and any two
+// majorities overlap, the new primary starts with every committed
+// request. Servers reject messages from views older than theirs.
+//
+// A group needs at least MinPBServers servers: the majority of two
+// servers is both of them, so a group of two would stop serving at its
+// first failure. StartPBKVServer refuses smaller groups.
+
+const MinPBServers = 3
+
+const (
+	HeartbeatInterval = 50 * time.Millisecond
+	PrimaryTimeout    = 500 * time.Millisecond
+	CommitTimeout     = 1 * time.Second
+)
+
+type primaryBackup struct {
+	ends []*ClientEnd // ends[me] is unused
+	me   int
+
+	// serializes client requests at the primary, so that a request
+	// is committed before the next one starts
+	opMu sync.Mutex
+
+	// protected by kv.mu
+	view       int    // the highest view this server has seen
+	syncedView int    // the view whose primary this server's state follows
+	index      uint64 // the index of the last request in this server's state
+	ready      bool   // this server is the primary of view and took over
+	takingOver bool
+	lastHeard  time.Time
+	installing []bool // sending the state to a peer
+}
+
+// The servers of a group send each other their credential (see
+// acl.go) in Cred.
+type ForwardArgs struct {
+	View int
+	Rec  walRecord
+	Cred Credential
+}
+
+// NeedState asks the primary to send its whole state, because the
+// sender missed requests or followed an earlier view.
+type ForwardReply struct {
+	OK        bool
+	View      int
+	NeedState bool
+}
+
+type HeartbeatArgs struct {
+	View  int
+	Index uint64
+	Cred  Credential
+}
+
+type InstallStateArgs struct {
+	View  int
+	Index uint64
+	State []byte
+	Cred  Credential
+}
+
+type InstallStateReply struct {
+	OK   bool
+	View int
+}
+
+type GetStateArgs struct {
+	View int
+	Cred Credential
+}
+
+type GetStateReply struct {
+	OK         bool
+	View       int
+	SyncedView int
+	Index      uint64
+	State      []byte
+}
+
+func makePrimaryBackup(ends []*ClientEnd, me int) *primaryBackup {
+	return &primaryBackup{
+		ends:       ends,
+		me:         me,
+		lastHeard:  time.Now(),
+		installing: make([]bool, len(ends)),
+	}
+}
+
+func (pb *primaryBackup) majority() int {
+	return len(pb.ends)/2 + 1
+}
+
+// primaryL reports whether this server may serve clerks. Caller must
+// hold kv.mu.
+func (kv *KVServer) primaryL() bool {
+	if kv.raft != nil {
+		_, isLeader := kv.raft.rf.GetState()
+		return isLeader
+	}
+	return kv.pb == nil || (kv.pb.view%len(kv.pb.ends) == kv.pb.me && kv.pb.ready)
+}
+
+// startOp admits a client request if this server is a ready primary,
+// and then holds off other requests until endOp.
+func (kv *KVServer) startOp() bool {
+	if kv.pb == nil {
+		return true
+	}
+	kv.pb.opMu.Lock()
+
+	kv.mu.Lock()
+	ok := kv.primaryL()
+	kv.mu.Unlock()
+
+	if !ok {
+		kv.pb.opMu.Unlock()
+	}
+	return ok
+}
+
+func (kv *KVServer) endOp() {
+	if kv.pb != nil {
+		kv.pb.opMu.Unlock()
+	}
+}
+
+// adoptViewL moves this server to view, if it is newer than the
+// current one. Caller must hold kv.mu.
+func (kv *KVServer) adoptViewL(view int) {
+	if view <= kv.pb.view {
+		return
+	}
+	kv.pb.view = view
+	kv.pb.ready = false
+	kv.pb.lastHeard = time.Now()
+	kv.logL(walRecord{View: view})
+	kv.changed.Broadcast()
+}
+
+func (kv *KVServer) adoptView(view int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.adoptViewL(view)
+}
+
+// stepDown gives up view, because this server couldn't reach a
+// majority in it.
+func (kv *KVServer) stepDown(view int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.pb.view == view {
+		kv.adoptViewL(view + 1)
+	}
+}
+
+// quorum calls fn for every peer, in parallel and in rounds, until fn
+// has succeeded for a majority of the group counting this server,
+// view is over, or CommitTimeout passes.
+func (kv *KVServer) quorum(view int, fn func(peer int) bool) bool {
+	pb := kv.pb
+	done := make([]bool, len(pb.ends))
+	done[pb.me] = true
+	deadline := time.Now().Add(CommitTimeout)
+
+	for {
+		kv.mu.Lock()
+		current := pb.view == view
+		kv.mu.Unlock()
+		if !current || kv.killed() {
+			return false
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for peer := range pb.ends {
+			if done[peer] {
+				continue
+			}
+			wg.Add(1)
+			go func(peer int) {
+				defer wg.Done()
+				if fn(peer) {
+					mu.Lock()
+					done[peer] = true
+					mu.Unlock()
+				}
+			}(peer)
+		}
+		wg.Wait()
+
+		n := 0
+		for _, d := range done {
+			if d {
+				n += 1
+			}
+		}
+		if n >= pb.majority() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// replicate returns once a majority holds rec. If that fails, this
+// server steps down and the clerk must retry elsewhere.
+func (kv *KVServer) replicate(rec walRecord) bool {
+	if kv.pb == nil {
+		return true
+	}
+	if kv.quorum(rec.View, func(peer int) bool { return kv.forward(peer, rec) }) {
+		return true
+	}
+	kv.stepDown(rec.View)
+	return false
+}
+
+// confirm returns whether a majority still follows this server as
+// primary, so that what it read is up to date.
+func (kv *KVServer) confirm() bool {
+	if kv.pb == nil {
+		return true
+	}
+	kv.mu.Lock()
+	view := kv.pb.view
+	kv.mu.Unlock()
+
+	if kv.quorum(view, func(peer int) bool { return kv.heartbeat(peer, view) }) {
+		return true
+	}
+	kv.stepDown(view)
+	return false
+}
+
+func (kv *KVServer) forward(peer int, rec walRecord) bool {
+	args := ForwardArgs{View: rec.View, Rec: rec, Cred: kv.serverCred()}
+	reply := ForwardReply{}
+	if !kv.pb.ends[peer].Call("KVServer.Forward", &args, &reply) {
+		return false
+	}
+	if reply.View > rec.View {
+		kv.adoptView(reply.View)
+		return false
+	}
+	if reply.NeedState {
+		// the state includes rec
+		return kv.sendState(peer, rec.View)
+	}
+	return reply.OK
+}
+
+func (kv *KVServer) heartbeat(peer int, view int) bool {
+	kv.mu.Lock()
+	args := HeartbeatArgs{View: view, Index: kv.pb.index, Cred: kv.serverCred()}
+	kv.mu.Unlock()
+
+	reply := ForwardReply{}
+	if !kv.pb.ends[peer].Call("KVServer.Heartbeat", &args, &reply) {
+		return false
+	}
+	if reply.View > view {
+		kv.adoptView(reply.View)
+		return false
+	}
+	if reply.NeedState {
+		kv.spawn(func() { kv.sendState(peer, view) })
+	}
+	return reply.OK
+}
+
+// sendState installs this server's whole state on peer, unless this
+// server has left view or is sending its state to peer already.
+func (kv *KVServer) sendState(peer int, view int) bool {
+	kv.mu.Lock()
+	if kv.pb.view != view || kv.pb.installing[peer] {
+		kv.mu.Unlock()
+		return false
+	}
+	kv.pb.installing[peer] = true
+	args := InstallStateArgs{View: view, Index: kv.pb.index, Cred: kv.serverCred()}
+	state := kv.stateL(false)
+	kv.mu.Unlock()
+	args.State = state.encode()
+
+	defer func() {
+		kv.mu.Lock()
+		kv.pb.installing[peer] = false
+		kv.mu.Unlock()
+	}()
+
+	reply := InstallStateReply{}
+	if !kv.pb.ends[peer].Call("KVServer.InstallState", &args, &reply) {
+		return false
+	}
+	if reply.View > view {
+		kv.adoptView(reply.View)
+		return false
+	}
+	return reply.OK
+}
+
+// Forward performs a request that the primary of args.View performed.
+func (kv *KVServer) Forward(args *ForwardArgs, reply *ForwardReply) {
+	if !kv.enter() {
+		return
+	}
+	defer kv.exit()
+	if kv.pb == nil || !kv.authorizeServer(&args.Cred) {
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	pb := kv.pb
+	if args.View < pb.view {
+		reply.View = pb.view
+		return
+	}
+	kv.adoptViewL(args.View)
+	pb.lastHeard = time.Now()
+	reply.View = pb.view
+
+	if pb.syncedView == args.View && args.Rec.Index <= pb.index {
+		// a resend of a request this server has already
+		reply.OK = true
+		return
+	}
+	if pb.syncedView != args.View || args.Rec.Index != pb.index+1 {
+		reply.NeedState = true
+		return
+	}
+
+	kv.applyRecordL(args.Rec)
+	kv.logL(args.Rec)
+	reply.OK = true
+}
+
+// Heartbeat tells a backup that the primary of args.View is alive.
+func (kv *KVServer) Heartbeat(args *HeartbeatArgs, reply *ForwardReply) {
+	if !kv.enter() {
+		return
+	}
+	defer kv.exit()
+	if kv.pb == nil || !kv.authorizeServer(&args.Cred) {
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	pb := kv.pb
+	if args.View < pb.view {
+		reply.View = pb.view
+		return
+	}
+	kv.adoptViewL(args.View)
+	pb.lastHeard = time.Now()
+	reply.View = pb.view
+	reply.OK = true
+	reply.NeedState = pb.syncedView != args.View || pb.index < args.Index
+}
+
+// InstallState replaces a backup's state with the primary's.
+func (kv *KVServer) InstallState(args *InstallStateArgs, reply *InstallStateReply) {
+	if !kv.enter() {
+		return
+	}
+	defer kv.exit()
+	if kv.pb == nil || !kv.authorizeServer(&args.Cred) {
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	pb := kv.pb
+	if args.View < pb.view {
+		reply.View = pb.view
+		return
+	}
+	kv.adoptViewL(args.View)
+	pb.lastHeard = time.Now()
+	reply.View = pb.view
+
+	if pb.syncedView != args.View || pb.index < args.Index {
+		kv.loadStateL(args.State)
+		pb.syncedView = args.View
+		pb.index = args.Index
+		kv.compactL()
+	}
+	reply.OK = true
+}
+
+// GetState returns a server's state to the primary of args.View,
+// which is taking over.
+func (kv *KVServer) GetState(args *GetStateArgs, reply *GetStateReply) {
+	if !kv.enter() {
+		return
+	}
+	defer kv.exit()
+	if kv.pb == nil || !kv.authorizeServer(&args.Cred) {
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	pb := kv.pb
+	if args.View < pb.view {
+		reply.View = pb.view
+		return
+	}
+	kv.adoptViewL(args.View)
+	pb.lastHeard = time.Now()
+	reply.View = pb.view
+	reply.OK = true
+	reply.SyncedView = pb.syncedView
+	reply.Index = pb.index
+	reply.State = kv.encodeStateL()
+}
+
+// takeover makes this server, the primary of view, ready to serve.
+func (kv *KVServer) takeover(view int) {
+	pb := kv.pb
+	defer func() {
+		kv.mu.Lock()
+		pb.takingOver = false
+		kv.mu.Unlock()
+	}()
+
+	kv.mu.Lock()
+	if pb.view != view {
+		kv.mu.Unlock()
+		return
+	}
+	best := GetStateReply{SyncedView: pb.syncedView, Index: pb.index}
+	kv.mu.Unlock()
+
+	var mu sync.Mutex
+	ok := kv.quorum(view, func(peer int) bool {
+		args := GetStateArgs{View: view, Cred: kv.serverCred()}
+		reply := GetStateReply{}
+		if !pb.ends[peer].Call("KVServer.GetState", &args, &reply) {
+			return false
+		}
+		if reply.View > view {
+			kv.adoptView(reply.View)
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if reply.SyncedView > best.SyncedView ||
+			(reply.SyncedView == best.SyncedView && reply.Index > best.Index) {
+			best = reply
+		}
+		return reply.OK
+	})
+	if !ok {
+		return
+	}
+
+	kv.mu.Lock()
+	if pb.view != view {
+		kv.mu.Unlock()
+		return
+	}
+	if best.State != nil {
+		kv.loadStateL(best.State)
+	}
+	pb.syncedView = view
+	pb.index = best.Index
+	kv.compactL()
+	kv.mu.Unlock()
+
+	if !kv.quorum(view, func(peer int) bool { return kv.sendState(peer, view) }) {
+		return
+	}
+
+	kv.mu.Lock()
+	if pb.view == view {
+		pb.ready = true
+	}
+	kv.mu.Unlock()
+}
+
+// ticker sends heartbeats from the primary, starts takeovers, and
+// moves backups to the next view when the primary goes quiet.
+func (kv *KVServer) ticker() {
+	pb := kv.pb
+	for {
+		select {
+		case <-kv.stop:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+
+		kv.mu.Lock()
+		view := pb.view
+		primary := view%len(pb.ends) == pb.me
+		if primary && pb.ready {
+			for peer := range pb.ends {
+				if peer != pb.me {
+					kv.spawn(func() { kv.heartbeat(peer, view) })
+				}
+			}
+		} else if primary && !pb.takingOver {
+			pb.takingOver = true
+			kv.spawn(func() { kv.takeover(view) })
+		} else if !primary && time.Since(pb.lastHeard) > PrimaryTimeout {
+			kv.adoptViewL(view + 1)
+		}
+		kv.mu.Unlock()
+	}
+}
@@ -0,0 +1,362 @@
+package kv_server_with_stable_network
+
+import (
+	"bytes"
+	"log"
+	"slices"
+)
+
+// A KVServer persists its state as a snapshot of all keys and clerks,
+// followed by a log of the requests performed since the snapshot. The
+// log goes where a Raft server would keep its Raft state. Each request
+// appends one walRecord to it with Persister.Append before the server
+// replies, and once the log outgrows the snapshot the server writes a
+// fresh snapshot and starts an empty log. Replay stops at a record
+// that doesn't decode, which is what a crash during an Append leaves.
+
+// the log may always grow to at least this many bytes before the
+// server compacts it into a snapshot
+const MinCompactBytes = 1 << 20
+
+// A key as it is persisted. Expires is in Unix nanoseconds, 0 if the
+// key never expires.
+type persistedValue struct {
+	Key     string
+	Value   string
+	Version Tversion
+	Expires int64
+	Meta    KeyMeta
+}
+
+// The keys a request changed, as they are after the request, and the
+// reply the server remembers for the clerk that sent it. A replicated
+// server also logs the view and position of the request in the
+// primary's order of requests; see pb.go. Shards holds the shards
+// whose ownership the request changed, and Clients and History the
+// clerks and the past versions of keys that a shard brought along;
+// see shard.go.
+type walRecord struct {
+	Values   []persistedValue
+	Deleted  []string
+	ClientId int64
+	Last     lastReply
+	View     int
+	Index    uint64
+	Shards   []ShardInfo
+	Clients  map[int64]lastReply
+	History  []persistedPast
+}
+
+// View, SyncedView, and Index are as in pb.go; in a Raft group, Index
+// is the Raft log index of the last request in the snapshot. If
+// InEngine is set, Values is empty, and the keys are those that the
+// server's durable engines kept; see lsm.go. History holds the past
+// versions of keys (see history.go), and Changes the changes kept,
+// the last of which is ChangeSeq (see changes.go).
+type kvSnapshot struct {
+	Values     []persistedValue
+	History    []persistedPast
+	Changes    []Change
+	ChangeSeq  uint64
+	Clients    map[int64]lastReply
+	View       int
+	SyncedView int
+	Index      uint64
+	Shards     []ShardInfo
+	InEngine   bool
+}
+
+func makePersistedValue(key Key, value Value) persistedValue {
+	return persistedValue{
+		Key:     string(key),
+		Value:   value.value,
+		Version: value.version,
+		Expires: unixNano(value.expires),
+		Meta:    value.meta,
+	}
+}
+
+func (kv *KVServer) installL(pv persistedValue) {
+	key := Key(pv.Key)
+	if _, found := kv.valueL(key); !found {
+		kv.index.insert(key)
+	}
+	value := Value{
+		value:   pv.Value,
+		version: pv.Version,
+		expires: fromUnixNano(pv.Expires),
+		meta:    pv.Meta,
+	}
+	kv.setValueL(key, value)
+	kv.changed.Broadcast()
+}
+
+// recordL describes the request of clientId that changed keys. On a
+// replicated server the request gets the next position in the order
+// of requests. Caller must hold kv.mu, or kv.mu shared and the
+// stripes of clientId and keys.
+func (kv *KVServer) recordL(clientId int64, keys ...string) walRecord {
+	rec := walRecord{ClientId: clientId}
+	for _, k := range keys {
+		if value, found := kv.valueL(Key(k)); found {
+			rec.Values = append(rec.Values, makePersistedValue(Key(k), value))
+		} else {
+			rec.Deleted = append(rec.Deleted, k)
+		}
+	}
+	if last, ok := kv.clientL(clientId); ok {
+		rec.Last = *last
+	}
+	if kv.pb != nil {
+		kv.pb.index += 1
+		rec.View = kv.pb.view
+		rec.Index = kv.pb.index
+	}
+	return rec
+}
+
+// applyRecordL performs rec on this server. Caller must hold kv.mu.
+func (kv *KVServer) applyRecordL(rec walRecord) {
+	for _, pv := range rec.Values {
+		kv.installL(pv)
+	}
+	for _, k := range rec.Deleted {
+		if _, found := kv.valueL(Key(k)); found {
+			kv.removeL(Key(k))
+		}
+	}
+	if rec.ClientId != 0 {
+		last := rec.Last
+		kv.setClientL(rec.ClientId, &last)
+	}
+	kv.mergeClientsL(rec.Clients)
+	kv.loadHistoryL(rec.History)
+	for _, info := range rec.Shards {
+		kv.setShardL(info)
+	}
+	if kv.pb != nil {
+		if rec.View > kv.pb.view {
+			kv.pb.view = rec.View
+		}
+		if rec.Index > 0 {
+			kv.pb.syncedView = rec.View
+			kv.pb.index = rec.Index
+		}
+	}
+}
+
+// persistL logs that the request of clientId changed keys, and
+// returns the record it logged. Caller must hold kv.mu, or kv.mu
+// shared and the stripes of clientId and keys.
+func (kv *KVServer) persistL(clientId int64, keys ...string) walRecord {
+	rec := kv.recordL(clientId, keys...)
+	kv.logL(rec)
+	return rec
+}
+
+// logL appends rec, and only rec, to the log, and then commits the keys of rec to
+// durable engines. If the log has grown too big, it marks it for
+// compaction by the next maybeCompact, since compacting needs kv.mu
+// exclusively. Caller must hold kv.mu, or kv.mu shared and the
+// stripes of the keys of rec for writing.
+func (kv *KVServer) logL(rec walRecord) {
+	if kv.persister == nil {
+		kv.addChangesL(rec)
+		kv.commitL(rec.Deleted)
+		kv.commitL(keysOf(rec.Values))
+		return
+	}
+
+	kv.walMu.Lock()
+	defer kv.walMu.Unlock()
+	defer kv.commitL(keysOf(rec.Values))
+	defer kv.commitL(rec.Deleted)
+
+	kv.addChangesL(rec)
+	if err := kv.walEnc.Encode(rec); err != nil {
+		log.Fatalf("[Server->logL]: encode %v", err)
+	}
+	kv.persister.Append(kv.wal.Bytes())
+	kv.walSize += kv.wal.Len()
+	kv.wal.Reset()
+
+	if kv.walSize > max(MinCompactBytes, len(kv.snapshot)) {
+		kv.compactDue.Store(true)
+	}
+}
+
+// maybeCompact compacts the log if logL asked for it. Caller must not
+// hold kv.mu.
+func (kv *KVServer) maybeCompact() {
+	if !kv.compactDue.Load() {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.compactDue.Load() {
+		kv.compactL()
+	}
+}
+
+func keysOf(values []persistedValue) []string {
+	keys := make([]string, len(values))
+	for i, pv := range values {
+		keys[i] = pv.Key
+	}
+	return keys
+}
+
+// encodeStateL returns a snapshot of all keys and clerks. Caller must
+// hold kv.mu.
+func (kv *KVServer) encodeStateL() []byte {
+	return kv.encodeSnapshotL(false)
+}
+
+// encodeSnapshotL is encodeStateL, but leaves out the keys if
+// inEngine is set.
+func (kv *KVServer) encodeSnapshotL(inEngine bool) []byte {
+	return kv.stateL(inEngine).encode()
+}
+
+// A pendingState is a snapshot of a server's state that hasn't been
+// encoded yet: it holds copies of the engines, rather than the keys,
+// so that the server can encode it without kv.mu.
+type pendingState struct {
+	snap    kvSnapshot
+	engines []Engine
+}
+
+// stateL copies the server's state for encodeSnapshotL. Caller must
+// hold kv.mu.
+func (kv *KVServer) stateL(inEngine bool) *pendingState {
+	ps := &pendingState{snap: kvSnapshot{
+		Clients:  make(map[int64]lastReply, kv.nclientsL()),
+		InEngine: inEngine,
+	}}
+	snap := &ps.snap
+	if !inEngine {
+		ps.engines = kv.snapshotL()
+	}
+	kv.forEachClientL(func(id int64, last *lastReply) {
+		snap.Clients[id] = *last
+	})
+	snap.History = kv.historyL()
+	snap.Changes, snap.ChangeSeq = kv.changes.snapshot()
+	snap.Shards = slices.Clone(kv.shards)
+	if kv.pb != nil {
+		snap.View = kv.pb.view
+		snap.SyncedView = kv.pb.syncedView
+		snap.Index = kv.pb.index
+	}
+	if kv.raft != nil {
+		snap.Index = uint64(kv.raft.lastApplied)
+	}
+	return ps
+}
+
+func (ps *pendingState) encode() []byte {
+	snap := ps.snap
+	if !snap.InEngine {
+		forEach(ps.engines, func(key Key, value Value) {
+			snap.Values = append(snap.Values, makePersistedValue(key, value))
+		})
+	}
+
+	w := new(bytes.Buffer)
+	if err := NewEncoder(w).Encode(snap); err != nil {
+		log.Fatalf("[Server->encodeStateL]: encode %v", err)
+	}
+	return w.Bytes()
+}
+
+// loadStateL replaces all keys and clerks with those in a snapshot
+// from encodeStateL. Caller must hold kv.mu.
+func (kv *KVServer) loadStateL(data []byte) {
+	snap := kvSnapshot{}
+	if err := NewDecoder(bytes.NewBuffer(data)).Decode(&snap); err != nil {
+		log.Fatalf("[Server->loadStateL]: decode snapshot %v", err)
+	}
+
+	if snap.InEngine {
+		kv.reloadL()
+	} else {
+		kv.resetL()
+	}
+	for _, pv := range snap.Values {
+		kv.installL(pv)
+	}
+	kv.loadHistoryL(snap.History)
+	kv.changes.reset(snap.Changes, snap.ChangeSeq)
+	for id, last := range snap.Clients {
+		last := last
+		kv.setClientL(id, &last)
+	}
+	kv.shards = snap.Shards
+	if kv.pb != nil {
+		kv.pb.view = max(kv.pb.view, snap.View)
+		kv.pb.syncedView = snap.SyncedView
+		kv.pb.index = snap.Index
+	}
+	if kv.raft != nil {
+		kv.raft.lastApplied = int(snap.Index)
+	}
+	kv.changed.Broadcast()
+}
+
+// compactL replaces the snapshot with one of the current state and
+// empties the log. With durable engines, the snapshot leaves out the
+// keys, which the engines have on disk once synced. Caller must hold
+// kv.mu.
+func (kv *KVServer) compactL() {
+	if kv.persister == nil {
+		return
+	}
+
+	kv.compactDue.Store(false)
+	if kv.durable() {
+		if !kv.syncL() {
+			return
+		}
+		kv.snapshot = kv.encodeSnapshotL(true)
+	} else {
+		kv.snapshot = kv.encodeStateL()
+	}
+
+	// a new encoder, since the empty log must start with the types
+	// of the records again
+	kv.wal.Reset()
+	kv.walEnc = NewEncoder(kv.wal)
+	kv.walSize = 0
+
+	kv.persister.Save(nil, kv.snapshot)
+}
+
+// restoreL loads the snapshot and replays the log saved in
+// persister, and then compacts them, so that this server never
+// appends to a log that an earlier incarnation might still be using.
+// Caller must hold kv.mu.
+func (kv *KVServer) restoreL(persister *Persister) {
+	kv.persister = persister
+	kv.wal = new(bytes.Buffer)
+	kv.walEnc = NewEncoder(kv.wal)
+
+	if data := persister.ReadSnapshot(); len(data) > 0 {
+		kv.loadStateL(data)
+	} else {
+		kv.resetL()
+	}
+
+	if data := persister.ReadRaftState(); len(data) > 0 {
+		dec := NewDecoder(bytes.NewBuffer(data))
+		for {
+			rec := walRecord{}
+			if err := dec.Decode(&rec); err != nil {
+				break
+			}
+			kv.applyRecordL(rec)
+			kv.addChangesL(rec)
+		}
+	}
+
+	kv.compactL()
+}
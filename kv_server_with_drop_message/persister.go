@@ -2,21 +2,122 @@ package kv_server_with_stable_network
 
 import "sync"
 
+// Persister holds the state a server must keep across restarts.
+// Save and the Read methods don't copy the byte slices they get or
+// return, so callers must not modify them afterwards; appending to a
+// saved slice is fine, since it doesn't change the saved bytes. A
+// server that keeps a log in the raft state can Append to it instead
+// of saving all of it again.
 type Persister struct {
 	mu        sync.Mutex
 	raftstate []byte
 	snapshot  []byte
+	retired   bool // superseded by a Copy
+
+	// set for a file-backed persister; see filepersister.go
+	files *persisterFiles
 }
 
+// Copy returns a persister with the same state, and from then on Save
+// on ps no longer affects the copy. A copy of a file-backed persister
+// takes over its files, and ps stops writing them.
 func (ps *Persister) Copy() *Persister {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
+	ps.retired = true
 	np := MakePersister()
-	np.raftstate = ps.raftstate
+	np.raftstate = ps.raftstate[:len(ps.raftstate):len(ps.raftstate)]
 	np.snapshot = ps.snapshot
+	if ps.files != nil {
+		np.files = ps.files.handOver()
+	}
 	return np
 }
 
+// retire stops ps from saving, as Copy does, for a server whose
+// successor reads the state from ps's files rather than from a copy.
+func (ps *Persister) retire() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.retired = true
+	if ps.files != nil {
+		ps.files.retire()
+	}
+}
+
 func MakePersister() *Persister {
 	return &Persister{}
 }
+
+// Retired reports whether ps was copied, which happens when its server
+// is shut down. What the server saves from then on is lost, so it must
+// not make anything else durable either, such as a storage engine's
+// files.
+func (ps *Persister) Retired() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.retired
+}
+
+func (ps *Persister) ReadRaftState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// capped, so that appending to it can't overwrite what Append
+	// adds later
+	return ps.raftstate[:len(ps.raftstate):len(ps.raftstate)]
+}
+
+func (ps *Persister) RaftStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.raftstate)
+}
+
+// Save both Raft state and K/V snapshot as a single atomic action,
+// to help avoid them getting out of sync.
+func (ps *Persister) Save(raftstate []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.files != nil {
+		ps.files.save(raftstate, snapshot, !sameSlice(snapshot, ps.snapshot))
+	}
+	ps.raftstate = raftstate[:len(raftstate):len(raftstate)]
+	ps.snapshot = snapshot
+}
+
+// Append adds data to the end of the raft state, leaving the snapshot
+// as it is. A copied persister ignores Append, as it does Save for
+// its files.
+func (ps *Persister) Append(data []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.retired {
+		return
+	}
+	if ps.files != nil {
+		ps.files.append(data, ps.snapshot)
+	}
+	ps.raftstate = append(ps.raftstate, data...)
+}
+
+// sameSlice reports whether a and b are the same bytes in memory, which
+// for a snapshot means it hasn't changed, since callers don't modify
+// the slices they save.
+func sameSlice(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+func (ps *Persister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.snapshot
+}
+
+func (ps *Persister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.snapshot)
+}
@@ -58,6 +58,44 @@ func Put(cfg *Config, ck IKVClerk, key string, value string, version Tversion, l
 	return err
 }
 
+func Delete(cfg *Config, ck IKVClerk, key string, version Tversion, log *OpLog, cli int) Err {
+	start := int64(time.Since(t0))
+	err := ck.Delete(key, version)
+	end := int64(time.Since(t0))
+	cfg.Op()
+	if log != nil {
+		log.Append(porcupine.Operation{
+			Input:    KvInput{Op: 2, Key: key, Version: uint64(version)},
+			Output:   KvOutput{Err: string(err)},
+			Call:     start,
+			Return:   end,
+			ClientId: cli,
+		})
+	}
+	return err
+}
+
+func MultiPut(cfg *Config, ck IKVClerk, ops []PutOp, log *OpLog, cli int) ([]Conflict, Err) {
+	start := int64(time.Since(t0))
+	conflicts, err := ck.MultiPut(ops)
+	end := int64(time.Since(t0))
+	cfg.Op()
+	if log != nil {
+		puts := make([]KvInput, len(ops))
+		for i, op := range ops {
+			puts[i] = KvInput{Op: 1, Key: op.Key, Value: op.Value, Version: uint64(op.Version)}
+		}
+		log.Append(porcupine.Operation{
+			Input:    KvInput{Op: 3, Puts: puts},
+			Output:   KvOutput{Err: string(err)},
+			Call:     start,
+			Return:   end,
+			ClientId: cli,
+		})
+	}
+	return conflicts, err
+}
+
 // Checks that the log of Clerk.Put's and Clerk.Get's is linearizable (see
 // linearizability-faq.txt)
 func checkPorcupine(t *testing.T, opLog *OpLog, nsec time.Duration) {
@@ -0,0 +1,623 @@
+package kv_server_with_stable_network
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Raft consensus, as in the extended Raft paper, with log compaction
+// through snapshots. A service calls Start() to add a command to the
+// log, and Raft sends each committed command, in log order, on the
+// applyCh passed to MakeRaft(). The service hands Raft a snapshot of
+// its state with Snapshot(), and Raft then discards the log up to
+// that point; a follower that falls behind the discarded part gets
+// the snapshot instead, also through applyCh.
+
+const (
+	RaftHeartbeat      = 100 * time.Millisecond
+	ElectionTimeoutMin = 400 * time.Millisecond
+	ElectionTimeoutMax = 800 * time.Millisecond
+)
+
+// A message on applyCh carries either a committed command or a
+// snapshot from the leader that replaces the service's state.
+type ApplyMsg struct {
+	CommandValid bool
+	Command      interface{}
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
+}
+
+type LogEntry struct {
+	Term    int
+	Command interface{}
+}
+
+type raftRole int
+
+const (
+	follower raftRole = iota
+	candidate
+	leader
+)
+
+type Raft struct {
+	mu        sync.Mutex
+	peers     []*ClientEnd // peers[me] is unused
+	persister *Persister
+	me        int
+	dead      int32
+
+	// persistent
+	currentTerm int
+	votedFor    int // -1 if none
+	// log[0] stands for the last entry in the snapshot, at index
+	// lastIncluded; it holds only that entry's term
+	log          []LogEntry
+	lastIncluded int
+	snapshot     []byte
+
+	commitIndex int
+	lastApplied int
+	// the snapshot must go on applyCh before any further command
+	snapshotPending bool
+
+	role             raftRole
+	electionDeadline time.Time
+	votes            int
+	nextIndex        []int
+	matchIndex       []int
+
+	applyCh   chan ApplyMsg
+	applyCond *sync.Cond
+
+	// runs Raft's goroutines; see MakeRaft
+	spawn func(fn func())
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// On failure, XTerm is the term of the follower's entry at
+// PrevLogIndex and XIndex the first index of that term in its log, or
+// XTerm is -1 and XLen the length of its log, if the log is too short.
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderId     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	XTerm   int
+	XIndex  int
+	XLen    int
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// MakeRaft starts server me of the peers, restoring the state saved
+// in persister. Raft runs each of its goroutines with spawn, so that
+// the service can wait for them when it shuts down; spawn may drop
+// the goroutines it is given once Kill is called.
+func MakeRaft(peers []*ClientEnd, me int, persister *Persister, applyCh chan ApplyMsg, spawn func(fn func())) *Raft {
+	rf := &Raft{
+		peers:     peers,
+		persister: persister,
+		me:        me,
+		votedFor:  -1,
+		log:       []LogEntry{{}},
+		applyCh:   applyCh,
+		spawn:     spawn,
+	}
+	rf.applyCond = sync.NewCond(&rf.mu)
+
+	rf.readPersist(persister.ReadRaftState())
+	rf.snapshot = persister.ReadSnapshot()
+	rf.commitIndex = rf.lastIncluded
+	rf.lastApplied = rf.lastIncluded
+	rf.resetElectionTimerL()
+
+	rf.spawn(rf.ticker)
+	rf.spawn(rf.applier)
+
+	return rf
+}
+
+func (rf *Raft) lastIndex() int {
+	return rf.lastIncluded + len(rf.log) - 1
+}
+
+func (rf *Raft) termAt(index int) int {
+	return rf.log[index-rf.lastIncluded].Term
+}
+
+// GetState returns the current term and whether this server believes
+// it is the leader.
+func (rf *Raft) GetState() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.currentTerm, rf.role == leader
+}
+
+func (rf *Raft) persistL() {
+	w := new(bytes.Buffer)
+	enc := NewEncoder(w)
+	if enc.Encode(rf.currentTerm) != nil ||
+		enc.Encode(rf.votedFor) != nil ||
+		enc.Encode(rf.lastIncluded) != nil ||
+		enc.Encode(rf.log) != nil {
+		log.Fatalf("[Raft->persistL]: encode failed")
+	}
+	rf.persister.Save(w.Bytes(), rf.snapshot)
+}
+
+func (rf *Raft) readPersist(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	dec := NewDecoder(bytes.NewBuffer(data))
+	var term, votedFor, lastIncluded int
+	var entries []LogEntry
+	if dec.Decode(&term) != nil ||
+		dec.Decode(&votedFor) != nil ||
+		dec.Decode(&lastIncluded) != nil ||
+		dec.Decode(&entries) != nil {
+		log.Fatalf("[Raft->readPersist]: decode failed")
+	}
+	rf.currentTerm = term
+	rf.votedFor = votedFor
+	rf.lastIncluded = lastIncluded
+	rf.log = entries
+}
+
+// Start adds command to the log if this server is the leader, and
+// returns the index it will have if it is ever committed, the current
+// term, and whether this server is the leader. Start doesn't wait for
+// the command to commit.
+func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.role != leader || rf.killed() {
+		return -1, rf.currentTerm, false
+	}
+
+	rf.log = append(rf.log, LogEntry{Term: rf.currentTerm, Command: command})
+	rf.persistL()
+	rf.matchIndex[rf.me] = rf.lastIndex()
+	rf.broadcastL()
+
+	return rf.lastIndex(), rf.currentTerm, true
+}
+
+// Snapshot tells Raft that snapshot holds the service's state after
+// applying every command up to and including index, so Raft may
+// discard that part of the log.
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if index <= rf.lastIncluded || index > rf.lastApplied {
+		return
+	}
+	log := make([]LogEntry, 0, rf.lastIndex()-index+1)
+	log = append(log, LogEntry{Term: rf.termAt(index)})
+	log = append(log, rf.log[index-rf.lastIncluded+1:]...)
+	rf.log = log
+	rf.lastIncluded = index
+	rf.snapshot = snapshot
+	rf.persistL()
+}
+
+func (rf *Raft) Kill() {
+	atomic.StoreInt32(&rf.dead, 1)
+	rf.mu.Lock()
+	rf.applyCond.Broadcast()
+	rf.mu.Unlock()
+}
+
+func (rf *Raft) killed() bool {
+	return atomic.LoadInt32(&rf.dead) == 1
+}
+
+func (rf *Raft) resetElectionTimerL() {
+	timeout := ElectionTimeoutMin + time.Duration(rand.Int63n(int64(ElectionTimeoutMax-ElectionTimeoutMin)))
+	rf.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollowerL moves to a newer term. Caller must hold rf.mu and
+// persist.
+func (rf *Raft) becomeFollowerL(term int) {
+	rf.currentTerm = term
+	rf.votedFor = -1
+	rf.role = follower
+}
+
+func (rf *Raft) ticker() {
+	for !rf.killed() {
+		rf.mu.Lock()
+		isLeader := rf.role == leader
+		if isLeader {
+			rf.broadcastL()
+		} else if time.Now().After(rf.electionDeadline) {
+			rf.startElectionL()
+		}
+		rf.mu.Unlock()
+
+		if isLeader {
+			time.Sleep(RaftHeartbeat)
+		} else {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func (rf *Raft) startElectionL() {
+	rf.currentTerm += 1
+	rf.role = candidate
+	rf.votedFor = rf.me
+	rf.votes = 1
+	rf.persistL()
+	rf.resetElectionTimerL()
+
+	args := RequestVoteArgs{
+		Term:         rf.currentTerm,
+		CandidateId:  rf.me,
+		LastLogIndex: rf.lastIndex(),
+		LastLogTerm:  rf.termAt(rf.lastIndex()),
+	}
+	for peer := range rf.peers {
+		if peer != rf.me {
+			rf.spawn(func() { rf.requestVote(peer, &args) })
+		}
+	}
+}
+
+func (rf *Raft) requestVote(peer int, args *RequestVoteArgs) {
+	reply := RequestVoteReply{}
+	if !rf.peers[peer].Call("Raft.RequestVote", args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollowerL(reply.Term)
+		rf.persistL()
+		return
+	}
+	if rf.role != candidate || rf.currentTerm != args.Term || !reply.VoteGranted {
+		return
+	}
+	rf.votes += 1
+	if rf.votes > len(rf.peers)/2 {
+		rf.role = leader
+		rf.nextIndex = make([]int, len(rf.peers))
+		rf.matchIndex = make([]int, len(rf.peers))
+		for i := range rf.peers {
+			rf.nextIndex[i] = rf.lastIndex() + 1
+		}
+		rf.matchIndex[rf.me] = rf.lastIndex()
+		rf.broadcastL()
+	}
+}
+
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollowerL(args.Term)
+		rf.persistL()
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+
+	lastTerm := rf.termAt(rf.lastIndex())
+	upToDate := args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= rf.lastIndex())
+	if (rf.votedFor == -1 || rf.votedFor == args.CandidateId) && upToDate {
+		rf.votedFor = args.CandidateId
+		rf.persistL()
+		rf.resetElectionTimerL()
+		reply.VoteGranted = true
+	}
+}
+
+// broadcastL sends every follower the entries it is missing, or the
+// snapshot if the log no longer holds them. Caller must hold rf.mu.
+func (rf *Raft) broadcastL() {
+	for peer := range rf.peers {
+		if peer != rf.me {
+			rf.sendL(peer)
+		}
+	}
+}
+
+func (rf *Raft) sendL(peer int) {
+	next := rf.nextIndex[peer]
+	if next <= rf.lastIncluded {
+		args := InstallSnapshotArgs{
+			Term:              rf.currentTerm,
+			LeaderId:          rf.me,
+			LastIncludedIndex: rf.lastIncluded,
+			LastIncludedTerm:  rf.termAt(rf.lastIncluded),
+			Data:              rf.snapshot,
+		}
+		rf.spawn(func() { rf.installSnapshot(peer, &args) })
+		return
+	}
+
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.me,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  rf.termAt(next - 1),
+		Entries:      append([]LogEntry(nil), rf.log[next-rf.lastIncluded:]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	rf.spawn(func() { rf.appendEntries(peer, &args) })
+}
+
+func (rf *Raft) appendEntries(peer int, args *AppendEntriesArgs) {
+	reply := AppendEntriesReply{}
+	if !rf.peers[peer].Call("Raft.AppendEntries", args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollowerL(reply.Term)
+		rf.persistL()
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = match
+			rf.advanceCommitL()
+		}
+		rf.nextIndex[peer] = max(rf.nextIndex[peer], match+1)
+		return
+	}
+
+	if reply.XTerm == -1 {
+		rf.nextIndex[peer] = reply.XLen
+	} else {
+		next := reply.XIndex
+		for i := rf.lastIndex(); i > rf.lastIncluded; i-- {
+			if rf.termAt(i) == reply.XTerm {
+				next = i + 1
+				break
+			}
+		}
+		rf.nextIndex[peer] = next
+	}
+	rf.nextIndex[peer] = max(1, min(rf.nextIndex[peer], rf.lastIndex()+1))
+	rf.sendL(peer)
+}
+
+// advanceCommitL commits the highest entry of the current term that a
+// majority holds. Caller must hold rf.mu.
+func (rf *Raft) advanceCommitL() {
+	for n := rf.lastIndex(); n > rf.commitIndex && rf.termAt(n) == rf.currentTerm; n-- {
+		count := 0
+		for _, m := range rf.matchIndex {
+			if m >= n {
+				count += 1
+			}
+		}
+		if count > len(rf.peers)/2 {
+			rf.commitIndex = n
+			rf.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollowerL(args.Term)
+		rf.persistL()
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+	rf.role = follower
+	rf.resetElectionTimerL()
+
+	if args.PrevLogIndex > rf.lastIndex() {
+		reply.XTerm = -1
+		reply.XLen = rf.lastIndex() + 1
+		return
+	}
+
+	prev, entries := args.PrevLogIndex, args.Entries
+	if prev < rf.lastIncluded {
+		// the snapshot already covers some of the entries
+		if prev+len(entries) <= rf.lastIncluded {
+			reply.Success = true
+			return
+		}
+		entries = entries[rf.lastIncluded-prev:]
+		prev = rf.lastIncluded
+	} else if rf.termAt(prev) != args.PrevLogTerm {
+		reply.XTerm = rf.termAt(prev)
+		i := prev
+		for i > rf.lastIncluded+1 && rf.termAt(i-1) == reply.XTerm {
+			i--
+		}
+		reply.XIndex = i
+		return
+	}
+
+	for i, e := range entries {
+		index := prev + 1 + i
+		if index <= rf.lastIndex() && rf.termAt(index) == e.Term {
+			continue
+		}
+		// drop a conflicting suffix, but never a matching one, since
+		// this RPC may be older than one that appended more
+		rf.log = append(rf.log[:index-rf.lastIncluded], entries[i:]...)
+		rf.persistL()
+		break
+	}
+
+	// an older RPC may carry fewer entries than this follower has
+	// committed since, so never move commitIndex back
+	if commit := min(args.LeaderCommit, prev+len(entries)); commit > rf.commitIndex {
+		rf.commitIndex = commit
+		rf.applyCond.Broadcast()
+	}
+	reply.Success = true
+}
+
+func (rf *Raft) installSnapshot(peer int, args *InstallSnapshotArgs) {
+	reply := InstallSnapshotReply{}
+	if !rf.peers[peer].Call("Raft.InstallSnapshot", args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollowerL(reply.Term)
+		rf.persistL()
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+	rf.matchIndex[peer] = max(rf.matchIndex[peer], args.LastIncludedIndex)
+	rf.nextIndex[peer] = max(rf.nextIndex[peer], args.LastIncludedIndex+1)
+}
+
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollowerL(args.Term)
+		rf.persistL()
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+	rf.role = follower
+	rf.resetElectionTimerL()
+
+	index := args.LastIncludedIndex
+	if index <= rf.commitIndex {
+		// this server has, or will apply, everything in it
+		return
+	}
+
+	if index < rf.lastIndex() && rf.termAt(index) == args.LastIncludedTerm {
+		rf.log = append([]LogEntry{{Term: args.LastIncludedTerm}}, rf.log[index-rf.lastIncluded+1:]...)
+	} else {
+		rf.log = []LogEntry{{Term: args.LastIncludedTerm}}
+	}
+	rf.lastIncluded = index
+	rf.snapshot = args.Data
+	rf.commitIndex = index
+	rf.snapshotPending = true
+	rf.persistL()
+	rf.applyCond.Broadcast()
+}
+
+// applier sends the snapshot and the committed commands on applyCh,
+// in order, and closes applyCh once Raft is killed.
+func (rf *Raft) applier() {
+	defer close(rf.applyCh)
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for {
+		for !rf.killed() && !rf.snapshotPending && rf.lastApplied >= rf.commitIndex {
+			rf.applyCond.Wait()
+		}
+		if rf.killed() {
+			return
+		}
+
+		if rf.snapshotPending {
+			msg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      rf.snapshot,
+				SnapshotTerm:  rf.termAt(rf.lastIncluded),
+				SnapshotIndex: rf.lastIncluded,
+			}
+			rf.snapshotPending = false
+			rf.lastApplied = max(rf.lastApplied, rf.lastIncluded)
+			rf.mu.Unlock()
+			rf.applyCh <- msg
+			rf.mu.Lock()
+			continue
+		}
+
+		msgs := make([]ApplyMsg, 0, rf.commitIndex-rf.lastApplied)
+		for i := rf.lastApplied + 1; i <= rf.commitIndex; i++ {
+			msgs = append(msgs, ApplyMsg{
+				CommandValid: true,
+				Command:      rf.log[i-rf.lastIncluded].Command,
+				CommandIndex: i,
+				CommandTerm:  rf.log[i-rf.lastIncluded].Term,
+			})
+		}
+		rf.lastApplied = rf.commitIndex
+		rf.mu.Unlock()
+		for _, msg := range msgs {
+			rf.applyCh <- msg
+		}
+		rf.mu.Lock()
+	}
+}
@@ -1,5 +1,7 @@
 package kv_server_with_stable_network
 
+import "time"
+
 type Err string
 
 const (
@@ -11,17 +13,45 @@ const (
 	// Err returned by Clerk only
 	ErrMaybe = "ErrMaybe"
 
-	// For future kvraft lab
+	// the write doesn't fit in the server's memory limit
+	ErrFull = "ErrFull"
+
+	// the version asked for is no longer kept
+	ErrCompacted = "ErrCompacted"
+
+	// a restore into a server that already holds keys
+	ErrNotEmpty = "ErrNotEmpty"
+
+	// the clerk's credential doesn't allow the request; see acl.go
+	ErrPermission = "ErrPermission"
+
+	// the server is over its rate limit or in-flight cap; see limit.go
+	ErrBusy = "ErrBusy"
+
+	// the write would take its namespace over quota; see namespace.go
+	ErrQuota = "ErrQuota"
+
+	// a key or namespace that clerks may not use; see namespace.go
+	ErrBadKey = "ErrBadKey"
+
+	// a replica that isn't the leader (or primary) of its group
 	ErrWrongLeader = "ErrWrongLeader"
-	ErrWrongGroup  = "ErrWrongGroup"
+	// For future shardkv lab
+	ErrWrongGroup = "ErrWrongGroup"
 )
 
 type Tversion uint64
 
 type PutArgs struct {
-	Key     string
-	Value   string
-	Version Tversion
+	Key       string
+	Value     string
+	Version   Tversion
+	TTL       time.Duration // 0 means the key never expires
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+	Seq      uint64
 }
 
 type PutReply struct {
@@ -29,11 +59,196 @@ type PutReply struct {
 }
 
 type GetArgs struct {
-	Key string
+	Key       string
+	AtVersion Tversion // 0 means the current version
+	WithMeta  bool     // also return the key's metadata; see meta.go
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
 }
 
 type GetReply struct {
 	Value   string
 	Version Tversion
+	Meta    KeyMeta
+	Err     Err
+}
+
+type GetMetaArgs struct {
+	Key       string
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+}
+
+type GetMetaReply struct {
+	Meta    KeyMeta
+	Version Tversion
+	Err     Err
+}
+
+type DeleteArgs struct {
+	Key       string
+	Version   Tversion
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+	Seq      uint64
+}
+
+type DeleteReply struct {
+	Err Err
+}
+
+// One conditional put inside a MultiPut.
+type PutOp struct {
+	Key     string
+	Value   string
+	Version Tversion
+}
+
+// A key whose version didn't match in a MultiPut. Version is the
+// version of the key at the server, or 0 if it doesn't exist.
+type Conflict struct {
+	Key     string
+	Version Tversion
+	Err     Err
+}
+
+type MultiPutArgs struct {
+	Ops       []PutOp
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+	Seq      uint64
+}
+
+type MultiPutReply struct {
+	Err       Err
+	Conflicts []Conflict
+}
+
+// Scan returns the keys in [Start, End) in lexicographic order; an
+// empty End means no upper bound. If Prefix is set, Scan returns the
+// keys with that prefix instead. Token continues an earlier Scan.
+type ScanArgs struct {
+	Start     string
+	End       string
+	Prefix    string
+	Limit     int
+	Token     string
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+}
+
+type ScanEntry struct {
+	Key     string
+	Value   string
+	Version Tversion
+}
+
+// Token is empty if there are no more keys in the range
+type ScanReply struct {
+	Entries []ScanEntry
+	Token   string
+	Err     Err
+}
+
+// Watch replies with a GetReply once the version of Key differs from
+// Version, or once Timeout passes.
+type WatchArgs struct {
+	Key       string
+	Version   Tversion
+	Timeout   time.Duration
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+}
+
+type ReadChangesArgs struct {
+	After     uint64
+	Max       int
+	Wait      time.Duration
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+}
+
+// Last is the number of the server's last change; a reply without
+// changes has read all changes up to it.
+type ReadChangesReply struct {
+	Changes []Change
+	Last    uint64
+	Err     Err
+}
+
+// A key in a dump; see admin.go.
+type DumpEntry struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	Version   Tversion `json:"version"`
+}
+
+type DumpArgs struct {
+	Id     int64 // 0 to start a new dump
+	Offset int
+	Cred   Credential
+
+	ClientId int64
+}
+
+type DumpReply struct {
+	Id      int64
+	Entries []DumpEntry
+	Done    bool // the last page
 	Err     Err
 }
+
+type RestoreArgs struct {
+	Entries []DumpEntry
+	Fresh   bool // the server must hold no live keys in the namespaces of Entries
+	Cred    Credential
+
+	ClientId int64
+	Seq      uint64
+}
+
+type RestoreReply struct {
+	Err Err
+}
+
+type StatsArgs struct {
+	Hot       int // the number of hot keys to return
+	Cred      Credential
+	Namespace string
+
+	ClientId int64
+}
+
+// Keys counts the live keys of the clerk's namespace, Bytes the bytes
+// of those keys and their values, and ValueBytes those of the values
+// alone; Limit is 0 if the server has no memory limit. See memory.go,
+// and stats.go for the rest.
+type StatsReply struct {
+	Keys       int
+	ValueBytes int64
+	Bytes      int64
+	Limit      int64
+	Evictions  int64
+	Gets       OpCounts
+	Puts       OpCounts
+	Deletes    OpCounts
+	MultiPuts  OpCounts
+	Watches    OpCounts
+	Hot        []KeyCount
+	Err        Err
+}
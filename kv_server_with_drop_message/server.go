@@ -1,12 +1,23 @@
 package kv_server_with_stable_network
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const Debug = false
 
+// the most entries a single Scan returns
+const MaxScanLimit = 1000
+
+// the longest a single Watch RPC blocks
+const MaxWatchTimeout = 2 * time.Second
+
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug {
 		log.Printf(format, a...)
@@ -19,58 +30,326 @@ type Key string
 type Value struct {
 	value   string
 	version Tversion
+	expires time.Time // zero if the key never expires
+	meta    KeyMeta
 }
 
 type KVServer struct {
-	mu sync.Mutex
+	// see store.go for how mu and the stripes divide the locking
+	mu sync.RWMutex
 
 	// Your definitions here.
-	data map[Key]*Value
+	stripes []stripe
+	index   keyIndex
+
+	// broadcast whenever a key changes, to wake up Watch
+	changed *sync.Cond
+
+	// closed by Kill() to stop the background goroutines
+	stop chan struct{}
+
+	// see Kill; running counts the handlers and goroutines at work,
+	// and killMu orders running.Add before Kill's running.Wait
+	killMu  sync.Mutex
+	dead    atomic.Bool
+	running sync.WaitGroup
+
+	// the last request and reply of each clerk, by client id
+	clientStripes []clientStripe
+
+	// take mu exclusively for every request, as the server did
+	// before it had stripes; for benchmarks
+	singleLock bool
+
+	// see history.go
+	historyPolicy HistoryPolicy
+
+	// see acl.go; nil if the server checks no credentials
+	acl *ACL
+
+	// see limit.go; nil if the server has no limits
+	limiter *rateLimiter
+
+	// see namespace.go; nil if no namespace has a quota
+	quota *quotaTable
+
+	// see stats.go
+	stats *serverStats
+
+	// see changes.go
+	changes changeLog
+
+	// see memory.go; memLimit is 0 if there is no limit, and lru is
+	// nil unless the server evicts keys
+	memLimit  int64
+	memPolicy MemoryPolicy
+	lru       *lruList
+	bytes     atomic.Int64
+	evictions atomic.Int64
+
+	// the bytes of the values alone, for Stats
+	valueBytes atomic.Int64
+
+	// see persist.go; persister is nil if the server doesn't persist
+	persister  *Persister
+	snapshot   []byte
+	walMu      sync.Mutex
+	wal        *bytes.Buffer // the record being encoded
+	walEnc     *LabEncoder
+	walSize    int // bytes in the log
+	compactDue atomic.Bool
+
+	// see pb.go; nil unless the server is a primary-backup replica
+	pb *primaryBackup
+	// see kvraft.go; nil unless the server is a Raft replica
+	raft *raftKV
+
+	// see shard.go; nil unless the server is sharded
+	shards []ShardInfo
 }
 
 func MakeKVServer() *KVServer {
+	return MakeKVServerEngine(MakeMapEngine)
+}
+
+// MakeKVServerEngine makes a KVServer that stores its keys in engines
+// made by mk. The server's goroutines start only once it is started
+// (see startKVServer), so that they see it configured.
+func MakeKVServerEngine(mk EngineMaker) *KVServer {
 	kv := &KVServer{}
 	// Your code here.
 
-	kv.data = make(map[Key]*Value)
+	kv.stripes = makeStripes(mk)
+	kv.resetIndexL()
+	kv.clientStripes = makeClientStripes()
+	kv.changed = sync.NewCond(&kv.mu)
+	kv.stop = make(chan struct{})
+	kv.stats = makeServerStats()
 
 	return kv
 }
 
+// A request is what begin needs to know about a clerk request.
+type request struct {
+	op       int // the kind of request for stats.go, or opNone
+	clientId int64
+	cred     *Credential
+	perm     Perm
+	ns       string
+	keys     []*string // the keys of the request, as the clerk sees them
+	bounds   []string  // the bounds of a Scan
+}
+
+// begin does what every clerk request goes through before its handler
+// performs it: it enters the server (see Kill), admits the request
+// past the limits (see limit.go), checks its keys and namespace and
+// its credential (see namespace.go and acl.go), and turns its keys
+// into the keys the server stores. It returns the function the handler must defer, which
+// counts the reply once the handler has set *err (see stats.go), and
+// reports whether the handler may go on; if not, *err is set.
+func (kv *KVServer) begin(r request, err *Err) (func(), bool) {
+	if !kv.enter() {
+		*err = ErrWrongLeader
+		return func() {}, false
+	}
+	keys := make([]string, len(r.keys))
+	for i, k := range r.keys {
+		keys[i] = *k
+	}
+	admitted := false
+	end := func() {
+		if admitted {
+			kv.limiter.done()
+		}
+		if r.op != opNone {
+			stored := make([]string, len(keys))
+			for i, k := range keys {
+				stored[i] = nsKey(r.ns, k)
+			}
+			kv.stats.count(r.op, err, stored...)
+		}
+		kv.exit()
+	}
+
+	if !kv.limiter.admit(r.clientId) {
+		*err = ErrBusy
+		return end, false
+	}
+	admitted = true
+
+	valid := validKey(r.ns, "")
+	for _, k := range append(keys, r.bounds...) {
+		valid = valid && validKey(r.ns, k)
+	}
+	if !valid {
+		*err = ErrBadKey
+		return end, false
+	}
+
+	if !kv.authorize(r.cred, r.perm, keys...) {
+		*err = ErrPermission
+		return end, false
+	}
+
+	for _, k := range r.keys {
+		*k = nsKey(r.ns, *k)
+	}
+	return end, true
+}
+
+// perform performs op, through Raft on a Raft replica, and otherwise
+// by calling do between startOp and endOp. do sets its reply in *res
+// and reports whether the server may give it, which a primary can't
+// once it has lost its backups. perform reports false if this server
+// can't perform op, and the handler then replies ErrWrongLeader.
+func (kv *KVServer) perform(op Op, do func(res *opResult) bool) (opResult, bool) {
+	if kv.raft != nil {
+		return kv.submit(op)
+	}
+
+	if !kv.startOp() {
+		return opResult{}, false
+	}
+	defer kv.endOp()
+
+	var res opResult
+	ok := do(&res)
+	return res, ok
+}
+
 // Get returns the value and version for args.Key, if args.Key
 // exists. Otherwise, Get returns ErrNoKey.
 func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
 	// Your code here.
+	end, ok := kv.begin(request{op: opGet, clientId: args.ClientId, cred: &args.Cred, perm: PermRead,
+		ns: args.Namespace, keys: []*string{&args.Key}}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+	kv.performGet(args, reply)
+}
 
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
+// performGet performs a Get of a stored key that begin has let
+// through.
+func (kv *KVServer) performGet(args *GetArgs, reply *GetReply) {
+	res, ok := kv.perform(Op{Get: args}, func(res *opResult) bool {
+		kv.get(args, &res.get)
+		return kv.confirm()
+	})
+	if !ok {
+		*reply = GetReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.get
+}
 
-	value, found := kv.data[Key(args.Key)]
+func (kv *KVServer) get(args *GetArgs, reply *GetReply) {
+	kv.lockShared()
+	defer kv.unlockShared()
 
-	if !found {
+	s := kv.stripeOf(Key(args.Key))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	kv.getL(args, reply)
+}
+
+// getL leaves an expired key for the reaper, since the caller may
+// hold only a read lock. Caller must hold kv.mu, or kv.mu shared and
+// the key's stripe.
+func (kv *KVServer) getL(args *GetArgs, reply *GetReply) {
+	if !kv.ownsL(args.Key) {
+		reply.Err = ErrWrongGroup
+		return
+	}
+
+	value, found := kv.valueL(Key(args.Key))
+
+	if !found || value.expired(kv.nowL()) {
 		reply.Err = ErrNoKey
 		return
 	}
+	kv.touch(Key(args.Key))
+
+	if args.AtVersion != 0 && args.AtVersion != value.version {
+		kv.getPastL(args, value.version, reply)
+		return
+	}
 
 	reply.Value = value.value
 	reply.Version = value.version
+	if args.WithMeta {
+		reply.Meta = value.meta
+	}
 	reply.Err = OK
-
-	return
 }
 
 // Update the value for a key if args.Version matches the version of
 // the key on the server. If versions don't match, return ErrVersion.
 // If the key doesn't exist, Put installs the value if the
-// args.Version is 0, and returns ErrNoKey otherwise.
+// args.Version is 0, and returns ErrNoKey otherwise. If args.TTL is
+// set, the key expires that long after the Put; otherwise it never
+// expires.
 func (kv *KVServer) Put(args *PutArgs, reply *PutReply) {
 	// Your code here.
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	end, ok := kv.begin(request{op: opPut, clientId: args.ClientId, cred: &args.Cred, perm: PermWrite,
+		ns: args.Namespace, keys: []*string{&args.Key}}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+
+	res, ok := kv.perform(Op{Put: args}, func(res *opResult) bool {
+		rec, ok := kv.put(args, &res.put)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = PutReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.put
+}
 
+func (kv *KVServer) put(args *PutArgs, reply *PutReply) (walRecord, bool) {
+	defer kv.maybeCompact()
+	defer kv.lockStripes(args.ClientId, Key(args.Key))()
+
+	return kv.putOpL(args, reply)
+}
+
+// putOpL performs a Put and returns the record to replicate, unless
+// the Put is a duplicate.
+// Caller must hold kv.mu, or kv.mu shared and the stripes of the
+// clerk and the key.
+func (kv *KVServer) putOpL(args *PutArgs, reply *PutReply) (walRecord, bool) {
+	if !kv.ownsL(args.Key) {
+		reply.Err = ErrWrongGroup
+		return walRecord{}, false
+	}
+
+	if last, ok := kv.duplicateL(args.ClientId, args.Seq); ok {
+		if last != nil {
+			reply.Err = last.Err
+		}
+		return walRecord{}, false
+	}
+
+	kv.putL(args, reply)
+	kv.rememberL(args.ClientId, args.Seq, reply.Err, nil, args.Key)
+
+	if reply.Err == OK {
+		evicted := kv.evictL(args.Key)
+		return kv.persistL(args.ClientId, append(evicted, args.Key)...), true
+	}
+	return kv.persistL(args.ClientId), true
+}
+
+func (kv *KVServer) putL(args *PutArgs, reply *PutReply) {
 	key := Key(args.Key)
+	expires := kv.deadlineL(args.TTL)
 
-	value, found := kv.data[key]
+	value, found := kv.lookupL(key)
 
 	if found && args.Version == 0 {
 		reply.Err = ErrVersion
@@ -87,19 +366,35 @@ func (kv *KVServer) Put(args *PutArgs, reply *PutReply) {
 		return
 	}
 
+	if kv.overQuotaL(map[Key]string{key: args.Value}) {
+		reply.Err = ErrQuota
+		return
+	}
+
+	size := int64(len(args.Key) + len(args.Value))
+	delta := size
+	if found {
+		delta -= keyBytes(key, value)
+	}
+	if kv.fullL(delta, size) {
+		reply.Err = ErrFull
+		return
+	}
+
+	meta := value.meta.written(args.ClientId, kv.nowL())
+
 	if !found && args.Version == 0 {
-		kv.data[key] = &Value{
-			value:   args.Value,
-			version: 1,
-		}
+		kv.setValueL(key, Value{value: args.Value, version: 1, expires: expires, meta: meta})
+		kv.index.insert(key)
+		kv.changed.Broadcast()
 
 		reply.Err = OK
 		return
 	}
 
 	if found && value.version == args.Version {
-		value.value = args.Value
-		value.version += 1
+		kv.setValueL(key, Value{value: args.Value, version: value.version + 1, expires: expires, meta: meta})
+		kv.changed.Broadcast()
 
 		reply.Err = OK
 		return
@@ -109,12 +404,564 @@ func (kv *KVServer) Put(args *PutArgs, reply *PutReply) {
 
 }
 
-// You can ignore all arguments; they are for replicated KVservers
+// Delete removes args.Key if args.Version matches the version of the
+// key on the server. If versions don't match, return ErrVersion. If
+// the key doesn't exist, Delete returns ErrNoKey.
+func (kv *KVServer) Delete(args *DeleteArgs, reply *DeleteReply) {
+	end, ok := kv.begin(request{op: opDelete, clientId: args.ClientId, cred: &args.Cred, perm: PermWrite,
+		ns: args.Namespace, keys: []*string{&args.Key}}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+
+	res, ok := kv.perform(Op{Delete: args}, func(res *opResult) bool {
+		rec, ok := kv.delete(args, &res.delete)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = DeleteReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.delete
+}
+
+func (kv *KVServer) delete(args *DeleteArgs, reply *DeleteReply) (walRecord, bool) {
+	defer kv.maybeCompact()
+	defer kv.lockStripes(args.ClientId, Key(args.Key))()
+
+	return kv.deleteOpL(args, reply)
+}
+
+func (kv *KVServer) deleteOpL(args *DeleteArgs, reply *DeleteReply) (walRecord, bool) {
+	if !kv.ownsL(args.Key) {
+		reply.Err = ErrWrongGroup
+		return walRecord{}, false
+	}
+
+	if last, ok := kv.duplicateL(args.ClientId, args.Seq); ok {
+		if last != nil {
+			reply.Err = last.Err
+		}
+		return walRecord{}, false
+	}
+
+	kv.deleteL(args, reply)
+	kv.rememberL(args.ClientId, args.Seq, reply.Err, nil, args.Key)
+
+	if reply.Err == OK {
+		return kv.persistL(args.ClientId, args.Key), true
+	}
+	return kv.persistL(args.ClientId), true
+}
+
+func (kv *KVServer) deleteL(args *DeleteArgs, reply *DeleteReply) {
+	key := Key(args.Key)
+
+	value, found := kv.lookupL(key)
+
+	if !found {
+		reply.Err = ErrNoKey
+		return
+	}
+
+	if value.version != args.Version {
+		reply.Err = ErrVersion
+		return
+	}
+
+	kv.removeL(key)
+
+	reply.Err = OK
+}
+
+// MultiPut applies all of args.Ops atomically if the version of every
+// op matches the version of its key on the server, using the same
+// rules as Put. An op on a key that appears earlier in args.Ops must
+// expect the version produced by the earlier op. If any op doesn't
+// match, MultiPut applies none of them and returns ErrVersion with a
+// Conflict for each mismatching key. Keys written by MultiPut never
+// expire.
+func (kv *KVServer) MultiPut(args *MultiPutArgs, reply *MultiPutReply) {
+	keys := make([]*string, len(args.Ops))
+	for i := range args.Ops {
+		keys[i] = &args.Ops[i].Key
+	}
+	end, ok := kv.begin(request{op: opMultiPut, clientId: args.ClientId, cred: &args.Cred, perm: PermWrite,
+		ns: args.Namespace, keys: keys}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+
+	res, ok := kv.perform(Op{MultiPut: args}, func(res *opResult) bool {
+		rec, ok := kv.multiPut(args, &res.multiPut)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = MultiPutReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.multiPut
+}
+
+func (kv *KVServer) multiPut(args *MultiPutArgs, reply *MultiPutReply) (walRecord, bool) {
+	defer kv.maybeCompact()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.multiPutOpL(args, reply)
+}
+
+func (kv *KVServer) multiPutOpL(args *MultiPutArgs, reply *MultiPutReply) (walRecord, bool) {
+	for _, op := range args.Ops {
+		if !kv.ownsL(op.Key) {
+			reply.Err = ErrWrongGroup
+			return walRecord{}, false
+		}
+	}
+
+	if last, ok := kv.duplicateL(args.ClientId, args.Seq); ok {
+		if last != nil {
+			reply.Err = last.Err
+			reply.Conflicts = last.Conflicts
+		}
+		return walRecord{}, false
+	}
+
+	keys := make([]string, len(args.Ops))
+	for i, op := range args.Ops {
+		keys[i] = op.Key
+	}
+	kv.multiPutL(args, reply)
+	kv.rememberL(args.ClientId, args.Seq, reply.Err, reply.Conflicts, keys...)
+
+	if reply.Err == OK {
+		evicted := kv.evictL(keys...)
+		return kv.persistL(args.ClientId, append(evicted, keys...)...), true
+	}
+	return kv.persistL(args.ClientId), true
+}
+
+func (kv *KVServer) multiPutL(args *MultiPutArgs, reply *MultiPutReply) {
+	// versions after the ops seen so far; 0 means the key doesn't exist
+	staged := make(map[Key]Tversion)
+	conflicts := []Conflict{}
+
+	for _, op := range args.Ops {
+		key := Key(op.Key)
+
+		version, found := staged[key]
+		if !found {
+			if value, ok := kv.lookupL(key); ok {
+				version = value.version
+			}
+		}
+
+		if version != op.Version {
+			err := Err(ErrVersion)
+			if version == 0 {
+				err = ErrNoKey
+			}
+			conflicts = append(conflicts, Conflict{Key: op.Key, Version: version, Err: err})
+			continue
+		}
+
+		staged[key] = version + 1
+	}
+
+	if len(conflicts) > 0 {
+		reply.Conflicts = conflicts
+		reply.Err = ErrVersion
+		return
+	}
+
+	// the value and size of each key once the ops are done
+	values := make(map[Key]string)
+	sizes := make(map[Key]int64)
+	for _, op := range args.Ops {
+		values[Key(op.Key)] = op.Value
+		sizes[Key(op.Key)] = int64(len(op.Key) + len(op.Value))
+	}
+	if kv.overQuotaL(values) {
+		reply.Err = ErrQuota
+		return
+	}
+	var delta, size int64
+	for key, s := range sizes {
+		size += s
+		delta += s
+		if value, found := kv.valueL(key); found {
+			delta -= keyBytes(key, value)
+		}
+	}
+	if kv.fullL(delta, size) {
+		reply.Err = ErrFull
+		return
+	}
+
+	now := kv.nowL()
+	for _, op := range args.Ops {
+		key := Key(op.Key)
+
+		if value, found := kv.lookupL(key); found {
+			kv.setValueL(key, Value{value: op.Value, version: value.version + 1, meta: value.meta.written(args.ClientId, now)})
+		} else {
+			kv.setValueL(key, Value{value: op.Value, version: 1, meta: KeyMeta{}.written(args.ClientId, now)})
+			kv.index.insert(key)
+		}
+	}
+	kv.changed.Broadcast()
+
+	reply.Err = OK
+}
+
+// Scan returns up to args.Limit keys with their values and versions
+// in lexicographic order, starting at args.Start or, if args.Token is
+// set, right after the last key of the previous page. If more keys
+// remain in the range, reply.Token continues the scan.
+func (kv *KVServer) Scan(args *ScanArgs, reply *ScanReply) {
+	principal := args.Cred.Principal
+	end, ok := kv.begin(request{op: opNone, clientId: args.ClientId, cred: &args.Cred, perm: PermRead,
+		ns: args.Namespace, bounds: []string{args.Prefix, args.Start, args.End, args.Token}}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+	args.Cred.Principal = principal
+	p := nsScan(args.Namespace, args)
+	defer stripScan(p, reply)
+
+	res, ok := kv.perform(Op{Scan: args}, func(res *opResult) bool {
+		kv.scan(args, &res.scan)
+		return kv.confirm()
+	})
+	if !ok {
+		*reply = ScanReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.scan
+}
+
+func (kv *KVServer) scan(args *ScanArgs, reply *ScanReply) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.scanL(args, reply)
+}
+
+func (kv *KVServer) scanL(args *ScanArgs, reply *ScanReply) {
+	start, end := args.Start, args.End
+	if args.Prefix != "" {
+		start, end = args.Prefix, prefixEnd(args.Prefix)
+	}
+	if args.Token != "" && args.Token > start {
+		start = args.Token
+	}
+
+	limit := args.Limit
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	now := kv.nowL()
+	reply.Entries = []ScanEntry{}
+	kv.ascendL(Key(start), func(key Key, value Value) bool {
+		if end != "" && key >= Key(end) {
+			return false
+		}
+		if len(reply.Entries) == limit {
+			// the smallest key after the last one returned
+			reply.Token = reply.Entries[limit-1].Key + "\x00"
+			return false
+		}
+		if !kv.ownsL(string(key)) {
+			return true
+		}
+		if _, k := splitKey(string(key)); !kv.acl.grants(args.Cred.Principal, k, PermRead) {
+			return true
+		}
+		if value.expired(now) {
+			// leave it for the reaper, since removing it would
+			// change the index under us
+			return true
+		}
+		reply.Entries = append(reply.Entries, ScanEntry{Key: string(key), Value: value.value, Version: value.version})
+		return true
+	})
+	reply.Err = OK
+}
+
+// Watch blocks until the version of args.Key differs from
+// args.Version, or until args.Timeout passes, and then returns the
+// value and version of the key like Get. A key that doesn't exist has
+// version 0, so Watch also returns when the key is created or
+// deleted. Watch blocks for at most MaxWatchTimeout.
+func (kv *KVServer) Watch(args *WatchArgs, reply *GetReply) {
+	end, ok := kv.begin(request{op: opWatch, clientId: args.ClientId, cred: &args.Cred, perm: PermRead,
+		ns: args.Namespace, keys: []*string{&args.Key}}, &reply.Err)
+	defer end()
+	if !ok {
+		return
+	}
+
+	if !kv.wait(args) {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	kv.performGet(&GetArgs{Key: args.Key, ClientId: args.ClientId}, reply)
+}
+
+// wait blocks until Watch should return, and reports whether this
+// server is still one that serves clerks.
+func (kv *KVServer) wait(args *WatchArgs) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if !kv.primaryL() {
+		return false
+	}
+
+	timeout := args.Timeout
+	if timeout > MaxWatchTimeout {
+		timeout = MaxWatchTimeout
+	}
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+
+		expired = true
+		kv.changed.Broadcast()
+	})
+	defer timer.Stop()
+
+	key := Key(args.Key)
+	for {
+		version := Tversion(0)
+		value, found := kv.lookupL(key)
+		if found {
+			version = value.version
+		}
+		if version != args.Version || expired || !kv.primaryL() || kv.killed() {
+			break
+		}
+		kv.changed.Wait()
+	}
+	return kv.primaryL() && !kv.killed()
+}
+
+// StartKVServer restores the keys and clerks saved in persister, and
+// saves every change to them from then on. If ends holds more than
+// one server, the KVServer is server srv of a Raft group (see
+// kvraft.go) instead.
 func StartKVServer(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
-	kv := MakeKVServer()
-	return []IService{kv}
+	return startKVServer(MakeKVServer(), ends, srv, persister)
+}
+
+// StartKVServerEngine returns a function like StartKVServer, whose
+// KVServers store their keys in engines made by mk.
+func StartKVServerEngine(mk EngineMaker) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		return startKVServer(MakeKVServerEngine(mk), ends, srv, persister)
+	}
+}
+
+// StartKVServerLSM returns a function like StartKVServer, whose
+// KVServers store their keys in LSM engines (see lsm.go) under
+// dir/<gid>-<srv>, with memtables of memtable bytes, or 0 for the
+// default.
+func StartKVServerLSM(dir string, memtable int) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		mk := MakeLSMEngines(filepath.Join(dir, fmt.Sprintf("%v-%v", gid, srv)), memtable)
+		return startKVServer(MakeKVServerEngine(mk), ends, srv, persister)
+	}
+}
+
+// StartKVServerFile returns a function like StartKVServer, whose
+// KVServers persist to files under dir/<gid>-<srv> (see
+// filepersister.go) instead of to persister. Each start reads the
+// state back from the files, after retiring the persister of the
+// server's previous incarnation, as the tester does with persister.
+func StartKVServerFile(dir string) FstartServer {
+	var mu sync.Mutex
+	open := make(map[string]*Persister)
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		name := filepath.Join(dir, fmt.Sprintf("%v-%v", gid, srv))
+
+		mu.Lock()
+		if old, ok := open[name]; ok {
+			old.retire()
+		}
+		ps, err := MakeFilePersister(name)
+		if err != nil {
+			log.Fatalf("[Server->StartKVServerFile]: %v", err)
+		}
+		open[name] = ps
+		mu.Unlock()
+
+		return startKVServer(MakeKVServer(), ends, srv, ps)
+	}
 }
 
-// You can ignore Kill() for this lab
+// StartKVServerMemLimit returns a function like StartKVServer, whose
+// KVServers keep their keys within limit bytes, following policy; see
+// memory.go.
+func StartKVServerMemLimit(limit int64, policy MemoryPolicy) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.memLimit = limit
+		kv.memPolicy = policy
+		if policy == EvictLRU {
+			kv.lru = makeLRU()
+		}
+		return startKVServer(kv, ends, srv, persister)
+	}
+}
+
+// StartKVServerHistory returns a function like StartKVServer, whose
+// KVServers keep the past versions of keys that policy allows; see
+// history.go.
+func StartKVServerHistory(policy HistoryPolicy) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.historyPolicy = policy
+		return startKVServer(kv, ends, srv, persister)
+	}
+}
+
+// StartKVServerACL returns a function like StartKVServer, whose
+// KVServers check the credentials of clerks against acl; see acl.go.
+func StartKVServerACL(acl ACL) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.acl = &acl
+		return startKVServer(kv, ends, srv, persister)
+	}
+}
+
+// StartKVServerRateLimit returns a function like StartKVServer, whose
+// KVServers turn away requests over limit with ErrBusy; see limit.go.
+func StartKVServerRateLimit(limit RateLimit) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.limiter = makeRateLimiter(limit)
+		return startKVServer(kv, ends, srv, persister)
+	}
+}
+
+// StartKVServerQuotas returns a function like StartKVServer, whose
+// KVServers hold each namespace in quotas to its quota; see
+// namespace.go.
+func StartKVServerQuotas(quotas map[string]Quota) FstartServer {
+	return func(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+		kv := MakeKVServer()
+		kv.quota = makeQuotaTable(quotas)
+		return startKVServer(kv, ends, srv, persister)
+	}
+}
+
+func startKVServer(kv *KVServer, ends []*ClientEnd, srv int, persister *Persister) []IService {
+	if len(ends) > 1 {
+		rf := kv.startRaft(ends, srv, persister)
+		kv.spawn(kv.reaper)
+		return []IService{kv, makeAdmin(kv), rf}
+	}
+
+	kv.mu.Lock()
+	kv.restoreL(persister)
+	kv.mu.Unlock()
+
+	kv.spawn(kv.reaper)
+
+	return []IService{kv, makeAdmin(kv)}
+}
+
+// StartPBKVServer is like StartKVServer, but makes the KVServer server
+// srv of a primary-backup group (see pb.go), which must have at least
+// MinPBServers servers.
+func StartPBKVServer(ends []*ClientEnd, gid Tgid, srv int, persister *Persister) []IService {
+	if len(ends) < MinPBServers {
+		log.Fatalf("[Server->StartPBKVServer]: a group of %d servers; need at least %d", len(ends), MinPBServers)
+	}
+	return startPBKVServer(MakeKVServer(), ends, srv, persister)
+}
+
+func startPBKVServer(kv *KVServer, ends []*ClientEnd, srv int, persister *Persister) []IService {
+	kv.pb = makePrimaryBackup(ends, srv)
+
+	kv.mu.Lock()
+	kv.restoreL(persister)
+	kv.mu.Unlock()
+
+	kv.spawn(kv.ticker)
+	kv.spawn(kv.reaper)
+
+	return []IService{kv, makeAdmin(kv)}
+}
+
+// Kill makes the server turn away new requests with ErrWrongLeader,
+// wakes up the ones it is serving, and waits for them and for its
+// goroutines to finish before it closes durable engines. In a Raft
+// group it also kills Raft, whose goroutines it waits for too, and
+// the applier stops once Raft closes applyCh.
 func (kv *KVServer) Kill() {
+	kv.killMu.Lock()
+	if kv.dead.Load() {
+		kv.killMu.Unlock()
+		return
+	}
+	kv.dead.Store(true)
+	kv.killMu.Unlock()
+
+	kv.mu.Lock()
+	close(kv.stop)
+	kv.changed.Broadcast()
+	kv.mu.Unlock()
+
+	if kv.raft != nil {
+		kv.raft.rf.Kill()
+	}
+	kv.running.Wait()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for i := range kv.stripes {
+		if e, ok := kv.stripes[i].engine.(DurableEngine); ok {
+			e.Close()
+		}
+	}
+}
+
+func (kv *KVServer) killed() bool {
+	return kv.dead.Load()
+}
+
+// enter admits a request, unless the server is killed, in which case
+// the handler must return at once. A handler that enters must exit.
+func (kv *KVServer) enter() bool {
+	kv.killMu.Lock()
+	defer kv.killMu.Unlock()
+	if kv.dead.Load() {
+		return false
+	}
+	kv.running.Add(1)
+	return true
+}
+
+func (kv *KVServer) exit() {
+	kv.running.Done()
+}
+
+// spawn runs fn in a goroutine that Kill waits for, unless the server
+// is killed already.
+func (kv *KVServer) spawn(fn func()) {
+	if !kv.enter() {
+		return
+	}
+	go func() {
+		defer kv.exit()
+		fn()
+	}()
 }
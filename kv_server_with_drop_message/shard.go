@@ -0,0 +1,297 @@
+package kv_server_with_stable_network
+
+// A KVServer in a sharded deployment serves only the shards the
+// controller installed on its group, and answers requests for keys in
+// other shards with ErrWrongGroup. A server that never had a shard
+// installed isn't sharded and serves every key.
+//
+// To move a shard, the controller freezes it on the source group,
+// which then rejects all requests for it and returns its keys, their
+// past versions (see history.go), and the last replies of the clerks
+// whose last request touched the shard; installs those on the
+// destination group; publishes the new configuration; and finally
+// deletes the shard from the source. Each step carries the number of
+// the new configuration, so that repeating a step does nothing. A
+// shard moves to no group at all, gid 0, only if it holds no keys.
+
+// Owned is false for a shard the group doesn't serve, and Frozen is
+// set while the shard moves away; Num is the configuration in which
+// the group last got or gave up the shard.
+type ShardInfo struct {
+	Shard  int
+	Num    int
+	Owned  bool
+	Frozen bool
+}
+
+// Values, History, and Clients are the keys of the shard, their past
+// versions, and the clerks of the source group, from FreezeShard.
+type InstallShardArgs struct {
+	Shard   int
+	Num     int
+	Values  []persistedValue
+	History []persistedPast
+	Clients map[int64]lastReply
+	Cred    Credential
+}
+
+type InstallShardReply struct {
+	Err Err
+}
+
+// IfEmpty is set if the shard moves to gid 0, where its keys would be
+// lost.
+type FreezeShardArgs struct {
+	Shard   int
+	Num     int
+	IfEmpty bool
+	Cred    Credential
+}
+
+type FreezeShardReply struct {
+	Values  []persistedValue
+	History []persistedPast
+	Clients map[int64]lastReply
+	Err     Err
+}
+
+type DeleteShardArgs struct {
+	Shard int
+	Num   int
+	Cred  Credential
+}
+
+type DeleteShardReply struct {
+	Err Err
+}
+
+// ownsL reports whether this server serves key. Caller must hold
+// kv.mu.
+func (kv *KVServer) ownsL(key string) bool {
+	return owns(kv.shards, key)
+}
+
+// owns reports whether a server with shards serves key.
+func owns(shards []ShardInfo, key string) bool {
+	if shards == nil {
+		return true
+	}
+	info := shards[Key2Shard(key)]
+	return info.Owned && !info.Frozen
+}
+
+// setShardL records info about a shard. Caller must hold kv.mu.
+func (kv *KVServer) setShardL(info ShardInfo) {
+	if kv.shards == nil {
+		kv.shards = make([]ShardInfo, NShards)
+		for s := range kv.shards {
+			kv.shards[s].Shard = s
+		}
+	}
+	kv.shards[info.Shard] = info
+}
+
+// InstallShard makes this server's group serve args.Shard, with the
+// keys in args.Values, as of configuration args.Num. The clerks in
+// args.Clients join this group's, so that a request the source group
+// performed isn't performed again here. Installing a shard again in
+// the same or an older configuration does nothing.
+func (kv *KVServer) InstallShard(args *InstallShardArgs, reply *InstallShardReply) {
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.authorizeServer(&args.Cred) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	res, ok := kv.perform(Op{InstallShard: args}, func(res *opResult) bool {
+		rec, ok := kv.installShard(args, &res.installShard)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = InstallShardReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.installShard
+}
+
+func (kv *KVServer) installShard(args *InstallShardArgs, reply *InstallShardReply) (walRecord, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.installShardOpL(args, reply)
+}
+
+func (kv *KVServer) installShardOpL(args *InstallShardArgs, reply *InstallShardReply) (walRecord, bool) {
+	reply.Err = OK
+	if kv.shards != nil && args.Num <= kv.shards[args.Shard].Num {
+		return walRecord{}, false
+	}
+
+	info := ShardInfo{Shard: args.Shard, Num: args.Num, Owned: true}
+	kv.setShardL(info)
+	for _, pv := range args.Values {
+		kv.installL(pv)
+	}
+	kv.loadHistoryL(args.History)
+	kv.mergeClientsL(args.Clients)
+
+	rec := kv.recordL(0)
+	rec.Values = args.Values
+	rec.History = args.History
+	rec.Clients = args.Clients
+	rec.Shards = []ShardInfo{info}
+	kv.logL(rec)
+	return rec, true
+}
+
+// FreezeShard makes this server's group stop serving args.Shard, which
+// moves to another group in configuration args.Num, and returns the
+// keys of the shard with their history, and the clerks of the group
+// whose last request touched the shard. Freezing the shard again in
+// the same configuration returns them again. If the group doesn't own
+// the shard, FreezeShard returns ErrWrongGroup, if the group got the
+// shard in a later configuration, ErrVersion, and if args.IfEmpty is
+// set and the shard holds keys, ErrNotEmpty, leaving the shard as it
+// was.
+func (kv *KVServer) FreezeShard(args *FreezeShardArgs, reply *FreezeShardReply) {
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.authorizeServer(&args.Cred) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	res, ok := kv.perform(Op{FreezeShard: args}, func(res *opResult) bool {
+		rec, ok := kv.freezeShard(args, &res.freezeShard)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = FreezeShardReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.freezeShard
+}
+
+func (kv *KVServer) freezeShard(args *FreezeShardArgs, reply *FreezeShardReply) (walRecord, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.freezeShardOpL(args, reply)
+}
+
+func (kv *KVServer) freezeShardOpL(args *FreezeShardArgs, reply *FreezeShardReply) (walRecord, bool) {
+	if kv.shards == nil || !kv.shards[args.Shard].Owned {
+		reply.Err = ErrWrongGroup
+		return walRecord{}, false
+	}
+	info := kv.shards[args.Shard]
+	if args.Num < info.Num || (args.Num == info.Num && !info.Frozen) {
+		reply.Err = ErrVersion
+		return walRecord{}, false
+	}
+
+	// the shard may not change any more, but may expire
+	now := kv.nowL()
+	moving := make(map[Key]bool)
+	kv.forEachL(func(key Key, value Value) {
+		if Key2Shard(string(key)) == args.Shard && !value.expired(now) {
+			reply.Values = append(reply.Values, makePersistedValue(key, value))
+			moving[key] = true
+		}
+	})
+	if args.IfEmpty && !info.Frozen && len(reply.Values) > 0 {
+		*reply = FreezeShardReply{Err: ErrNotEmpty}
+		return walRecord{}, false
+	}
+	reply.History = kv.historyWhereL(func(key Key) bool { return moving[key] })
+	reply.Clients = make(map[int64]lastReply)
+	kv.forEachClientL(func(id int64, last *lastReply) {
+		if last.touches(args.Shard) {
+			reply.Clients[id] = *last
+		}
+	})
+	reply.Err = OK
+
+	if info.Frozen {
+		return walRecord{}, false
+	}
+	info.Num = args.Num
+	info.Frozen = true
+	kv.setShardL(info)
+
+	rec := kv.recordL(0)
+	rec.Shards = []ShardInfo{info}
+	kv.logL(rec)
+	return rec, true
+}
+
+// DeleteShard drops args.Shard, which this server's group froze for
+// configuration args.Num, once the shard is installed on its new
+// group. Deleting the shard again does nothing.
+func (kv *KVServer) DeleteShard(args *DeleteShardArgs, reply *DeleteShardReply) {
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.authorizeServer(&args.Cred) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	res, ok := kv.perform(Op{DeleteShard: args}, func(res *opResult) bool {
+		rec, ok := kv.deleteShard(args, &res.deleteShard)
+		return !ok || kv.replicate(rec)
+	})
+	if !ok {
+		*reply = DeleteShardReply{Err: ErrWrongLeader}
+		return
+	}
+	*reply = res.deleteShard
+}
+
+func (kv *KVServer) deleteShard(args *DeleteShardArgs, reply *DeleteShardReply) (walRecord, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.deleteShardOpL(args, reply)
+}
+
+func (kv *KVServer) deleteShardOpL(args *DeleteShardArgs, reply *DeleteShardReply) (walRecord, bool) {
+	reply.Err = OK
+	if kv.shards == nil {
+		return walRecord{}, false
+	}
+	info := kv.shards[args.Shard]
+	if !info.Frozen || info.Num != args.Num {
+		return walRecord{}, false
+	}
+
+	keys := []string{}
+	kv.forEachL(func(key Key, _ Value) {
+		if Key2Shard(string(key)) == args.Shard {
+			keys = append(keys, string(key))
+		}
+	})
+	for _, key := range keys {
+		kv.removeL(Key(key))
+	}
+	info = ShardInfo{Shard: args.Shard, Num: args.Num}
+	kv.setShardL(info)
+
+	rec := kv.recordL(0)
+	rec.Deleted = keys
+	rec.Shards = []ShardInfo{info}
+	kv.logL(rec)
+	return rec, true
+}
@@ -0,0 +1,111 @@
+package kv_server_with_stable_network
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"slices"
+)
+
+// The key space is split into NShards shards, and a ShardConfig
+// assigns each shard to a server group. Configurations are numbered;
+// a group only serves a shard once the controller has installed it at
+// the shard's configuration number (see shardctrler.go).
+
+const NShards = 10
+
+// Shards[s] is the group that owns shard s, 0 if none, and Groups
+// holds the server names of each group.
+type ShardConfig struct {
+	Num    int
+	Shards [NShards]Tgid
+	Groups map[Tgid][]string
+}
+
+// Key2Shard returns the shard that key belongs to.
+func Key2Shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % NShards)
+}
+
+func MakeShardConfig() *ShardConfig {
+	return &ShardConfig{Groups: make(map[Tgid][]string)}
+}
+
+func FromString(s string) *ShardConfig {
+	cfg := &ShardConfig{}
+	if err := json.Unmarshal([]byte(s), cfg); err != nil {
+		log.Fatalf("[ShardConfig->FromString]: unmarshal %v", err)
+	}
+	return cfg
+}
+
+func (cfg *ShardConfig) String() string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatalf("[ShardConfig->String]: marshal %v", err)
+	}
+	return string(b)
+}
+
+func (cfg *ShardConfig) Copy() *ShardConfig {
+	c := &ShardConfig{Num: cfg.Num, Shards: cfg.Shards, Groups: make(map[Tgid][]string)}
+	for gid, servers := range cfg.Groups {
+		c.Groups[gid] = slices.Clone(servers)
+	}
+	return c
+}
+
+// Join adds the groups in gids, with their servers, and spreads the
+// shards evenly over all groups, moving as few shards as possible.
+func (cfg *ShardConfig) Join(gids map[Tgid][]string) {
+	for gid, servers := range gids {
+		cfg.Groups[gid] = slices.Clone(servers)
+	}
+	cfg.rebalance()
+}
+
+func (cfg *ShardConfig) rebalance() {
+	if len(cfg.Groups) == 0 {
+		return
+	}
+	gids := make([]Tgid, 0, len(cfg.Groups))
+	for gid := range cfg.Groups {
+		gids = append(gids, gid)
+	}
+	slices.Sort(gids)
+
+	owned := make(map[Tgid][]int)
+	free := []int{}
+	for s, gid := range cfg.Shards {
+		if _, ok := cfg.Groups[gid]; ok {
+			owned[gid] = append(owned[gid], s)
+		} else {
+			free = append(free, s)
+		}
+	}
+
+	// the first NShards % len(gids) groups get one extra shard
+	for i, gid := range gids {
+		want := NShards / len(gids)
+		if i < NShards%len(gids) {
+			want += 1
+		}
+		if len(owned[gid]) > want {
+			free = append(free, owned[gid][want:]...)
+			owned[gid] = owned[gid][:want]
+		}
+	}
+	for i, gid := range gids {
+		want := NShards / len(gids)
+		if i < NShards%len(gids) {
+			want += 1
+		}
+		for len(owned[gid]) < want {
+			cfg.Shards[free[0]] = gid
+			owned[gid] = append(owned[gid], free[0])
+			free = free[1:]
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package kv_server_with_stable_network
+
+import "time"
+
+// The shard controller keeps the current ShardConfig in a KVServer
+// (or a replicated group of them), under ConfigKey, and tells the
+// groups which shards to serve. Clerks fetch the configuration with
+// Query. A ShardCtrler must not be used by several threads at once,
+// since its Clerk mustn't.
+
+const ConfigKey = "shardcfg"
+
+type ShardCtrler struct {
+	clnt *Clnt
+	ck   *Clerk
+}
+
+// MakeShardCtrler makes a controller for the configuration kept by
+// servers.
+func MakeShardCtrler(clnt *Clnt, servers ...string) *ShardCtrler {
+	return &ShardCtrler{clnt: clnt, ck: MakeClerk(clnt, servers...).(*Clerk)}
+}
+
+// MakeShardCtrlerWithCredential is like MakeShardCtrler, but the
+// controller sends cred with its requests. The groups take shards
+// only from the Server principal of their ACL, if they have one (see
+// acl.go).
+func MakeShardCtrlerWithCredential(clnt *Clnt, cred Credential, servers ...string) *ShardCtrler {
+	return &ShardCtrler{clnt: clnt, ck: MakeClerkWithCredential(clnt, cred, servers...).(*Clerk)}
+}
+
+// InitConfig installs every shard on the group that cfg assigns it
+// to, and then publishes cfg. The controller must not have a
+// configuration yet.
+func (sck *ShardCtrler) InitConfig(cfg *ShardConfig) Err {
+	for s, gid := range cfg.Shards {
+		if gid != 0 {
+			sck.installShard(gid, cfg.Groups[gid], &InstallShardArgs{Shard: s, Num: cfg.Num})
+		}
+	}
+	return sck.ck.Put(ConfigKey, cfg.String(), 0)
+}
+
+// Query returns the current configuration, or an empty one with Num 0
+// if there is none yet.
+func (sck *ShardCtrler) Query() *ShardConfig {
+	cfg, _ := sck.query()
+	return cfg
+}
+
+func (sck *ShardCtrler) query() (*ShardConfig, Tversion) {
+	value, version, err := sck.ck.Get(ConfigKey)
+	if err == ErrNoKey {
+		return MakeShardConfig(), 0
+	}
+	return FromString(value), version
+}
+
+// MoveShard moves shard to group gid, whose servers must be in the
+// current configuration.
+func (sck *ShardCtrler) MoveShard(shard int, gid Tgid) Err {
+	next := sck.Query()
+	next.Shards[shard] = gid
+	return sck.ChangeConfigTo(next)
+}
+
+// ChangeConfigTo moves the shards that next assigns to other groups
+// than the current configuration does, while the groups keep serving
+// their other shards, and then publishes next with the following
+// configuration number. Clerks get ErrWrongGroup for a moving shard
+// until next is published. If the controller fails halfway, calling
+// ChangeConfigTo again with the same next finishes the move.
+//
+// A shard that next assigns to no group, gid 0, must hold no keys.
+// ChangeConfigTo freezes such shards first, and returns ErrNotEmpty,
+// before it moves any other shard, if one holds keys.
+func (sck *ShardCtrler) ChangeConfigTo(next *ShardConfig) Err {
+	cur, version := sck.query()
+	next = next.Copy()
+	next.Num = cur.Num + 1
+
+	// the shards that go to gid 0 first
+	order := []int{}
+	for _, toZero := range []bool{true, false} {
+		for s := range next.Shards {
+			if cur.Shards[s] != next.Shards[s] && (next.Shards[s] == 0) == toZero {
+				order = append(order, s)
+			}
+		}
+	}
+
+	moved := []int{}
+	for _, s := range order {
+		from, to := cur.Shards[s], next.Shards[s]
+		args := &InstallShardArgs{Shard: s, Num: next.Num}
+		if from != 0 {
+			reply := sck.freezeShard(from, cur.Groups[from], &FreezeShardArgs{Shard: s, Num: next.Num, IfEmpty: to == 0})
+			if reply.Err != OK {
+				return reply.Err
+			}
+			args.Values = reply.Values
+			args.History = reply.History
+			args.Clients = reply.Clients
+			moved = append(moved, s)
+		}
+		if to != 0 {
+			sck.installShard(to, next.Groups[to], args)
+		}
+	}
+
+	if err := sck.ck.Put(ConfigKey, next.String(), version); err != OK {
+		return err
+	}
+
+	for _, s := range moved {
+		from := cur.Shards[s]
+		sck.deleteShard(from, cur.Groups[from], &DeleteShardArgs{Shard: s, Num: next.Num})
+	}
+	return OK
+}
+
+func (sck *ShardCtrler) installShard(gid Tgid, servers []string, args *InstallShardArgs) {
+	args.Cred = sck.ck.cred
+	for {
+		reply := &InstallShardReply{}
+		if sck.ck.callGroup(gid, servers, "KVServer.InstallShard", args, reply, &reply.Err) {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (sck *ShardCtrler) freezeShard(gid Tgid, servers []string, args *FreezeShardArgs) *FreezeShardReply {
+	args.Cred = sck.ck.cred
+	for {
+		reply := &FreezeShardReply{}
+		if sck.ck.callGroup(gid, servers, "KVServer.FreezeShard", args, reply, &reply.Err) {
+			return reply
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (sck *ShardCtrler) deleteShard(gid Tgid, servers []string, args *DeleteShardArgs) {
+	args.Cred = sck.ck.cred
+	for {
+		reply := &DeleteShardReply{}
+		if sck.ck.callGroup(gid, servers, "KVServer.DeleteShard", args, reply, &reply.Err) {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
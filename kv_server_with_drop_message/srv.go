@@ -53,3 +53,33 @@ func (s *ServerSrv) connect(sg *ServerGrp, to []int) {
 		}
 	}
 }
+
+// disconnect s from servers listed in from
+func (s *ServerSrv) disconnect(from []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for j := 0; j < len(from); j++ {
+		s.net.Enable(s.endNames[from[j]], false)
+	}
+}
+
+func (s *ServerSrv) shutdownServer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a fresh persister, in case old instance
+	// continues to update the Persister.
+	// but copy old persister's content so that we always
+	// pass Make() the last persisted state.
+	if s.saved != nil {
+		s.saved = s.saved.Copy()
+	}
+
+	// inform all services to stop
+	for _, svc := range s.svcs {
+		if svc != nil {
+			svc.Kill()
+		}
+	}
+	s.svcs = nil
+}
@@ -0,0 +1,247 @@
+package kv_server_with_stable_network
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A KVServer counts the replies it gives to Gets, Puts, Deletes,
+// MultiPuts, and Watches, by Err, and how often clerks ask for each
+// key, to find the
+// hot keys. It counts only the requests it serves itself, so a replica
+// that isn't the leader counts its ErrWrongLeader replies but no key
+// accesses. To bound its memory, the server tracks the accesses of at
+// most HotKeysTracked keys: once the table is full, a new key takes
+// the place of the least accessed one and carries on from its count,
+// as in the Space-Saving algorithm, so that a key that is truly hot
+// isn't missed, though a count may be too high.
+//
+// The reply counts are atomic, and the table is split into
+// statStripes stripes by key, each with its own lock and a heap that
+// keeps its least accessed key at hand, so that counting a request
+// takes no lock that requests for other keys need, and no scan.
+// The table holds stored keys (see namespace.go), so that the same key
+// in two namespaces counts apart; Stats reports only the hot keys of
+// the clerk's namespace that the clerk may read (see acl.go), and
+// counts only the keys of that namespace that haven't expired, so
+// that a clerk learns nothing of other namespaces.
+
+const HotKeysTracked = 1024
+
+const statStripes = 16
+
+const (
+	opGet = iota
+	opPut
+	opDelete
+	opMultiPut
+	opWatch
+	nOps
+
+	opNone = -1 // a request that isn't counted
+)
+
+// OpCounts counts the replies to one kind of request by Err.
+type OpCounts map[Err]int64
+
+type KeyCount struct {
+	Key   string
+	Count int64
+}
+
+type serverStats struct {
+	ops     [nOps]sync.Map // Err -> *atomic.Int64
+	stripes [statStripes]statStripe
+}
+
+type statStripe struct {
+	mu   sync.Mutex
+	keys map[Key]*hotKey
+	heap hotHeap
+}
+
+type hotKey struct {
+	key   Key
+	count int64
+	index int // in the heap
+}
+
+// a min-heap of keys by count
+type hotHeap []*hotKey
+
+func (h hotHeap) Len() int           { return len(h) }
+func (h hotHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h hotHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotHeap) Push(x any) {
+	k := x.(*hotKey)
+	k.index = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *hotHeap) Pop() any {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+func makeServerStats() *serverStats {
+	st := &serverStats{}
+	for i := range st.stripes {
+		st.stripes[i].keys = make(map[Key]*hotKey)
+	}
+	return st
+}
+
+// count notes a request of kind op for the stored keys, once the
+// handler has set *err.
+func (st *serverStats) count(op int, err *Err, keys ...string) {
+	n, ok := st.ops[op].Load(*err)
+	if !ok {
+		n, _ = st.ops[op].LoadOrStore(*err, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+
+	if *err == ErrWrongLeader || *err == ErrWrongGroup || *err == ErrBadKey {
+		return
+	}
+	for _, key := range keys {
+		st.stripes[keyHash(Key(key))%statStripes].access(Key(key))
+	}
+}
+
+func (s *statStripe) access(key Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[key]; ok {
+		k.count += 1
+		heap.Fix(&s.heap, k.index)
+		return
+	}
+	if len(s.heap) < HotKeysTracked/statStripes {
+		k := &hotKey{key: key, count: 1}
+		s.keys[key] = k
+		heap.Push(&s.heap, k)
+		return
+	}
+	// take the place of the least accessed key
+	k := s.heap[0]
+	delete(s.keys, k.key)
+	k.key = key
+	k.count += 1
+	s.keys[key] = k
+	heap.Fix(&s.heap, 0)
+}
+
+// tracked returns the number of keys whose accesses st tracks.
+func (st *serverStats) tracked() int {
+	n := 0
+	for i := range st.stripes {
+		s := &st.stripes[i]
+		s.mu.Lock()
+		n += len(s.keys)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// hot returns the n most accessed keys that keep turns into keys to
+// report, most accessed first.
+func (st *serverStats) hot(n int, keep func(Key) (string, bool)) []KeyCount {
+	hot := []KeyCount{}
+	for i := range st.stripes {
+		s := &st.stripes[i]
+		s.mu.Lock()
+		for key, k := range s.keys {
+			if report, ok := keep(key); ok {
+				hot = append(hot, KeyCount{Key: report, Count: k.count})
+			}
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Count != hot[j].Count {
+			return hot[i].Count > hot[j].Count
+		}
+		return hot[i].Key < hot[j].Key
+	})
+	return hot[:min(n, len(hot))]
+}
+
+func (st *serverStats) opCounts(op int) OpCounts {
+	counts := make(OpCounts)
+	st.ops[op].Range(func(err, n any) bool {
+		counts[err.(Err)] = n.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// Stats reports how many keys of namespace args.Namespace this server
+// holds, how much memory they take (see memory.go), how it answered
+// requests, and its args.Hot most accessed keys. A replica answers
+// for itself, whether it leads its group or not.
+func (kv *KVServer) Stats(args *StatsArgs, reply *StatsReply) {
+	if !kv.enter() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	defer kv.exit()
+
+	if !kv.limiter.admit(args.ClientId) {
+		reply.Err = ErrBusy
+		return
+	}
+	defer kv.limiter.done()
+
+	if !validKey(args.Namespace, "") {
+		reply.Err = ErrBadKey
+		return
+	}
+	principal := args.Cred.Principal
+	if !kv.authorize(&args.Cred, PermRead) {
+		reply.Err = ErrPermission
+		return
+	}
+
+	kv.lockShared()
+	now := kv.nowL()
+	for i := range kv.stripes {
+		s := &kv.stripes[i]
+		s.mu.RLock()
+		s.engine.Iterate(func(key Key, value Value) bool {
+			if ns, _ := splitKey(string(key)); ns == args.Namespace && !value.expired(now) {
+				reply.Keys += 1
+				reply.Bytes += keyBytes(key, value)
+				reply.ValueBytes += int64(len(value.value))
+			}
+			return true
+		})
+		s.mu.RUnlock()
+	}
+	kv.unlockShared()
+
+	reply.Limit = kv.memLimit
+	reply.Evictions = kv.evictions.Load()
+	reply.Gets = kv.stats.opCounts(opGet)
+	reply.Puts = kv.stats.opCounts(opPut)
+	reply.Deletes = kv.stats.opCounts(opDelete)
+	reply.MultiPuts = kv.stats.opCounts(opMultiPut)
+	reply.Watches = kv.stats.opCounts(opWatch)
+	if args.Hot > 0 {
+		reply.Hot = kv.stats.hot(args.Hot, func(stored Key) (string, bool) {
+			ns, key := splitKey(string(stored))
+			return key, ns == args.Namespace && kv.acl.grants(principal, key, PermRead)
+		})
+	}
+	reply.Err = OK
+}
@@ -0,0 +1,311 @@
+package kv_server_with_stable_network
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// A KVServer spreads its keys, and separately its clerks, over
+// NStripes stripes by hash, each with its own lock, so that requests
+// for different keys don't wait for each other. Each stripe keeps its
+// keys in an Engine; see engine.go.
+//
+// The locking rule: holding kv.mu exclusively gives access to all
+// server state, with no need for stripe locks. Get, Put, and Delete
+// instead hold kv.mu shared, and lock just the clerk's stripe and
+// then the key's stripe, Get with a read lock. State that such
+// requests share beyond their stripes has its own lock: the key index
+// (keyIndex.mu) and the log (kv.walMu). Everything else, including
+// MultiPut and Scan, takes kv.mu exclusively.
+//
+// Striping therefore only helps a plain server. A primary (see
+// pb.go), and a server with a memory limit (see memory.go) or with
+// namespace quotas (see namespace.go), takes kv.mu exclusively for
+// every request, since the order of requests, the LRU list, and the
+// usage of a namespace span all stripes; such a server performs one
+// request at a time, as it did before it had stripes. A Raft replica
+// applies one Op at a time anyway.
+
+const NStripes = 64
+
+type stripe struct {
+	mu       sync.RWMutex
+	engine   Engine
+	expiring map[Key]struct{}    // keys with a TTL, for the reaper
+	history  map[Key][]pastValue // oldest first; see history.go
+}
+
+type clientStripe struct {
+	mu      sync.Mutex
+	clients map[int64]*lastReply
+}
+
+// lockShared takes kv.mu shared, or exclusively on a server that
+// benchmarks the single lock, on a primary, which must put its
+// requests in one order for the backups, on a server with a memory
+// limit, which may evict keys of any stripe, and on a server with
+// namespace quotas, whose usage spans the stripes.
+func (kv *KVServer) lockShared() {
+	if kv.exclusive() {
+		kv.mu.Lock()
+	} else {
+		kv.mu.RLock()
+	}
+}
+
+func (kv *KVServer) unlockShared() {
+	if kv.exclusive() {
+		kv.mu.Unlock()
+	} else {
+		kv.mu.RUnlock()
+	}
+}
+
+func (kv *KVServer) exclusive() bool {
+	return kv.singleLock || kv.pb != nil || kv.memLimit > 0 || kv.quota != nil
+}
+
+// lockStripes takes kv.mu shared and the stripes of clientId and key,
+// in that order, and returns a function that releases them.
+func (kv *KVServer) lockStripes(clientId int64, key Key) func() {
+	kv.lockShared()
+	cs := kv.clientStripeOf(clientId)
+	cs.mu.Lock()
+	s := kv.stripeOf(key)
+	s.mu.Lock()
+
+	return func() {
+		s.mu.Unlock()
+		cs.mu.Unlock()
+		kv.unlockShared()
+	}
+}
+
+func makeStripes(mk EngineMaker) []stripe {
+	stripes := make([]stripe, NStripes)
+	for i := range stripes {
+		stripes[i].engine = mk()
+		stripes[i].expiring = make(map[Key]struct{})
+		stripes[i].history = make(map[Key][]pastValue)
+	}
+	return stripes
+}
+
+func makeClientStripes() []clientStripe {
+	stripes := make([]clientStripe, NStripes)
+	for i := range stripes {
+		stripes[i].clients = make(map[int64]*lastReply)
+	}
+	return stripes
+}
+
+func (kv *KVServer) stripeOf(key Key) *stripe {
+	return &kv.stripes[keyHash(key)%uint32(len(kv.stripes))]
+}
+
+func keyHash(key Key) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (kv *KVServer) clientStripeOf(clientId int64) *clientStripe {
+	return &kv.clientStripes[uint64(clientId)%uint64(len(kv.clientStripes))]
+}
+
+// valueL returns the value of key, expired or not. Caller must hold
+// kv.mu, or kv.mu shared and the key's stripe.
+func (kv *KVServer) valueL(key Key) (Value, bool) {
+	return kv.stripeOf(key).engine.Get(key)
+}
+
+// setValueL makes value the value of key. Caller must hold kv.mu, or
+// kv.mu shared and the key's stripe for writing.
+func (kv *KVServer) setValueL(key Key, value Value) {
+	s := kv.stripeOf(key)
+	delta := keyBytes(key, value)
+	vdelta := int64(len(value.value))
+	if old, found := s.engine.Get(key); found {
+		delta -= keyBytes(key, old)
+		vdelta -= int64(len(old.value))
+		switch {
+		case old.meta.Created != value.meta.Created:
+			// created again after old expired
+			delete(s.history, key)
+		case old.version != value.version:
+			kv.recordPastL(key, old)
+		}
+		kv.quota.add(key, old, -1)
+	}
+	kv.quota.add(key, value, 1)
+	kv.bytes.Add(delta)
+	kv.valueBytes.Add(vdelta)
+	kv.touch(key)
+	if value.expires.IsZero() {
+		delete(s.expiring, key)
+	} else {
+		s.expiring[key] = struct{}{}
+	}
+	s.engine.Put(key, value)
+}
+
+// forEachL calls fn for every key, expired or not. Caller must hold
+// kv.mu.
+func (kv *KVServer) forEachL(fn func(Key, Value)) {
+	for i := range kv.stripes {
+		kv.stripes[i].engine.Iterate(func(key Key, value Value) bool {
+			fn(key, value)
+			return true
+		})
+	}
+}
+
+// snapshotL returns a copy of every stripe's engine, which later
+// writes don't affect, so that the keys can be read without kv.mu.
+// Caller must hold kv.mu.
+func (kv *KVServer) snapshotL() []Engine {
+	engines := make([]Engine, len(kv.stripes))
+	for i := range kv.stripes {
+		engines[i] = kv.stripes[i].engine.Snapshot()
+	}
+	return engines
+}
+
+// forEach calls fn for every key of engines, expired or not.
+func forEach(engines []Engine, fn func(Key, Value)) {
+	for _, e := range engines {
+		e.Iterate(func(key Key, value Value) bool {
+			fn(key, value)
+			return true
+		})
+	}
+}
+
+func (kv *KVServer) nkeysL() int {
+	n := 0
+	for i := range kv.stripes {
+		n += kv.stripes[i].engine.Len()
+	}
+	return n
+}
+
+// clientL returns the last request of clientId. Caller must hold
+// kv.mu, or kv.mu shared and the clerk's stripe.
+func (kv *KVServer) clientL(clientId int64) (*lastReply, bool) {
+	last, ok := kv.clientStripeOf(clientId).clients[clientId]
+	return last, ok
+}
+
+func (kv *KVServer) setClientL(clientId int64, last *lastReply) {
+	kv.clientStripeOf(clientId).clients[clientId] = last
+}
+
+// forEachClientL calls fn for every clerk. Caller must hold kv.mu.
+func (kv *KVServer) forEachClientL(fn func(int64, *lastReply)) {
+	for i := range kv.clientStripes {
+		for id, last := range kv.clientStripes[i].clients {
+			fn(id, last)
+		}
+	}
+}
+
+func (kv *KVServer) nclientsL() int {
+	n := 0
+	for i := range kv.clientStripes {
+		n += len(kv.clientStripes[i].clients)
+	}
+	return n
+}
+
+// resetL drops all keys and clerks. Caller must hold kv.mu.
+func (kv *KVServer) resetL() {
+	for i := range kv.stripes {
+		s := &kv.stripes[i]
+		keys := []Key{}
+		s.engine.Iterate(func(key Key, _ Value) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			s.engine.Delete(key)
+		}
+		s.expiring = make(map[Key]struct{})
+		s.history = make(map[Key][]pastValue)
+	}
+	kv.clientStripes = makeClientStripes()
+	kv.resetIndexL()
+	kv.bytes.Store(0)
+	kv.valueBytes.Store(0)
+	kv.quota.reset()
+	if kv.lru != nil {
+		kv.lru = makeLRU()
+	}
+	kv.changes.reset(nil, 0)
+}
+
+// reloadL drops all clerks, and rebuilds the index and the expiring
+// keys from the keys that durable engines kept. Caller must hold
+// kv.mu.
+func (kv *KVServer) reloadL() {
+	kv.clientStripes = makeClientStripes()
+	kv.resetIndexL()
+	kv.bytes.Store(0)
+	kv.valueBytes.Store(0)
+	kv.quota.reset()
+	if kv.lru != nil {
+		kv.lru = makeLRU()
+	}
+	kv.changes.reset(nil, 0)
+	for i := range kv.stripes {
+		s := &kv.stripes[i]
+		s.expiring = make(map[Key]struct{})
+		s.history = make(map[Key][]pastValue)
+		s.engine.Iterate(func(key Key, value Value) bool {
+			kv.index.insert(key)
+			kv.bytes.Add(keyBytes(key, value))
+			kv.valueBytes.Add(int64(len(value.value)))
+			kv.quota.add(key, value, 1)
+			kv.touch(key)
+			if !value.expires.IsZero() {
+				s.expiring[key] = struct{}{}
+			}
+			return true
+		})
+	}
+}
+
+// durable reports whether the engines keep the keys on disk.
+func (kv *KVServer) durable() bool {
+	_, ok := kv.stripes[0].engine.(DurableEngine)
+	return ok
+}
+
+// commitL commits the writes to the engines of keys, unless the
+// server was shut down and its log lost; see Persister.Retired.
+// Caller must hold kv.mu, or kv.mu shared and the stripes of keys for
+// writing.
+func (kv *KVServer) commitL(keys []string) {
+	if kv.persister != nil && kv.persister.Retired() {
+		return
+	}
+	for _, k := range keys {
+		if e, ok := kv.stripeOf(Key(k)).engine.(DurableEngine); ok {
+			e.Commit()
+		}
+	}
+}
+
+// syncL commits all writes to durable engines and waits for them to
+// reach the disk. It reports false if the server was shut down, and
+// then commits nothing. Caller must hold kv.mu.
+func (kv *KVServer) syncL() bool {
+	if kv.persister.Retired() {
+		return false
+	}
+	for i := range kv.stripes {
+		if e, ok := kv.stripes[i].engine.(DurableEngine); ok {
+			e.Sync()
+		}
+	}
+	return true
+}
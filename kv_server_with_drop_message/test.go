@@ -6,21 +6,106 @@ type TestKV struct {
 	*Test
 	t        *testing.T
 	reliable bool
+	nsrv     int
+
+	// set if sharded; the configuration lives on GRP0
+	ctrler *ShardCtrler
 }
 
 func MakeTestKV(t *testing.T, reliable bool) *TestKV {
-	cfg := MakeConfig(t, 1, reliable, StartKVServer)
+	return makeTestKV(t, 1, reliable, StartKVServer)
+}
+
+// Start a Raft group of nsrv servers.
+func MakeTestKVGroup(t *testing.T, nsrv int, reliable bool) *TestKV {
+	return makeTestKV(t, nsrv, reliable, StartKVServer)
+}
+
+// Start a primary-backup group of nsrv servers.
+func MakeTestPBGroup(t *testing.T, nsrv int, reliable bool) *TestKV {
+	return makeTestKV(t, nsrv, reliable, StartPBKVServer)
+}
+
+func makeTestKV(t *testing.T, nsrv int, reliable bool, mks FstartServer) *TestKV {
+	cfg := MakeConfig(t, nsrv, reliable, mks)
 	ts := &TestKV{
 		t:        t,
 		reliable: reliable,
+		nsrv:     nsrv,
 	}
 	ts.Test = MakeTest(t, cfg, false, ts)
 	return ts
 }
 
+// Start ngrp groups of nsrv servers, numbered from 1, and spread the
+// shards over them. GRP0 holds the shard configuration.
+func MakeTestShardKV(t *testing.T, ngrp, nsrv int, reliable bool) *TestKV {
+	return makeTestShardKV(t, ngrp, nsrv, reliable, StartKVServer)
+}
+
+// Same, with the servers of the groups started by mks.
+func makeTestShardKV(t *testing.T, ngrp, nsrv int, reliable bool, mks FstartServer) *TestKV {
+	cfg := MakeConfig(t, 1, reliable, StartKVServer)
+	ts := &TestKV{
+		t:        t,
+		reliable: reliable,
+		nsrv:     nsrv,
+	}
+	ts.Test = MakeTest(t, cfg, true, ts)
+
+	sc := MakeShardConfig()
+	sc.Num = 1
+	gids := make(map[Tgid][]string)
+	for g := 1; g <= ngrp; g++ {
+		gid := Tgid(g)
+		cfg.MakeGroupStart(gid, nsrv, mks)
+		for i := 0; i < nsrv; i++ {
+			gids[gid] = append(gids[gid], ServerName(gid, i))
+		}
+	}
+	sc.Join(gids)
+
+	ts.ctrler = MakeShardCtrler(cfg.MakeClient(), ServerName(GRP0, 0))
+	if err := ts.ctrler.InitConfig(sc); err != OK {
+		t.Fatalf("InitConfig err %v", err)
+	}
+	return ts
+}
+
 func (ts *TestKV) MakeClerk() IKVClerk {
 	clnt := ts.Config.MakeClient()
-	ck := MakeClerk(clnt, ServerName(GRP0, 0))
+	if ts.ctrler != nil {
+		return &TestClerk{MakeShardClerk(clnt, ServerName(GRP0, 0)), clnt}
+	}
+	servers := make([]string, ts.nsrv)
+	for i := range servers {
+		servers[i] = ServerName(GRP0, i)
+	}
+	ck := MakeClerk(clnt, servers...)
+	return &TestClerk{ck, clnt}
+}
+
+// Make a Clerk whose keys are those of namespace; not for a sharded
+// deployment.
+func (ts *TestKV) MakeClerkInNamespace(namespace string) IKVClerk {
+	clnt := ts.Config.MakeClient()
+	servers := make([]string, ts.nsrv)
+	for i := range servers {
+		servers[i] = ServerName(GRP0, i)
+	}
+	ck := MakeClerkInNamespace(clnt, namespace, servers...)
+	return &TestClerk{ck, clnt}
+}
+
+// Make a Clerk that sends cred with its requests; not for a sharded
+// deployment.
+func (ts *TestKV) MakeClerkWithCredential(cred Credential) IKVClerk {
+	clnt := ts.Config.MakeClient()
+	servers := make([]string, ts.nsrv)
+	for i := range servers {
+		servers[i] = ServerName(GRP0, i)
+	}
+	ck := MakeClerkWithCredential(clnt, cred, servers...)
 	return &TestClerk{ck, clnt}
 }
 
@@ -28,3 +113,11 @@ func (ts *TestKV) DeleteClerk(ck IKVClerk) {
 	tck := ck.(*TestClerk)
 	ts.DeleteClient(tck.Clnt)
 }
+
+// Shut down the server and start it again from its persisted state.
+func (ts *TestKV) Restart() {
+	grp := ts.Group(GRP0)
+	grp.ShutdownServer(0)
+	grp.StartServer(0)
+	grp.ConnectOne(0)
+}
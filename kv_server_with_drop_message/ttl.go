@@ -0,0 +1,157 @@
+package kv_server_with_stable_network
+
+import "time"
+
+// how often the reaper looks for expired keys
+const ReapInterval = 100 * time.Millisecond
+
+func (v Value) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+// lookupL returns the value of key, treating an expired key as if it
+// didn't exist. It leaves the key for the reaper, so that its removal
+// is replicated and makes a change; a write that creates the key
+// again replaces it (see setValueL). Caller must hold kv.mu, or kv.mu
+// shared and the key's stripe.
+func (kv *KVServer) lookupL(key Key) (Value, bool) {
+	value, found := kv.valueL(key)
+	if found && value.expired(kv.nowL()) {
+		return Value{}, false
+	}
+	return value, found
+}
+
+// removeL deletes key and wakes up its watchers. Caller must hold
+// kv.mu, or kv.mu shared and the key's stripe for writing.
+func (kv *KVServer) removeL(key Key) {
+	s := kv.stripeOf(key)
+	if value, found := s.engine.Get(key); found {
+		kv.bytes.Add(-keyBytes(key, value))
+		kv.valueBytes.Add(-int64(len(value.value)))
+		kv.quota.add(key, value, -1)
+	}
+	if kv.lru != nil {
+		kv.lru.remove(key)
+	}
+	s.engine.Delete(key)
+	delete(s.expiring, key)
+	delete(s.history, key)
+	kv.index.remove(key)
+	kv.changed.Broadcast()
+}
+
+// nowL returns the time as of which the server performs a request:
+// while a Raft server applies an Op, the time its leader stamped on
+// it, so that every server agrees on which keys have expired and on
+// the times in keys' metadata and history; otherwise the server's
+// clock. Caller must hold kv.mu, or kv.mu shared.
+func (kv *KVServer) nowL() time.Time {
+	if kv.raft != nil && !kv.raft.now.IsZero() {
+		return kv.raft.now
+	}
+	return time.Now()
+}
+
+// deadlineL returns when a key written now with ttl expires, or the
+// zero time if ttl is 0 and the key never expires. Caller must hold
+// kv.mu, or kv.mu shared.
+func (kv *KVServer) deadlineL(ttl time.Duration) time.Time {
+	if ttl > 0 {
+		return kv.nowL().Add(ttl)
+	}
+	return time.Time{}
+}
+
+// unixNano returns t in Unix nanoseconds, or 0 for the zero time,
+// which fromUnixNano turns back into the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// ExpireArgs asks a server to remove those of Keys that have expired
+// at Now, in Unix nanoseconds. The reaper fixes Now, so that every
+// replica removes the same keys.
+type ExpireArgs struct {
+	Keys []string
+	Now  int64
+}
+
+// reaper removes expired keys in the background, so that they go
+// away even if no client touches them again. Only the server that
+// serves clerks looks for expired keys, and it removes them with an
+// Expire, which goes through the Raft log or to the backups like a
+// Delete, and into the change log (see changes.go). It stops when the
+// server is killed.
+func (kv *KVServer) reaper() {
+	ticker := time.NewTicker(ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kv.stop:
+			return
+		case <-ticker.C:
+		}
+
+		kv.mu.Lock()
+		now := time.Now()
+		keys := []string{}
+		if kv.primaryL() {
+			for i := range kv.stripes {
+				s := &kv.stripes[i]
+				for key := range s.expiring {
+					if value, _ := s.engine.Get(key); value.expired(now) {
+						keys = append(keys, string(key))
+					}
+				}
+			}
+		}
+		kv.pruneHistoryL(now)
+		kv.mu.Unlock()
+
+		if len(keys) > 0 {
+			args := &ExpireArgs{Keys: keys, Now: now.UnixNano()}
+			kv.perform(Op{Expire: args}, func(*opResult) bool {
+				rec, ok := kv.expire(args)
+				return !ok || kv.replicate(rec)
+			})
+		}
+		kv.maybeCompact()
+	}
+}
+
+func (kv *KVServer) expire(args *ExpireArgs) (walRecord, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.expireOpL(args)
+}
+
+// expireOpL removes the keys of args that have expired, and returns
+// the record to replicate, unless there were none. Caller must hold
+// kv.mu.
+func (kv *KVServer) expireOpL(args *ExpireArgs) (walRecord, bool) {
+	now := time.Unix(0, args.Now)
+	removed := []string{}
+	for _, k := range args.Keys {
+		if value, found := kv.valueL(Key(k)); found && value.expired(now) {
+			kv.removeL(Key(k))
+			removed = append(removed, k)
+		}
+	}
+	if len(removed) == 0 {
+		return walRecord{}, false
+	}
+	return kv.persistL(0, removed...), true
+}